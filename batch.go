@@ -0,0 +1,199 @@
+package bisp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// BatchID is the reserved procedure ID of batch frames. Registered procedures start at ID 1.
+const BatchID ID = 0
+
+// BatchEntrySize is the size of the fixed part of a batch entry: flags, procedure ID, transaction ID and length.
+const BatchEntrySize = FlagsSize + TypeIDSize + TransactionIDSize + LengthSize
+
+// BatchEntry is a single procedure call, response or error in a batch frame.
+type BatchEntry struct {
+	Kind          PKind
+	ProcedureID   ID
+	TransactionID TransactionID
+	Procedure     any
+	Err           error
+}
+
+// Batch carries multiple procedure calls, or their responses, in a single frame.
+type Batch []BatchEntry
+
+// EncodeBatch encodes the entries of b as a single procedure frame with the BatchID type. Entries with Err set are
+// encoded as errors, the ProcedureID of those entries must be set by the caller.
+func (e *Encoder) EncodeBatch(b Batch, opts *EncodeProcedureOpts) error {
+	e.buf.Reset()
+	var (
+		err      error
+		msgBytes []byte
+		header   Header
+	)
+	if len(b) > MaxTcpMessageBodySize {
+		return errors.New(fmt.Sprintf("too many batch entries. length: %d max: %d", len(b), MaxTcpMessageBodySize))
+	}
+	header.SetFlag(FProcedure)
+	opts.apply(&header)
+	if err = e.encodeLength(len(b), false); err != nil {
+		return err
+	}
+	for i := range b {
+		if err = e.encodeBatchEntry(&b[i]); err != nil {
+			return err
+		}
+	}
+	length := e.buf.Len()
+	if length > MaxTcpMessageBodySize {
+		return errors.New(fmt.Sprintf("message body too large. length: %d max: %d", length, MaxTcpMessageBodySize))
+	}
+	msgBytes, err = e.EncodeHeader(&header, BatchID, length)
+	if err != nil {
+		return err
+	}
+	return e.write(&header, msgBytes)
+}
+
+func (e *Encoder) encodeBatchEntry(entry *BatchEntry) error {
+	var flags Flag
+	pid := entry.ProcedureID
+	if entry.Err != nil {
+		flags |= FError
+	} else {
+		if entry.Kind == Unknown {
+			return errors.New(fmt.Sprintf("batch entry kind %s, set either %s, %s or %s", Unknown, Call, Response, Notify))
+		}
+		id, err := GetProcedureID(entry.Procedure)
+		if err != nil {
+			return err
+		}
+		pid = id
+	}
+	e.buf.WriteByte(byte(flags))
+	if err := binary.Write(e.buf, binary.BigEndian, uint16(pid)); err != nil {
+		return err
+	}
+	e.buf.Write(entry.TransactionID[:])
+
+	// The length is written once the payload is encoded.
+	lengthPos := e.buf.Len()
+	if err := e.encodeLength(0, false); err != nil {
+		return err
+	}
+	if entry.Err != nil {
+		if err := e.encodeUint8(reflect.ValueOf(uint8(Response)), false); err != nil {
+			return err
+		}
+		if err := e.encodeString(reflect.ValueOf(entry.Err.Error()), false); err != nil {
+			return err
+		}
+	} else if err := e.encodeProcedure(reflect.ValueOf(entry.Procedure), pid, entry.Kind); err != nil {
+		return err
+	}
+	length := e.buf.Len() - lengthPos - LengthSize
+	if length > MaxTcpMessageBodySize {
+		return errors.New(fmt.Sprintf("batch entry too large. length: %d max: %d", length, MaxTcpMessageBodySize))
+	}
+	binary.BigEndian.PutUint16(e.buf.Bytes()[lengthPos:], uint16(length))
+	return nil
+}
+
+// DecodeBatch decodes the body of a batch frame of length l. Entries of unknown procedures, or entries that fail to
+// decode, are returned with Err set rather than failing the whole batch.
+func (d *Decoder) DecodeBatch(l uint32) (Batch, error) {
+	if err := d.readBody(l, "batch"); err != nil {
+		return nil, err
+	}
+	return d.decodeBatch()
+}
+
+// decodeBatch decodes a batch that has been read into the buffer.
+func (d *Decoder) decodeBatch() (Batch, error) {
+	count, err := d.decodeLength(reflect.Value{}, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.checkCollection(count, BatchEntrySize, int(reflect.TypeOf(BatchEntry{}).Size())); err != nil {
+		return nil, err
+	}
+	batch := make(Batch, count)
+	for i := range batch {
+		if err = d.decodeBatchEntry(&batch[i]); err != nil {
+			return nil, err
+		}
+	}
+	return batch, nil
+}
+
+func (d *Decoder) decodeBatchEntry(entry *BatchEntry) error {
+	flags, err := d.decodeUint8(reflect.Value{}, false)
+	if err != nil {
+		return err
+	}
+	var pID uint16
+	if pID, err = d.decodeUint16(reflect.Value{}, false); err != nil {
+		return err
+	}
+	entry.ProcedureID = ID(pID)
+	if err = d.need(TransactionIDSize); err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(d.buf, entry.TransactionID[:]); err != nil {
+		return err
+	}
+	var length int
+	if length, err = d.decodeLength(reflect.Value{}, false); err != nil {
+		return err
+	}
+	if err = d.need(length); err != nil {
+		return err
+	}
+	payload := d.buf.Next(length)
+	if len(payload) != length {
+		return errors.New("unexpected end of batch entry")
+	}
+
+	sub := d.sub(payload)
+	defer func() {
+		d.alloc = sub.alloc
+	}()
+	if Flag(flags)&FError == FError {
+		entry.Kind = Response
+		if _, err = sub.decodeUint8(reflect.Value{}, false); err != nil {
+			return err
+		}
+		var msg string
+		if msg, err = sub.decodeString(reflect.Value{}, false); err != nil {
+			return err
+		}
+		entry.Err = errors.New(msg)
+		return nil
+	}
+	typ, err := GetProcedureFromID(entry.ProcedureID)
+	if err != nil {
+		entry.Err = err
+		return nil
+	}
+	val := reflect.New(typ).Elem()
+	if err = sub.decodeProcedure(val, entry.ProcedureID); err != nil {
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			return err
+		}
+		entry.Err = err
+		return nil
+	}
+	// A payload longer than the procedure it names was encoded for another procedure.
+	if sub.buf.Len() > 0 {
+		entry.Err = errors.New(fmt.Sprintf("batch entry for procedure %s has %d trailing bytes", typ, sub.buf.Len()))
+		return nil
+	}
+	entry.Kind = procedureKind(val.Interface())
+	entry.Procedure = val.Interface()
+	return nil
+}
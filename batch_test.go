@@ -0,0 +1,157 @@
+package bisp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecodeBatch(t *testing.T) {
+	stringID, err := bisp.GetProcedureID(pString)
+	assert.NoError(t, err)
+	batch := bisp.Batch{
+		{Kind: bisp.Call, TransactionID: bisp.TransactionID{1}, Procedure: pString},
+		{Kind: bisp.Notify, TransactionID: bisp.TransactionID{2}, Procedure: pNotification},
+		{Kind: bisp.Response, TransactionID: bisp.TransactionID{3}, Procedure: pInt},
+		{Kind: bisp.Response, ProcedureID: stringID, TransactionID: bisp.TransactionID{4}, Err: errors.New("boom")},
+	}
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoder(buf)
+	err = encoder.EncodeBatch(batch, &bisp.EncodeProcedureOpts{TransactionID: testTransactionID})
+	assert.NoError(t, err)
+	// The procedure IDs of the entries are looked up while encoding, leaving the batch unmodified.
+	assert.Equal(t, bisp.ID(0), batch[0].ProcedureID)
+
+	decoder := bisp.NewDecoder(buf)
+	var msg bisp.Message
+	err = decoder.Decode(&msg)
+	assert.NoError(t, err)
+	assert.Equal(t, bisp.BatchID, msg.Header.Type)
+	assert.Equal(t, testTransactionID, msg.Header.TransactionID)
+
+	res, ok := msg.Body.(bisp.Batch)
+	assert.True(t, ok)
+	assert.Len(t, res, len(batch))
+	assert.Equal(t, bisp.Call, res[0].Kind)
+	assert.Equal(t, stringID, res[0].ProcedureID)
+	assert.Equal(t, bisp.TransactionID{1}, res[0].TransactionID)
+	assert.Equal(t, TestProcedureString{Procedure: bisp.Procedure[string]{Kind: bisp.Call}, String: "Hello"}, res[0].Procedure)
+	assert.Equal(t, bisp.Notify, res[1].Kind)
+	assert.Equal(t, TestNotification{Notification: bisp.Notification{Kind: bisp.Notify}, String: "Hello", Int: 42}, res[1].Procedure)
+	assert.Equal(t, bisp.Response, res[2].Kind)
+	assert.Equal(t, TestProcedureInt{Procedure: bisp.Procedure[int]{Kind: bisp.Response, Out: 42}}, res[2].Procedure)
+	assert.Equal(t, bisp.Response, res[3].Kind)
+	assert.Equal(t, stringID, res[3].ProcedureID)
+	assert.Nil(t, res[3].Procedure)
+	assert.EqualError(t, res[3].Err, "boom")
+}
+
+func TestEncodeBatch_UnknownKind(t *testing.T) {
+	encoder := bisp.NewEncoder(new(bytes.Buffer))
+	err := encoder.EncodeBatch(bisp.Batch{{Procedure: pString}}, nil)
+	assert.Error(t, err)
+}
+
+func TestDecodeBatch_UnknownProcedure(t *testing.T) {
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoder(buf)
+	err := encoder.EncodeBatch(bisp.Batch{
+		{Kind: bisp.Call, Procedure: pString},
+		{Kind: bisp.Call, Procedure: pInt},
+	}, nil)
+	assert.NoError(t, err)
+
+	// Point the first entry at an unregistered procedure ID.
+	encoded := buf.Bytes()
+	entry := bisp.HeaderSize + bisp.LengthSize
+	encoded[entry+bisp.FlagsSize] = 0xff
+	encoded[entry+bisp.FlagsSize+1] = 0xff
+
+	decoder := bisp.NewDecoder(bytes.NewReader(encoded))
+	var msg bisp.Message
+	err = decoder.Decode(&msg)
+	assert.NoError(t, err)
+	res := msg.Body.(bisp.Batch)
+	assert.Len(t, res, 2)
+	assert.Error(t, res[0].Err)
+	assert.NoError(t, res[1].Err)
+	assert.Equal(t, TestProcedureInt{Procedure: bisp.Procedure[int]{Kind: bisp.Call}, Int: 42}, res[1].Procedure)
+}
+
+func TestClient_CallBatch(t *testing.T) {
+	received := make(chan TestNotificationMetric, 1)
+	srv, conn := newTestServer(t, nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestNotificationMetric) error {
+		received <- *p
+		return nil
+	})
+	client := bisp.NewClient(conn, nil)
+
+	res, err := client.CallBatch(context.Background(),
+		bisp.BatchEntry{Kind: bisp.Call, Procedure: TestProcedureAdd{A: 1, B: 2}},
+		bisp.BatchEntry{Kind: bisp.Notify, Procedure: TestNotificationMetric{Name: "requests", Value: 1}},
+		bisp.BatchEntry{Kind: bisp.Call, Procedure: TestProcedureFail{Reason: "boom"}},
+		bisp.BatchEntry{Kind: bisp.Call, Procedure: TestProcedureAdd{A: 40, B: 2}},
+	)
+	assert.NoError(t, err)
+	assert.Len(t, res, 4)
+	assert.NoError(t, res[0].Err)
+	assert.Equal(t, 3, res[0].Procedure.(TestProcedureAdd).Out)
+	assert.Equal(t, bisp.Notify, res[1].Kind)
+	assert.EqualError(t, res[2].Err, "boom")
+	assert.Equal(t, 42, res[3].Procedure.(TestProcedureAdd).Out)
+	select {
+	case p := <-received:
+		assert.Equal(t, "requests", p.Name)
+	case <-time.After(time.Second):
+		t.Fatal("notification not dispatched")
+	}
+}
+
+func TestClient_CallBatchNotifyOnly(t *testing.T) {
+	received := make(chan TestNotificationMetric, 2)
+	srv, conn := newTestServer(t, nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestNotificationMetric) error {
+		received <- *p
+		return nil
+	})
+	client := bisp.NewClient(conn, nil)
+
+	res, err := client.CallBatch(context.Background(),
+		bisp.BatchEntry{Kind: bisp.Notify, Procedure: TestNotificationMetric{Name: "a"}},
+		bisp.BatchEntry{Kind: bisp.Notify, Procedure: TestNotificationMetric{Name: "b"}},
+	)
+	assert.NoError(t, err)
+	assert.Len(t, res, 2)
+	for range 2 {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("notification not dispatched")
+		}
+	}
+}
+
+func TestClient_CallBatchNotSent(t *testing.T) {
+	conn, server := net.Pipe()
+	defer server.Close()
+	client := bisp.NewClient(brokenWriteConn{conn}, nil)
+
+	_, err := client.CallBatch(context.Background(),
+		bisp.BatchEntry{Kind: bisp.Call, Procedure: TestProcedureAdd{A: 1, B: 2}},
+	)
+	assert.ErrorIs(t, err, bisp.ErrNotSent)
+	assert.ErrorIs(t, err, bisp.ErrClientClosed)
+
+	// Later batches fail without being sent either.
+	_, err = client.CallBatch(context.Background(),
+		bisp.BatchEntry{Kind: bisp.Notify, Procedure: TestNotificationMetric{Name: "requests"}},
+	)
+	assert.ErrorIs(t, err, bisp.ErrClientClosed)
+}
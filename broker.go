@@ -0,0 +1,533 @@
+package bisp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultQueueSize is the number of frames queued for each subscriber when BrokerOpts.QueueSize is not set.
+const DefaultQueueSize = 256
+
+// TopicLengthSize is the size of the length preceding the topic in the body of a ControlPublish frame.
+const TopicLengthSize = 2
+
+var (
+	// ErrSlowConsumer is returned to subscribers disconnected by the SlowConsumerDisconnect policy.
+	ErrSlowConsumer = errors.New("slow consumer disconnected")
+	ErrBrokerClosed = errors.New("broker closed")
+)
+
+// SlowConsumerPolicy decides what happens to a message published while the queue of a subscriber is full.
+type SlowConsumerPolicy uint8
+
+const (
+	// SlowConsumerDrop drops the message for that subscriber.
+	SlowConsumerDrop SlowConsumerPolicy = iota
+	// SlowConsumerDisconnect drops the subscriber, closing its connection.
+	SlowConsumerDisconnect
+)
+
+type BrokerOpts struct {
+	// QueueSize is the number of frames queued for each subscriber. Zero means DefaultQueueSize.
+	QueueSize int
+	// SlowConsumer is the policy for subscribers whose queue is full.
+	SlowConsumer SlowConsumerPolicy
+	// OnError is called with errors that can't be returned, such as malformed frames received by ServeConn.
+	OnError func(err error)
+	// Encoder holds the options of the frames written by the broker.
+	Encoder EncoderOpts
+	// Decoder holds the options of the frames read by ServeConn and Subscription.Receive.
+	Decoder DecoderOpts
+}
+
+// Broker fans published messages out to the subscribers of their topic, in process with Subscribe, or over connections
+// served with ServeConn and a BrokerClient on the other end. Messages are published as ControlPublish frames holding
+// the topic and the encoded message frame, and the same frame is queued for every subscriber, so a message is encoded
+// once however many subscribers it has. The body can be any registered type.
+type Broker struct {
+	opts   BrokerOpts
+	mu     sync.RWMutex
+	topics map[string]map[*subscriber]struct{}
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+// subscriber is an in-process Subscription or a connection served by ServeConn.
+type subscriber struct {
+	queue   chan []byte
+	topics  map[string]struct{}
+	dropped atomic.Uint64
+	once    sync.Once
+	err     error
+	done    chan struct{}
+	onClose func()
+}
+
+func NewBroker(opts *BrokerOpts) *Broker {
+	b := &Broker{
+		topics: make(map[string]map[*subscriber]struct{}, 16),
+		subs:   make(map[*subscriber]struct{}, 16),
+	}
+	if opts != nil {
+		b.opts = *opts
+	}
+	if b.opts.QueueSize <= 0 {
+		b.opts.QueueSize = DefaultQueueSize
+	}
+	return b
+}
+
+// Publish encodes msg once, and queues it for every subscriber of topic.
+func (b *Broker) Publish(topic string, msg *Message) error {
+	frame, err := encodePublish(topic, msg, &b.opts.Encoder)
+	if err != nil {
+		return err
+	}
+	b.fanout(topic, frame)
+	return nil
+}
+
+// Subscribe returns an in-process subscription to topic.
+func (b *Broker) Subscribe(topic string) (*Subscription, error) {
+	if err := checkTopic(topic); err != nil {
+		return nil, err
+	}
+	sub, err := b.newSubscriber(nil)
+	if err != nil {
+		return nil, err
+	}
+	b.subscribe(sub, topic)
+	return &Subscription{broker: b, sub: sub}, nil
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine.
+func (b *Broker) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := b.ServeConn(conn); err != nil {
+				b.reportError(err)
+			}
+		}()
+	}
+}
+
+// ServeConn reads ControlSubscribe, ControlUnsubscribe and ControlPublish frames from conn until it is closed, and
+// writes the messages published to its topics. It returns ErrSlowConsumer if the connection was dropped by the
+// SlowConsumerDisconnect policy.
+func (b *Broker) ServeConn(conn net.Conn) error {
+	sub, err := b.newSubscriber(func() {
+		_ = conn.Close()
+	})
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer b.remove(sub, net.ErrClosed)
+	go b.writeLoop(conn, sub)
+
+	d := NewDecoderWithOpts(bufio.NewReader(conn), &b.opts.Decoder)
+	for {
+		header, err := d.DecodeHeader()
+		if err == nil {
+			err = d.readBody(uint32(header.Length), "broker frame")
+		}
+		if err != nil {
+			if errors.Is(sub.closeErr(), ErrSlowConsumer) {
+				return ErrSlowConsumer
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !header.HasFlag(FControl) {
+			b.reportError(errors.New(fmt.Sprintf("unexpected message of type %d, expected a broker control frame", header.Type)))
+			continue
+		}
+		body := d.buf.Bytes()
+		switch header.Type {
+		case ControlPing:
+			pong, err := encodeControlFrame(&Header{Flags: FControl}, ControlPong, nil, &b.opts.Encoder)
+			if err == nil {
+				b.enqueue(sub, pong)
+			}
+		case ControlSubscribe, ControlUnsubscribe:
+			topic := string(body)
+			if err = checkTopic(topic); err != nil {
+				b.reportError(err)
+				continue
+			}
+			if header.Type == ControlSubscribe {
+				b.subscribe(sub, topic)
+			} else {
+				b.unsubscribe(sub, topic)
+			}
+		case ControlPublish:
+			var topic string
+			if topic, _, err = splitPublish(body); err != nil {
+				b.reportError(err)
+				continue
+			}
+			// Only the header of the frame is encoded again, the body is forwarded as is.
+			var frame []byte
+			if frame, err = encodeControlFrame(publishHeader(len(body)), ControlPublish, body, &b.opts.Encoder); err != nil {
+				b.reportError(err)
+				continue
+			}
+			b.fanout(topic, frame)
+		}
+	}
+}
+
+// Close disconnects every subscriber. Their Receive returns ErrBrokerClosed.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	subs := make([]*subscriber, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+	for _, sub := range subs {
+		b.remove(sub, ErrBrokerClosed)
+	}
+	return nil
+}
+
+func (b *Broker) newSubscriber(onClose func()) (*subscriber, error) {
+	sub := &subscriber{
+		queue:   make(chan []byte, b.opts.QueueSize),
+		topics:  make(map[string]struct{}),
+		done:    make(chan struct{}),
+		onClose: onClose,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	b.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *Broker) subscribe(sub *subscriber, topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	subs, ok := b.topics[topic]
+	if !ok {
+		subs = make(map[*subscriber]struct{})
+		b.topics[topic] = subs
+	}
+	subs[sub] = struct{}{}
+	sub.topics[topic] = struct{}{}
+}
+
+func (b *Broker) unsubscribe(sub *subscriber, topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unsubscribeLocked(sub, topic)
+}
+
+func (b *Broker) unsubscribeLocked(sub *subscriber, topic string) {
+	delete(sub.topics, topic)
+	if subs, ok := b.topics[topic]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(b.topics, topic)
+		}
+	}
+}
+
+// remove unsubscribes sub from every topic, and closes it with err.
+func (b *Broker) remove(sub *subscriber, err error) {
+	b.mu.Lock()
+	for topic := range sub.topics {
+		b.unsubscribeLocked(sub, topic)
+	}
+	delete(b.subs, sub)
+	b.mu.Unlock()
+	sub.close(err)
+}
+
+// fanout queues frame for every subscriber of topic, applying BrokerOpts.SlowConsumer to subscribers with a full queue.
+func (b *Broker) fanout(topic string, frame []byte) {
+	var slow []*subscriber
+	b.mu.RLock()
+	for sub := range b.topics[topic] {
+		if !b.tryEnqueue(sub, frame) && b.opts.SlowConsumer == SlowConsumerDisconnect {
+			slow = append(slow, sub)
+		}
+	}
+	b.mu.RUnlock()
+	for _, sub := range slow {
+		b.remove(sub, ErrSlowConsumer)
+	}
+}
+
+func (b *Broker) enqueue(sub *subscriber, frame []byte) {
+	if !b.tryEnqueue(sub, frame) && b.opts.SlowConsumer == SlowConsumerDisconnect {
+		b.remove(sub, ErrSlowConsumer)
+	}
+}
+
+func (b *Broker) tryEnqueue(sub *subscriber, frame []byte) bool {
+	select {
+	case sub.queue <- frame:
+		return true
+	default:
+		sub.dropped.Add(1)
+		return false
+	}
+}
+
+// writeLoop writes the frames queued for a connection until it is closed.
+func (b *Broker) writeLoop(conn net.Conn, sub *subscriber) {
+	for {
+		select {
+		case frame := <-sub.queue:
+			if _, err := conn.Write(frame); err != nil {
+				b.remove(sub, err)
+				return
+			}
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+func (b *Broker) reportError(err error) {
+	if err != nil && b.opts.OnError != nil {
+		b.opts.OnError(err)
+	}
+}
+
+func (s *subscriber) close(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+}
+
+// closeErr returns the error sub was closed with, or nil if it is open.
+func (s *subscriber) closeErr() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Subscription receives the messages published to a topic of a Broker in process.
+type Subscription struct {
+	broker *Broker
+	sub    *subscriber
+}
+
+// Receive returns the next message published to the topic. Messages queued before the subscription was closed are
+// returned first.
+func (s *Subscription) Receive(ctx context.Context) (*Message, error) {
+	var frame []byte
+	select {
+	case frame = <-s.sub.queue:
+	default:
+		select {
+		case frame = <-s.sub.queue:
+		case <-s.sub.done:
+			return nil, s.sub.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	d := NewDecoderWithOpts(bytes.NewReader(frame), &s.broker.opts.Decoder)
+	header, err := d.DecodeHeader()
+	if err == nil {
+		err = d.readBody(uint32(header.Length), "publish frame")
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, msg, err := decodePublish(d.buf.Bytes(), &s.broker.opts.Decoder)
+	return msg, err
+}
+
+// Dropped returns the number of messages dropped because the queue of the subscription was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.sub.dropped.Load()
+}
+
+// Unsubscribe closes the subscription. Receive returns net.ErrClosed once the queued messages are received.
+func (s *Subscription) Unsubscribe() {
+	s.broker.remove(s.sub, net.ErrClosed)
+}
+
+type BrokerClientOpts struct {
+	Encoder EncoderOpts
+	Decoder DecoderOpts
+}
+
+// BrokerClient subscribes and publishes to a Broker over a connection served by Broker.ServeConn. Sends are
+// serialized, so a BrokerClient is safe for concurrent use, while Receive is meant to be called from a single read loop.
+type BrokerClient struct {
+	conn net.Conn
+	opts BrokerClientOpts
+	wmu  sync.Mutex
+	rmu  sync.Mutex
+	dec  *Decoder
+}
+
+func NewBrokerClient(conn net.Conn, opts *BrokerClientOpts) *BrokerClient {
+	c := &BrokerClient{conn: conn}
+	if opts != nil {
+		c.opts = *opts
+	}
+	c.dec = NewDecoderWithOpts(bufio.NewReader(conn), &c.opts.Decoder)
+	return c
+}
+
+// Subscribe subscribes the connection to topic. Messages published to it are returned by Receive.
+func (c *BrokerClient) Subscribe(topic string) error {
+	return c.sendTopic(ControlSubscribe, topic)
+}
+
+func (c *BrokerClient) Unsubscribe(topic string) error {
+	return c.sendTopic(ControlUnsubscribe, topic)
+}
+
+// Publish sends msg to the subscribers of topic.
+func (c *BrokerClient) Publish(topic string, msg *Message) error {
+	frame, err := encodePublish(topic, msg, &c.opts.Encoder)
+	if err != nil {
+		return err
+	}
+	return c.write(frame)
+}
+
+// Receive returns the next message published to a subscribed topic, with its topic.
+func (c *BrokerClient) Receive() (string, *Message, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		header, err := c.dec.DecodeHeader()
+		if err == nil {
+			err = c.dec.readBody(uint32(header.Length), "publish frame")
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if header.HasFlag(FControl) && header.Type == ControlPublish {
+			return decodePublish(c.dec.buf.Bytes(), &c.opts.Decoder)
+		}
+	}
+}
+
+func (c *BrokerClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *BrokerClient) sendTopic(typ ID, topic string) error {
+	if err := checkTopic(topic); err != nil {
+		return err
+	}
+	frame, err := encodeControlFrame(&Header{Flags: FControl}, typ, []byte(topic), &c.opts.Encoder)
+	if err != nil {
+		return err
+	}
+	return c.write(frame)
+}
+
+func (c *BrokerClient) write(frame []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func checkTopic(topic string) error {
+	if topic == "" || len(topic) > MaxTcpMessageBodySize {
+		return errors.New(fmt.Sprintf("invalid topic length %d", len(topic)))
+	}
+	return nil
+}
+
+// encodePublish encodes a ControlPublish frame, whose body is the length of the topic, the topic and the frame of msg.
+func encodePublish(topic string, msg *Message, opts *EncoderOpts) ([]byte, error) {
+	if err := checkTopic(topic); err != nil {
+		return nil, err
+	}
+	inner := *opts
+	inner.Sync = false
+	inner.ChunkSize = 0
+	buf := new(bytes.Buffer)
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(topic))))
+	buf.WriteString(topic)
+	if err := NewEncoderWithOpts(buf, &inner).Encode(msg); err != nil {
+		return nil, err
+	}
+	return encodeControlFrame(publishHeader(buf.Len()), ControlPublish, buf.Bytes(), opts)
+}
+
+func publishHeader(length int) *Header {
+	h := &Header{Flags: FControl}
+	if length > MaxTcpMessageBodySize {
+		h.SetFlag(F32b)
+	}
+	return h
+}
+
+// encodeControlFrame returns the bytes of a control frame with an already encoded body.
+func encodeControlFrame(h *Header, typ ID, body []byte, opts *EncoderOpts) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := NewEncoderWithOpts(buf, opts).encodeFrame(h, typ, body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// splitPublish splits the body of a ControlPublish frame into the topic and the frame of the message.
+func splitPublish(body []byte) (string, []byte, error) {
+	if len(body) < TopicLengthSize {
+		return "", nil, errors.New("unexpected end of publish frame")
+	}
+	l := int(binary.BigEndian.Uint16(body))
+	if len(body) < TopicLengthSize+l {
+		return "", nil, errors.New("unexpected end of publish frame")
+	}
+	topic := string(body[TopicLengthSize : TopicLengthSize+l])
+	if err := checkTopic(topic); err != nil {
+		return "", nil, err
+	}
+	return topic, body[TopicLengthSize+l:], nil
+}
+
+func decodePublish(body []byte, opts *DecoderOpts) (string, *Message, error) {
+	topic, frame, err := splitPublish(body)
+	if err != nil {
+		return "", nil, err
+	}
+	inner := *opts
+	inner.Sync = false
+	var msg Message
+	if err = NewDecoderWithOpts(bytes.NewReader(frame), &inner).Decode(&msg); err != nil {
+		return "", nil, err
+	}
+	return topic, &msg, nil
+}
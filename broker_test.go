@@ -0,0 +1,130 @@
+package bisp_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_Subscribe(t *testing.T) {
+	broker := bisp.NewBroker(nil)
+	defer broker.Close()
+	a, err := broker.Subscribe("news")
+	assert.NoError(t, err)
+	b, err := broker.Subscribe("news")
+	assert.NoError(t, err)
+	other, err := broker.Subscribe("other")
+	assert.NoError(t, err)
+
+	assert.NoError(t, broker.Publish("news", &bisp.Message{Body: testStruct{A: 1, B: "news", C: true}}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, sub := range []*bisp.Subscription{a, b} {
+		msg, err := sub.Receive(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, testStruct{A: 1, B: "news", C: true}, msg.Body)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	_, err = other.Receive(short)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	a.Unsubscribe()
+	_, err = a.Receive(ctx)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = broker.Subscribe("")
+	assert.Error(t, err)
+}
+
+func TestBroker_SlowConsumer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	drop := bisp.NewBroker(&bisp.BrokerOpts{QueueSize: 1})
+	defer drop.Close()
+	sub, err := drop.Subscribe("topic")
+	assert.NoError(t, err)
+	for i := range 3 {
+		assert.NoError(t, drop.Publish("topic", &bisp.Message{Body: int32(i)}))
+	}
+	assert.Equal(t, uint64(2), sub.Dropped())
+	msg, err := sub.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), msg.Body)
+
+	disconnect := bisp.NewBroker(&bisp.BrokerOpts{QueueSize: 1, SlowConsumer: bisp.SlowConsumerDisconnect})
+	defer disconnect.Close()
+	sub, err = disconnect.Subscribe("topic")
+	assert.NoError(t, err)
+	for i := range 3 {
+		assert.NoError(t, disconnect.Publish("topic", &bisp.Message{Body: int32(i)}))
+	}
+	// The queued message is still received.
+	msg, err = sub.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), msg.Body)
+	_, err = sub.Receive(ctx)
+	assert.ErrorIs(t, err, bisp.ErrSlowConsumer)
+}
+
+func newTestBrokerClient(t *testing.T, broker *bisp.Broker) *bisp.BrokerClient {
+	conn, server := net.Pipe()
+	go func() {
+		_ = broker.ServeConn(server)
+	}()
+	client := bisp.NewBrokerClient(conn, nil)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	return client
+}
+
+func TestBroker_ServeConn(t *testing.T) {
+	broker := bisp.NewBroker(nil)
+	defer broker.Close()
+	subscriber := newTestBrokerClient(t, broker)
+	publisher := newTestBrokerClient(t, broker)
+	local, err := broker.Subscribe("news")
+	assert.NoError(t, err)
+
+	// Frames of a connection are handled in order, so the subscription is active once its own message is received.
+	assert.NoError(t, subscriber.Subscribe("news"))
+	assert.NoError(t, subscriber.Publish("news", &bisp.Message{Body: "subscribed"}))
+	topic, msg, err := subscriber.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "news", topic)
+	assert.Equal(t, "subscribed", msg.Body)
+
+	large := make([]int, 20000)
+	for i := range large {
+		large[i] = i
+	}
+	assert.NoError(t, publisher.Publish("news", &bisp.Message{Header: bisp.Header{Flags: bisp.F32b}, Body: large}))
+	topic, msg, err = subscriber.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "news", topic)
+	assert.Equal(t, large, msg.Body)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, body := range []any{"subscribed", large} {
+		msg, err = local.Receive(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, body, msg.Body)
+	}
+
+	assert.NoError(t, subscriber.Unsubscribe("news"))
+	assert.NoError(t, subscriber.Subscribe("other"))
+	assert.NoError(t, subscriber.Publish("other", &bisp.Message{Body: "other"}))
+	assert.NoError(t, broker.Publish("news", &bisp.Message{Body: "unsubscribed"}))
+	topic, msg, err = subscriber.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "other", topic)
+	assert.Equal(t, "other", msg.Body)
+}
@@ -0,0 +1,420 @@
+package bisp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"reflect"
+)
+
+// readerSegmentSize is the maximum size of the segments io.Reader fields are encoded as.
+const readerSegmentSize = MaxTcpMessageBodySize
+
+// EncodeStream writes the data read from r as the body of a message of type typeID, split into frames of at most
+// EncoderOpts.ChunkSize bytes, or DefaultChunkSize if it is not set. The data is written as it is read, without being
+// encoded, so it is read back with Decoder.DecodeStream.
+func (e *Encoder) EncodeStream(h *Header, typeID ID, r io.Reader) error {
+	size := e.opts.ChunkSize
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	size = min(size, Max32bMessageBodySize)
+	if !h.HasFlag(F32b) {
+		size = min(size, MaxTcpMessageBodySize)
+	}
+	chunk := make([]byte, size)
+	for frames := 0; ; frames++ {
+		n, err := io.ReadFull(r, chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			if frames > 0 {
+				return e.abort(err)
+			}
+			return err
+		}
+		header := *h
+		if !last {
+			header.Extensions |= ExtMore
+		}
+		msgBytes, err := e.EncodeHeader(&header, typeID, n)
+		if err != nil {
+			return err
+		}
+		if err = e.writeBody(&header, msgBytes, chunk[:n]); err != nil {
+			if frames > 0 {
+				return e.abort(err)
+			}
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// DecodeStream decodes the header of the next message, and returns a reader of its body. The frames of a chunked body
+// are read as the reader is, so the reader must be read until io.EOF before the next message is decoded. The body is
+// not decoded, see Encoder.EncodeStream.
+func (d *Decoder) DecodeStream() (*Header, io.Reader, error) {
+	header, err := d.nextHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &chunkReader{d: d, first: header}
+	if err = r.start(header); err != nil {
+		return nil, nil, err
+	}
+	return header, r, nil
+}
+
+// chunkReader reads a body split into frames, verifying the checksum of every frame.
+type chunkReader struct {
+	d         *Decoder
+	first     *Header
+	header    *Header
+	remaining int64
+	crc       uint32
+	err       error
+	hbuf      bytes.Buffer
+}
+
+func (r *chunkReader) start(h *Header) error {
+	if r.d.opts.MaxMessageSize > 0 && uint32(h.Length) > r.d.opts.MaxMessageSize {
+		return &LimitError{Err: ErrMessageTooLarge, Value: int(h.Length), Max: int(r.d.opts.MaxMessageSize)}
+	}
+	r.header = h
+	r.remaining = int64(h.Length)
+	r.crc = r.d.crc
+	return nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 && r.err == nil {
+		r.err = r.next()
+	}
+	if r.remaining == 0 {
+		return 0, r.err
+	}
+	n, err := r.d.reader.Read(p[:min(int64(len(p)), r.remaining)])
+	r.remaining -= int64(n)
+	r.crc = crc32.Update(r.crc, crc32c, p[:n])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// next verifies the checksum of the frame that has been read, and starts the next frame of the body. It returns io.EOF
+// after the last frame.
+func (r *chunkReader) next() error {
+	if r.header.HasFlag(FChecksum) {
+		var trailer [ChecksumSize]byte
+		if _, err := io.ReadFull(r.d.reader, trailer[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(trailer[:]) != r.crc {
+			return ErrChecksumMismatch
+		}
+	}
+	if !r.header.HasExtension(ExtMore) {
+		return io.EOF
+	}
+	// The header is read into a buffer of its own, as the buffer of the decoder may hold the body being decoded.
+	body := r.d.buf
+	r.d.buf = &r.hbuf
+	header, err := r.d.nextHeader()
+	r.d.buf = body
+	if err != nil {
+		return err
+	}
+	// FExtension is only set on the last frame if the message has extensions of its own.
+	if header.Type != r.first.Type || (header.Flags^r.first.Flags)&^FExtension != 0 {
+		return errors.New(fmt.Sprintf("chunk of type %d with flags %08b in body of type %d with flags %08b", header.Type, header.Flags, r.first.Type, r.first.Flags))
+	}
+	return r.start(header)
+}
+
+// decodeChunked decodes a chunked body starting with header. The frames are read as the body is decoded, and at most
+// DecoderOpts.MaxMessageSize bytes of the body, or DefaultMaxChunkedSize, are buffered. An io.Reader field ending the
+// body is read as its frames are received instead, see decodeReader. The rest of the body is read after a decoding
+// error, so the next message can be decoded.
+func (d *Decoder) decodeChunked(header *Header) (any, error) {
+	r := &chunkReader{d: d, first: header}
+	if err := r.start(header); err != nil {
+		return nil, err
+	}
+	d.buf.Reset()
+	d.chunks = r
+	d.buffered = 0
+	d.maxBuffered = int(d.opts.MaxMessageSize)
+	if d.maxBuffered <= 0 {
+		d.maxBuffered = DefaultMaxChunkedSize
+	}
+	d.depth = 0
+	d.alloc = 0
+	var (
+		body any
+		err  error
+	)
+	switch {
+	case header.HasFlag(FProcedure) && header.Type == BatchID:
+		body, err = d.decodeBatch()
+	case header.HasFlag(FProcedure):
+		body, err = d.decodeProcedureBody(header.Type)
+	default:
+		body, err = d.decodeBody(header.Type, header.HasFlag(F32b))
+	}
+	if err == nil && d.stream != nil {
+		return body, nil
+	}
+	d.stream = nil
+	if endErr := d.endChunks(); err == nil {
+		err = endErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// need reads the frames of the chunked body being decoded into the buffer until it holds n bytes, or the body ends, in
+// which case the caller reports the buffer as truncated. It is a no-op for bodies read in full.
+func (d *Decoder) need(n int) error {
+	if d.chunks == nil || d.buf.Len() >= n {
+		return nil
+	}
+	missing := n - d.buf.Len()
+	if d.buffered+missing > d.maxBuffered {
+		return &LimitError{Err: ErrMessageTooLarge, Value: d.buffered + missing, Max: d.maxBuffered}
+	}
+	read, err := io.CopyN(d.buf, d.chunks, int64(missing))
+	d.buffered += int(read)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// endChunks reads the rest of the chunked body being decoded, verifying the checksums of its frames, so the next
+// message can be decoded. The rest of the body counts towards the limit on the buffered bytes, so an endless body isn't
+// read forever. The decoder fails every decode after a body that exceeds it.
+func (d *Decoder) endChunks() error {
+	r := d.chunks
+	if r == nil {
+		return nil
+	}
+	d.chunks = nil
+	d.checksum = false
+	limit := int64(d.maxBuffered - d.buffered)
+	n, err := io.CopyN(io.Discard, r, limit+1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.err = &LimitError{Err: ErrMessageTooLarge, Value: d.buffered + int(n), Max: d.maxBuffered}
+	return d.err
+}
+
+// errStreamDiscarded is returned by the io.Reader field ending a chunked body if it is read after the next message is
+// decoded.
+var errStreamDiscarded = errors.New("reader discarded, it must be read before the next message is decoded")
+
+// streamReader reads the segments of an io.Reader field ending a chunked body as the frames of the body are received.
+// If another value follows the field, the segments are read into memory before the value is decoded.
+type streamReader struct {
+	d         *Decoder
+	l32       bool
+	remaining int
+	data      *bytes.Reader
+	err       error
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.data != nil {
+		return r.data.Read(p)
+	}
+	d := r.d
+	// The frames read below mustn't discard the reader, see endStream.
+	d.stream = nil
+	defer func() {
+		if r.err == nil {
+			d.stream = r
+		}
+	}()
+	for r.remaining == 0 && r.err == nil {
+		r.err = r.next()
+	}
+	if r.remaining == 0 {
+		return 0, r.err
+	}
+	p = p[:min(len(p), r.remaining)]
+	var (
+		n   int
+		err error
+	)
+	if d.buf.Len() > 0 {
+		n, _ = d.buf.Read(p)
+	} else if n, err = d.chunks.Read(p); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.remaining -= n
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// next starts the next segment. After the empty segment ending the data, it reads the rest of the body and returns
+// io.EOF.
+func (r *streamReader) next() error {
+	length, err := r.d.decodeLength(reflect.Value{}, r.l32)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if length == 0 {
+		if err = r.d.endChunks(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	r.remaining = length
+	return nil
+}
+
+// buffer reads the segments into memory, as another value follows the field in the body.
+func (r *streamReader) buffer() error {
+	data, err := r.d.readSegments(r.l32)
+	if err != nil {
+		return err
+	}
+	r.data = data
+	return nil
+}
+
+// endStream reads the rest of the io.Reader field ending the last chunked body if it hasn't been read to the end, so
+// the next frame can be decoded.
+func (d *Decoder) endStream() error {
+	r := d.stream
+	if r == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, r)
+	d.stream = nil
+	r.err = errStreamDiscarded
+	return err
+}
+
+func (e *Encoder) startChunks(h *Header, typeID ID, l32 bool) {
+	e.chunk = h
+	e.chunkType = typeID
+	e.chunkSize = min(e.opts.ChunkSize, Max32bMessageBodySize)
+	if !l32 {
+		e.chunkSize = min(e.chunkSize, MaxTcpMessageBodySize)
+	}
+	e.chunks = 0
+}
+
+// abort fails the encoder after an error encoding a message of which some frames were written, see ErrMessageAborted.
+func (e *Encoder) abort(err error) error {
+	if e.err == nil {
+		e.err = errors.Join(ErrMessageAborted, err)
+	}
+	return e.err
+}
+
+func (e *Encoder) endChunks() {
+	e.chunk = nil
+	e.chunks = 0
+}
+
+// flushChunks writes the full chunks of the body encoded so far when Encode is chunking a body, leaving the rest in the
+// buffer.
+func (e *Encoder) flushChunks() error {
+	if e.chunk == nil {
+		return nil
+	}
+	for e.buf.Len() >= e.chunkSize {
+		header := *e.chunk
+		header.Extensions |= ExtMore
+		body := e.buf.Next(e.chunkSize)
+		msgBytes, err := e.EncodeHeader(&header, e.chunkType, len(body))
+		if err != nil {
+			return err
+		}
+		if err = e.writeBody(&header, msgBytes, body); err != nil {
+			return err
+		}
+		e.chunks++
+	}
+	return nil
+}
+
+// encodeReader encodes the data read from an io.Reader as segments prefixed with their length, followed by an empty
+// segment, as the length of the data isn't known up front. A nil reader is encoded as no data.
+func (e *Encoder) encodeReader(v reflect.Value, l32 bool) error {
+	if !v.IsNil() {
+		r := v.Interface().(io.Reader)
+		segment := make([]byte, readerSegmentSize)
+		for {
+			n, err := io.ReadFull(r, segment)
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if err = e.encodeLength(n, l32); err != nil {
+				return err
+			}
+			e.buf.Write(segment[:n])
+			if err = e.flushChunks(); err != nil {
+				return err
+			}
+			if n < readerSegmentSize {
+				break
+			}
+		}
+	}
+	return e.encodeLength(0, l32)
+}
+
+// decodeReader decodes the segments of an io.Reader field. In a chunked body, the returned reader reads the segments as
+// the frames are received, unless another value follows the field, so the reader must be read before the next message
+// is decoded. Otherwise, the segments are read into a *bytes.Reader.
+func (d *Decoder) decodeReader(_ reflect.Value, l32 bool) (io.Reader, error) {
+	if d.chunks != nil {
+		r := &streamReader{d: d, l32: l32}
+		d.stream = r
+		return r, nil
+	}
+	return d.readSegments(l32)
+}
+
+// readSegments reads the segments of an io.Reader field into a *bytes.Reader.
+func (d *Decoder) readSegments(l32 bool) (*bytes.Reader, error) {
+	var data []byte
+	for {
+		length, err := d.decodeLength(reflect.Value{}, l32)
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			return bytes.NewReader(data), nil
+		}
+		if err = d.checkCollection(length, 1, 1); err != nil {
+			return nil, err
+		}
+		data = append(data, d.buf.Next(length)...)
+	}
+}
@@ -0,0 +1,254 @@
+package bisp_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecodeMessage_Chunked(t *testing.T) {
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{ChunkSize: 1024})
+	large := strings.Repeat("abcdefgh", bisp.MaxTcpMessageBodySize/4)
+	msgs := []bisp.Message{
+		{Header: bisp.Header{Flags: bisp.F32b | bisp.FChecksum}, Body: large},
+		{Body: []string{large[:1000], large[:1000], large[:1000]}},
+		// Bodies that fit in a single chunk are written as a single frame.
+		{Body: "Hello"},
+	}
+	for i := range msgs {
+		assert.NoError(t, encoder.Encode(&msgs[i]))
+	}
+	header, err := bisp.NewDecoder(bytes.NewReader(buf.Bytes())).DecodeHeader()
+	assert.NoError(t, err)
+	assert.True(t, header.HasExtension(bisp.ExtMore))
+	assert.Equal(t, bisp.Length(1024), header.Length)
+
+	decoder := bisp.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for _, msg := range msgs {
+		var res bisp.Message
+		assert.NoError(t, decoder.Decode(&res))
+		assert.Equal(t, msg.Body, res.Body)
+	}
+}
+
+func TestEncodeDecodeMessage_ChunkedLimit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{ChunkSize: 256})
+	assert.NoError(t, encoder.Encode(&bisp.Message{Body: strings.Repeat("a", 4096)}))
+
+	decoder := bisp.NewDecoderWithOpts(bytes.NewReader(buf.Bytes()), &bisp.DecoderOpts{MaxMessageSize: 1024})
+	var res bisp.Message
+	assert.ErrorIs(t, decoder.Decode(&res), bisp.ErrMessageTooLarge)
+}
+
+func TestEncodeDecodeMessage_ReaderField(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), bisp.MaxTcpMessageBodySize/4)
+	tcs := []struct {
+		name string
+		opts *bisp.EncoderOpts
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "segments", data: data},
+		{name: "chunked", opts: &bisp.EncoderOpts{ChunkSize: 4096}, data: data},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			msg := bisp.Message{Header: bisp.Header{Flags: bisp.F32b}, Body: testStructReaderField{Name: "snapshot", Data: bytes.NewReader(tc.data)}}
+			assert.NoError(t, bisp.NewEncoderWithOpts(buf, tc.opts).Encode(&msg))
+
+			var res bisp.Message
+			assert.NoError(t, bisp.NewDecoder(buf).Decode(&res))
+			body := res.Body.(testStructReaderField)
+			assert.Equal(t, "snapshot", body.Name)
+			b, err := io.ReadAll(body.Data)
+			assert.NoError(t, err)
+			assert.Equal(t, len(tc.data), len(b))
+			assert.True(t, bytes.Equal(tc.data, b))
+		})
+	}
+}
+
+func TestDecode_ChunkedReaderFieldStreamed(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{ChunkSize: 1024})
+	msg := bisp.Message{Header: bisp.Header{Flags: bisp.F32b | bisp.FChecksum}, Body: testStructReaderField{Name: "snapshot", Data: bytes.NewReader(data)}}
+	assert.NoError(t, encoder.Encode(&msg))
+	assert.NoError(t, encoder.Encode(&bisp.Message{Body: "after"}))
+	encoded := bytes.Clone(buf.Bytes())
+
+	// The data is read as the reader is, rather than when the message is decoded.
+	r := bytes.NewReader(encoded)
+	decoder := bisp.NewDecoder(r)
+	var res bisp.Message
+	assert.NoError(t, decoder.Decode(&res))
+	assert.Greater(t, r.Len(), len(data)/2)
+	b, err := io.ReadAll(res.Body.(testStructReaderField).Data)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, b))
+	assert.NoError(t, decoder.Decode(&res))
+	assert.Equal(t, "after", res.Body)
+
+	// A reader that isn't read is discarded by the next decode.
+	decoder = bisp.NewDecoder(bytes.NewReader(encoded))
+	assert.NoError(t, decoder.Decode(&res))
+	unread := res.Body.(testStructReaderField).Data
+	assert.NoError(t, decoder.Decode(&res))
+	assert.Equal(t, "after", res.Body)
+	_, err = io.ReadAll(unread)
+	assert.Error(t, err)
+
+	// A reader followed by another field is read into memory.
+	buf.Reset()
+	msg.Body = testStructReaderFieldFirst{Data: bytes.NewReader(data), Name: "snapshot"}
+	assert.NoError(t, encoder.Encode(&msg))
+	assert.NoError(t, bisp.NewDecoder(buf).Decode(&res))
+	body := res.Body.(testStructReaderFieldFirst)
+	assert.Equal(t, "snapshot", body.Name)
+	b, err = io.ReadAll(body.Data)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, b))
+}
+
+func TestDecode_ChunkedErrorDrained(t *testing.T) {
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{ChunkSize: 16})
+	assert.NoError(t, encoder.Encode(&bisp.Message{Header: bisp.Header{Flags: bisp.FChecksum}, Body: []string{strings.Repeat("a", 100)}}))
+	assert.NoError(t, encoder.Encode(&bisp.Message{Body: "after"}))
+
+	decoder := bisp.NewDecoderWithOpts(buf, &bisp.DecoderOpts{MaxCollectionLength: 10})
+	var res bisp.Message
+	assert.ErrorIs(t, decoder.Decode(&res), bisp.ErrCollectionTooLong)
+	assert.NoError(t, decoder.Decode(&res))
+	assert.Equal(t, "after", res.Body)
+}
+
+// endlessChunks is a chunked body of []byte that never ends.
+type endlessChunks struct {
+	first, next []byte
+	pos         int
+}
+
+func (r *endlessChunks) Read(p []byte) (int, error) {
+	n := copy(p, r.first[r.pos:])
+	r.pos += n
+	if r.pos == len(r.first) {
+		r.first, r.pos = r.next, 0
+	}
+	return n, nil
+}
+
+func TestEncode_ChunkedAborted(t *testing.T) {
+	failed := errors.New("read failed")
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{ChunkSize: 8})
+
+	// The name is written in chunks before the reader fails.
+	msg := bisp.Message{Body: testStructReaderField{Name: strings.Repeat("a", 64), Data: iotest.ErrReader(failed)}}
+	err := encoder.Encode(&msg)
+	assert.ErrorIs(t, err, bisp.ErrMessageAborted)
+	assert.ErrorIs(t, err, failed)
+	written := buf.Len()
+	assert.Greater(t, written, 0)
+
+	// The valid message after it isn't written, as it would be decoded as the rest of the aborted one.
+	assert.ErrorIs(t, encoder.Encode(&bisp.Message{Body: "Hello"}), bisp.ErrMessageAborted)
+	assert.Equal(t, written, buf.Len())
+
+	// A failure before any frame is written doesn't abort anything.
+	buf.Reset()
+	encoder = bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{ChunkSize: 8})
+	msg = bisp.Message{Body: testStructReaderField{Name: "a", Data: iotest.ErrReader(failed)}}
+	err = encoder.Encode(&msg)
+	assert.ErrorIs(t, err, failed)
+	assert.NotErrorIs(t, err, bisp.ErrMessageAborted)
+	assert.NoError(t, encoder.Encode(&bisp.Message{Body: "Hello"}))
+	var res bisp.Message
+	assert.NoError(t, bisp.NewDecoder(buf).Decode(&res))
+	assert.Equal(t, "Hello", res.Body)
+}
+
+func TestConn_ChunkedAborted(t *testing.T) {
+	client, server := net.Pipe()
+	sender := bisp.NewConn(client, &bisp.ConnOpts{Encoder: bisp.EncoderOpts{ChunkSize: 8}})
+	receiver := bisp.NewConn(server, nil)
+	defer sender.Close()
+	defer receiver.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := receiver.Receive()
+		received <- err
+	}()
+	msg := bisp.Message{Body: testStructReaderField{Name: strings.Repeat("a", 64), Data: iotest.ErrReader(errors.New("read failed"))}}
+	assert.ErrorIs(t, sender.Send(&msg), bisp.ErrMessageAborted)
+	assert.Error(t, sender.Send(&bisp.Message{Body: "Hello"}))
+
+	// The connection is closed, so the receiver fails instead of waiting for the rest of the message.
+	select {
+	case err := <-received:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("receiver not unblocked by the aborted message")
+	}
+}
+
+func TestDecode_ChunkedDefaultLimit(t *testing.T) {
+	id, err := bisp.GetIDFromType([]byte{})
+	assert.NoError(t, err)
+	frame := func(body []byte) []byte {
+		header, err := bisp.NewEncoder(io.Discard).EncodeHeader(&bisp.Header{Flags: bisp.F32b, Extensions: bisp.ExtMore}, id, len(body))
+		assert.NoError(t, err)
+		return append(header, body...)
+	}
+	body := make([]byte, 1<<16)
+	// The body claims 256 MiB, more than DefaultMaxChunkedSize.
+	first := frame(append([]byte{0x10, 0x00, 0x00, 0x00}, body[4:]...))
+
+	decoder := bisp.NewDecoder(&endlessChunks{first: first, next: frame(body)})
+	var res bisp.Message
+	assert.ErrorIs(t, decoder.Decode(&res), bisp.ErrMessageTooLarge)
+	// The rest of the body can't be skipped, so the decoder fails from then on.
+	assert.ErrorIs(t, decoder.Decode(&res), bisp.ErrMessageTooLarge)
+}
+
+func TestEncodeDecodeStream(t *testing.T) {
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{ChunkSize: 1000})
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	id, err := bisp.GetIDFromType([]byte{})
+	assert.NoError(t, err)
+	assert.NoError(t, encoder.EncodeStream(&bisp.Header{Flags: bisp.FChecksum}, id, bytes.NewReader(data)))
+	assert.NoError(t, encoder.Encode(&bisp.Message{Body: "after"}))
+
+	encoded := bytes.Clone(buf.Bytes())
+	decoder := bisp.NewDecoder(bytes.NewReader(encoded))
+	header, r, err := decoder.DecodeStream()
+	assert.NoError(t, err)
+	assert.Equal(t, id, header.Type)
+	assert.True(t, header.HasExtension(bisp.ExtMore))
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, b))
+	var res bisp.Message
+	assert.NoError(t, decoder.Decode(&res))
+	assert.Equal(t, "after", res.Body)
+
+	// Corrupt a byte in the third chunk.
+	encoded[3*(bisp.HeaderSize+bisp.ExtensionSize+1000+bisp.ChecksumSize)-10] ^= 0x01
+	_, r, err = bisp.NewDecoder(bytes.NewReader(encoded)).DecodeStream()
+	assert.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, bisp.ErrChecksumMismatch)
+}
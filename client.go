@@ -0,0 +1,449 @@
+package bisp
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+)
+
+var ErrClientClosed = errors.New("client closed")
+
+// ErrNotSent is returned, with ErrClientClosed, by calls that failed because the connection broke before they were
+// written. The connection is closed, and the calls can safely be made again over another connection.
+var ErrNotSent = errors.New("call not sent")
+
+// ErrGoingAway is returned by calls made after the server sent ControlGoAway, as it is shutting down. The calls are not
+// sent, so they can safely be made again over another connection. The client closes the connection once the calls in
+// flight have been answered, as does the server.
+var ErrGoingAway = errors.New("server going away")
+
+type ClientOpts struct {
+	// OnMessage is called with received messages that don't answer a pending call.
+	OnMessage func(msg *Message)
+	// UnaryInterceptors are called in order around outbound procedure calls, including the calls of a CallBatch.
+	UnaryInterceptors []UnaryInterceptor
+	// NotifyInterceptors are called in order around outbound notifications, including the notifications of a CallBatch.
+	NotifyInterceptors []NotifyInterceptor
+	// Checksum appends a CRC32C trailer to sent messages. The server responds with checksums to messages that have them.
+	Checksum bool
+	// ConnOpts are the options of the Conn wrapping the connection.
+	ConnOpts *ConnOpts
+}
+
+// Caller calls procedures, over a connection with a Client or over HTTP with an HTTPClient.
+type Caller interface {
+	CallFunc(ctx context.Context, name string, args ...any) ([]any, error)
+	call(ctx context.Context, p any) (any, error)
+}
+
+type Client struct {
+	conn    *Conn
+	opts    ClientOpts
+	mu      sync.Mutex
+	pending map[TransactionID]chan *Message
+	err     error
+	done    chan struct{}
+}
+
+// NewClient returns a Client calling procedures over conn. The client reads responses from conn until it is closed.
+func NewClient(conn net.Conn, opts *ClientOpts) *Client {
+	c := &Client{
+		pending: make(map[TransactionID]chan *Message, 16),
+		done:    make(chan struct{}),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	c.conn = NewConn(conn, c.opts.ConnOpts)
+	c.conn.onGoAway = c.closeIfIdle
+	go c.readLoop()
+	return c
+}
+
+// CallProcedure sends p as a procedure call and waits for the response. The returned procedure has its Out field set.
+func CallProcedure[P any](ctx context.Context, c Caller, p P) (P, error) {
+	var zero P
+	body, err := c.call(ctx, p)
+	if err != nil {
+		return zero, err
+	}
+	res, ok := body.(P)
+	if !ok {
+		return zero, errors.New(fmt.Sprintf("expected response of type %s, got %s", reflect.TypeOf(p), reflect.TypeOf(body)))
+	}
+	return res, nil
+}
+
+// CallFunc calls the function procedure name, registered with RegisterFunc, and returns its results.
+func (c *Client) CallFunc(ctx context.Context, name string, args ...any) ([]any, error) {
+	p, err := NewFuncCall(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	var res any
+	if res, err = c.call(ctx, p); err != nil {
+		return nil, err
+	}
+	return FuncResults(res)
+}
+
+func (c *Client) call(ctx context.Context, p any) (any, error) {
+	t := reflect.TypeOf(p)
+	id, err := GetProcedureID(p)
+	if err != nil {
+		return nil, err
+	}
+	if isNotification(t) {
+		return nil, errors.New(fmt.Sprintf("procedure %s is a notification, use NotifyProcedure", t))
+	}
+	tID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	info := newCallInfo(&Header{Flags: FProcedure, Type: id, TransactionID: tID}, p, Call)
+	return chainUnary(c.opts.UnaryInterceptors, info, func(ctx context.Context, p any) (any, error) {
+		return c.roundTrip(ctx, p, tID)
+	})(ctx, p)
+}
+
+func (c *Client) roundTrip(ctx context.Context, p any, tID TransactionID) (any, error) {
+	ch, err := c.register(tID)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(tID)
+
+	if err = c.send(p, Call, tID); err != nil {
+		return nil, c.sendFailed(err)
+	}
+	select {
+	case msg := <-ch:
+		if msg.IsError() {
+			return nil, msg.Error()
+		}
+		return msg.Body, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.closeErr()
+	}
+}
+
+// NotifyProcedure sends p as a one-way procedure call. The server dispatches it without sending a response, and no
+// pending call is allocated. ctx is passed to the NotifyInterceptors, and the notification isn't sent once it is done.
+func NotifyProcedure[P any](ctx context.Context, c *Client, p P) error {
+	id, err := GetProcedureID(p)
+	if err != nil {
+		return err
+	}
+	info := newCallInfo(&Header{Flags: FProcedure, Type: id}, p, Notify)
+	return chainNotify(c.opts.NotifyInterceptors, info, func(ctx context.Context, p any) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if c.conn.GoingAway() {
+			return ErrGoingAway
+		}
+		select {
+		case <-c.done:
+			return c.closeErr()
+		default:
+		}
+		err := c.send(p, Notify, TransactionID{})
+		if err != nil && c.conn.GoingAway() {
+			// The connection was closed by closeIfIdle before the notification was written.
+			return ErrGoingAway
+		}
+		return err
+	})(ctx, p)
+}
+
+// CallBatch sends the entries as a single batch frame, and waits for the responses. Entries must have their Kind set
+// to Call or Notify, and Call entries are assigned a TransactionID if they don't have one. The returned batch is in the
+// same order as the entries, with notifications returned as they were sent. Every entry is passed through the client
+// interceptors, and the entries that reach the end of their chain are sent together once every chain has reached its
+// end or returned.
+func (c *Client) CallBatch(ctx context.Context, entries ...BatchEntry) (Batch, error) {
+	batch := make(Batch, len(entries))
+	copy(batch, entries)
+	for i := range batch {
+		entry := &batch[i]
+		switch entry.Kind {
+		case Call:
+			if isNotification(reflect.TypeOf(entry.Procedure)) {
+				return nil, errors.New(fmt.Sprintf("procedure %s is a notification, use %s", reflect.TypeOf(entry.Procedure), Notify))
+			}
+			if entry.TransactionID == (TransactionID{}) {
+				tID, err := newTransactionID()
+				if err != nil {
+					return nil, err
+				}
+				entry.TransactionID = tID
+			}
+		case Notify:
+		default:
+			return nil, errors.New(fmt.Sprintf("batch entry kind %s, set either %s or %s", entry.Kind, Call, Notify))
+		}
+	}
+	if len(c.opts.UnaryInterceptors) == 0 && len(c.opts.NotifyInterceptors) == 0 {
+		return c.roundTripBatch(ctx, batch)
+	}
+	return c.interceptBatch(ctx, batch)
+}
+
+// interceptBatch runs the interceptor chain of every entry concurrently. The ends of the chains wait for every chain to
+// reach its end or return, and the entries that reached it are sent in a single batch. The responses are then returned
+// back through the chains. An interceptor calling next again after the batch was sent makes a call of its own.
+func (c *Client) interceptBatch(ctx context.Context, batch Batch) (Batch, error) {
+	var (
+		arrived sync.WaitGroup
+		wg      sync.WaitGroup
+		once    = make([]sync.Once, len(batch))
+		sent    = make([]bool, len(batch))
+		procs   = make([]any, len(batch))
+		results = make([]chan BatchEntry, len(batch))
+		outs    = make([]BatchEntry, len(batch))
+	)
+	// arrive reports whether the chain of entry i reached its end before the batch was sent.
+	arrive := func(i int, p any) bool {
+		first := false
+		once[i].Do(func() {
+			first, sent[i], procs[i] = true, true, p
+			arrived.Done()
+		})
+		return first
+	}
+	arrived.Add(len(batch))
+	for i, entry := range batch {
+		results[i] = make(chan BatchEntry, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The chain may return without reaching its end.
+			defer once[i].Do(arrived.Done)
+			id, _ := GetProcedureID(entry.Procedure)
+			info := newCallInfo(&Header{Flags: FProcedure, Type: id, TransactionID: entry.TransactionID}, entry.Procedure, entry.Kind)
+			outs[i] = entry
+			if entry.Kind == Notify {
+				outs[i].Err = chainNotify(c.opts.NotifyInterceptors, info, func(ctx context.Context, p any) error {
+					if !arrive(i, p) {
+						return c.send(p, Notify, TransactionID{})
+					}
+					return (<-results[i]).Err
+				})(ctx, entry.Procedure)
+				return
+			}
+			out, err := chainUnary(c.opts.UnaryInterceptors, info, func(ctx context.Context, p any) (any, error) {
+				if !arrive(i, p) {
+					tID, err := newTransactionID()
+					if err != nil {
+						return nil, err
+					}
+					return c.roundTrip(ctx, p, tID)
+				}
+				res := <-results[i]
+				outs[i] = res
+				return res.Procedure, res.Err
+			})(ctx, entry.Procedure)
+			outs[i].Kind, outs[i].Procedure, outs[i].Err = Response, out, err
+		}()
+	}
+	arrived.Wait()
+
+	var sub Batch
+	for i, entry := range batch {
+		if sent[i] {
+			entry.Procedure = procs[i]
+			sub = append(sub, entry)
+		}
+	}
+	var (
+		res Batch
+		err error
+	)
+	if len(sub) > 0 {
+		res, err = c.roundTripBatch(ctx, sub)
+	}
+	for i, j := 0, 0; i < len(batch); i++ {
+		if !sent[i] {
+			continue
+		}
+		if err != nil {
+			results[i] <- BatchEntry{Err: err}
+		} else {
+			results[i] <- res[j]
+		}
+		j++
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return Batch(outs), nil
+}
+
+// roundTripBatch sends the batch and waits for the responses, which replace the Call entries. No response is waited for
+// if the batch holds notifications only.
+func (c *Client) roundTripBatch(ctx context.Context, batch Batch) (Batch, error) {
+	calls := 0
+	for _, entry := range batch {
+		if entry.Kind == Call {
+			calls++
+		}
+	}
+	if calls == 0 {
+		if err := c.sendBatch(batch, TransactionID{}); err != nil {
+			return batch, c.sendFailed(err)
+		}
+		return batch, nil
+	}
+
+	tID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := c.register(tID)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(tID)
+
+	if err = c.sendBatch(batch, tID); err != nil {
+		return nil, c.sendFailed(err)
+	}
+	select {
+	case msg := <-ch:
+		if msg.IsError() {
+			return nil, msg.Error()
+		}
+		res, ok := msg.Body.(Batch)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("expected batch response, got %s", reflect.TypeOf(msg.Body)))
+		}
+		responses := make(map[TransactionID]BatchEntry, len(res))
+		for _, entry := range res {
+			responses[entry.TransactionID] = entry
+		}
+		for i := range batch {
+			if batch[i].Kind != Call {
+				continue
+			}
+			entry, ok := responses[batch[i].TransactionID]
+			if !ok {
+				entry = batch[i]
+				entry.Err = errors.New("missing batch response")
+			}
+			batch[i] = entry
+		}
+		return batch, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.closeErr()
+	}
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) send(p any, kind PKind, tID TransactionID) error {
+	return c.conn.SendProcedure(p, kind, &EncodeProcedureOpts{TransactionID: tID, Checksum: c.opts.Checksum})
+}
+
+func (c *Client) sendBatch(b Batch, tID TransactionID) error {
+	return c.conn.SendBatch(b, &EncodeProcedureOpts{TransactionID: tID, Checksum: c.opts.Checksum})
+}
+
+// sendFailed returns the error of a call that failed to be sent with err. If the connection is broken, though the read
+// loop may not have noticed yet, it is closed so later calls fail without being sent either, and the error wraps
+// ErrNotSent.
+func (c *Client) sendFailed(err error) error {
+	if !isWriteError(err) {
+		return err
+	}
+	c.conn.closeWith(err)
+	<-c.done
+	return errors.Join(ErrNotSent, c.closeErr())
+}
+
+func (c *Client) register(tID TransactionID) (chan *Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The connection is closed by closeIfIdle after ControlGoAway, calls made since then are not sent either way.
+	if c.conn.GoingAway() {
+		return nil, ErrGoingAway
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	ch := make(chan *Message, 1)
+	c.pending[tID] = ch
+	return ch, nil
+}
+
+func (c *Client) unregister(tID TransactionID) {
+	c.mu.Lock()
+	delete(c.pending, tID)
+	c.mu.Unlock()
+	c.closeIfIdle()
+}
+
+// closeIfIdle closes the connection once the server has sent ControlGoAway and no call is pending. register checks
+// GoingAway while holding c.mu, so no call can be registered after the connection is found idle.
+func (c *Client) closeIfIdle() {
+	if !c.conn.GoingAway() {
+		return
+	}
+	c.mu.Lock()
+	idle := len(c.pending) == 0
+	c.mu.Unlock()
+	if idle {
+		_ = c.conn.Close()
+	}
+}
+
+func (c *Client) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) readLoop() {
+	var (
+		err error
+		msg *Message
+	)
+	for {
+		if msg, err = c.conn.Receive(); err != nil {
+			break
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[msg.Header.TransactionID]
+		c.mu.Unlock()
+		if ok && msg.Header.HasTransactionID() {
+			select {
+			case ch <- msg:
+			default:
+			}
+			continue
+		}
+		if c.opts.OnMessage != nil {
+			c.opts.OnMessage(msg)
+		}
+	}
+	c.mu.Lock()
+	c.err = errors.Join(ErrClientClosed, err)
+	c.mu.Unlock()
+	close(c.done)
+}
+
+func newTransactionID() (TransactionID, error) {
+	var tID TransactionID
+	_, err := rand.Read(tID[:])
+	return tID, err
+}
@@ -0,0 +1,82 @@
+package bisp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_CallNotification(t *testing.T) {
+	conn, _ := net.Pipe()
+	client := bisp.NewClient(conn, nil)
+	defer client.Close()
+
+	_, err := bisp.CallProcedure(context.Background(), client, TestNotificationMetric{Name: "requests"})
+	assert.Error(t, err)
+}
+
+func TestClient_CallContext(t *testing.T) {
+	conn, server := net.Pipe()
+	go func() {
+		// Read the call, but never respond.
+		decoder := bisp.NewDecoder(server)
+		var msg bisp.Message
+		_ = decoder.Decode(&msg)
+	}()
+	client := bisp.NewClient(conn, nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClient_Closed(t *testing.T) {
+	conn, server := net.Pipe()
+	client := bisp.NewClient(conn, nil)
+	server.Close()
+
+	assert.Eventually(t, func() bool {
+		_, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 1, B: 2})
+		return errors.Is(err, bisp.ErrClientClosed)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestClient_OnMessage(t *testing.T) {
+	received := make(chan *bisp.Message, 1)
+	conn, server := net.Pipe()
+	client := bisp.NewClient(conn, &bisp.ClientOpts{
+		OnMessage: func(msg *bisp.Message) {
+			received <- msg
+		},
+	})
+	defer client.Close()
+
+	go func() {
+		encoder := bisp.NewEncoder(server)
+		assert.NoError(t, encoder.Encode(&bisp.Message{Body: "Hello"}))
+	}()
+	select {
+	case msg := <-received:
+		assert.Equal(t, "Hello", msg.Body)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestClient_Checksum(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	client := bisp.NewClient(conn, &bisp.ClientOpts{Checksum: true})
+
+	res, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Out)
+	_, err = bisp.CallProcedure(context.Background(), client, TestProcedureFail{Reason: "boom"})
+	assert.EqualError(t, err, "boom")
+}
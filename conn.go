@@ -0,0 +1,311 @@
+package bisp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReadBufferSize is the size of the read buffer of a Conn when ConnOpts.ReadBufferSize is not set.
+const DefaultReadBufferSize = 4096
+
+// ErrPeerTimeout is returned by Receive after a Conn is closed because nothing was received from the peer within
+// ConnOpts.HeartbeatTimeout.
+var ErrPeerTimeout = errors.New("peer timed out")
+
+type ConnOpts struct {
+	Encoder EncoderOpts
+	Decoder DecoderOpts
+	// ReadBufferSize is the size of the buffer reads from the connection go through. Zero means DefaultReadBufferSize.
+	ReadBufferSize int
+	// ReadTimeout and WriteTimeout set a deadline on the connection before each Receive and Send. Zero means no
+	// deadline is set, leaving deadlines set with SetDeadline in place.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// HeartbeatInterval is the interval between pings sent to the peer. Zero disables heartbeats. Pongs, like every
+	// other frame, are read by Receive, so heartbeats need a goroutine calling it.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long the peer can go without sending anything before the connection is closed. Zero means
+	// three times HeartbeatInterval.
+	HeartbeatTimeout time.Duration
+}
+
+// Conn sends and receives messages over a net.Conn. Sends are serialized, so a Conn is safe for concurrent use, while
+// Receive is meant to be called from a single read loop.
+type Conn struct {
+	conn   net.Conn
+	opts   ConnOpts
+	wmu    sync.Mutex
+	enc    *Encoder
+	rmu    sync.Mutex
+	dec    *Decoder
+	closed atomic.Bool
+	once   sync.Once
+	err    error
+	done   chan struct{}
+	// seen holds the time the last frame was received, in unix nanoseconds.
+	seen    atomic.Int64
+	cause   atomic.Pointer[error]
+	pinging atomic.Bool
+	// pings counts the pings received and not yet answered, a single goroutine answers them with one pong.
+	pings atomic.Int32
+	// goingAway is set once the peer has sent ControlGoAway, and onGoAway is then called from the read loop.
+	goingAway atomic.Bool
+	onGoAway  func()
+	// onFrame is called from the read loop with every control frame received and its body, for protocols built on Conn.
+	onFrame func(h *Header, body []byte)
+}
+
+func NewConn(conn net.Conn, opts *ConnOpts) *Conn {
+	c := &Conn{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	size := c.opts.ReadBufferSize
+	if size <= 0 {
+		size = DefaultReadBufferSize
+	}
+	c.enc = NewEncoderWithOpts(connWriter{conn}, &c.opts.Encoder)
+	c.dec = NewDecoderWithOpts(bufio.NewReaderSize(conn, size), &c.opts.Decoder)
+	c.dec.onControl = c.handleControl
+	c.seen.Store(time.Now().UnixNano())
+	if c.opts.HeartbeatInterval > 0 {
+		go c.heartbeat()
+	}
+	return c
+}
+
+// Send encodes and writes msg.
+func (c *Conn) Send(msg *Message) error {
+	return c.write(func(enc *Encoder) error {
+		return enc.Encode(msg)
+	})
+}
+
+// SendProcedure encodes and writes p as a procedure of the given kind.
+func (c *Conn) SendProcedure(p any, kind PKind, opts *EncodeProcedureOpts) error {
+	return c.write(func(enc *Encoder) error {
+		return enc.EncodeProcedure(p, kind, opts)
+	})
+}
+
+// SendBatch encodes and writes b as a batch frame.
+func (c *Conn) SendBatch(b Batch, opts *EncodeProcedureOpts) error {
+	return c.write(func(enc *Encoder) error {
+		return enc.EncodeBatch(b, opts)
+	})
+}
+
+// Receive reads and decodes the next message.
+func (c *Conn) Receive() (*Message, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.closed.Load() {
+		return nil, net.ErrClosed
+	}
+	if c.opts.ReadTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout)); err != nil {
+			return nil, err
+		}
+	}
+	var msg Message
+	if err := c.dec.Decode(&msg); err != nil {
+		if cause := c.cause.Load(); cause != nil {
+			return nil, *cause
+		}
+		return nil, err
+	}
+	c.seen.Store(time.Now().UnixNano())
+	return &msg, nil
+}
+
+// Ping sends a ping to the peer, which responds with a pong.
+func (c *Conn) Ping() error {
+	return c.write(func(enc *Encoder) error {
+		return enc.EncodeControl(ControlPing)
+	})
+}
+
+// GoAway tells the peer the connection is being shut down, so it stops sending new calls.
+func (c *Conn) GoAway() error {
+	return c.write(func(enc *Encoder) error {
+		return enc.EncodeControl(ControlGoAway)
+	})
+}
+
+// goAway sends ControlGoAway, failing if it can't be written before deadline.
+func (c *Conn) goAway(deadline time.Time) error {
+	return c.write(func(enc *Encoder) error {
+		if err := c.conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+		defer c.conn.SetWriteDeadline(time.Time{})
+		return enc.EncodeControl(ControlGoAway)
+	})
+}
+
+// GoingAway reports whether the peer has sent ControlGoAway.
+func (c *Conn) GoingAway() bool {
+	return c.goingAway.Load()
+}
+
+// Resync skips to the next frame after a corrupted one. It requires DecoderOpts.Sync, see Decoder.Resync.
+func (c *Conn) Resync() error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	return c.dec.Resync()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Close closes the underlying connection, unblocking Receive. Sends after Close return net.ErrClosed. Calling Close
+// more than once returns the result of the first call.
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		c.closed.Store(true)
+		close(c.done)
+		c.err = c.conn.Close()
+	})
+	return c.err
+}
+
+// closeWith closes the connection, making Receive return err.
+func (c *Conn) closeWith(err error) {
+	c.cause.CompareAndSwap(nil, &err)
+	_ = c.Close()
+}
+
+// connWriter is the writer of the encoder of a Conn. It wraps the errors of writes to the connection in a writeError, so
+// they can be told apart from encoding errors.
+type connWriter struct {
+	net.Conn
+}
+
+func (w connWriter) Write(p []byte) (int, error) {
+	n, err := w.Conn.Write(p)
+	if err != nil {
+		err = &writeError{err: err}
+	}
+	return n, err
+}
+
+// writeError is an error writing to the connection. The frame being written is incomplete, so the peer doesn't decode
+// it.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+// isWriteError reports whether err means a frame wasn't written, because writing to the connection failed or the Conn
+// was closed.
+func isWriteError(err error) bool {
+	var writeErr *writeError
+	return errors.As(err, &writeErr) || errors.Is(err, net.ErrClosed)
+}
+
+func (c *Conn) handleControl(h *Header) {
+	c.seen.Store(time.Now().UnixNano())
+	if h.Type == ControlGoAway && !c.goingAway.Swap(true) && c.onGoAway != nil {
+		c.onGoAway()
+	}
+	if h.Type == ControlPing {
+		// Respond from another goroutine, so the read loop doesn't block on a peer that is itself blocked writing. Pings
+		// received while a pong is being written are answered by a single pong after it.
+		if c.pings.Add(1) == 1 {
+			go func() {
+				for n := int32(1); n > 0; n = c.pings.Add(-n) {
+					_ = c.write(func(enc *Encoder) error {
+						return enc.EncodeControl(ControlPong)
+					})
+				}
+			}()
+		}
+	}
+	if c.onFrame != nil {
+		c.onFrame(h, c.dec.buf.Bytes())
+	}
+}
+
+func (c *Conn) heartbeat() {
+	timeout := c.opts.HeartbeatTimeout
+	if timeout <= 0 {
+		timeout = 3 * c.opts.HeartbeatInterval
+	}
+	ticker := time.NewTicker(c.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, c.seen.Load())) > timeout {
+				c.closeWith(ErrPeerTimeout)
+				return
+			}
+			// Ping from another goroutine, so a peer that stopped reading doesn't block the timeout check.
+			if c.pinging.CompareAndSwap(false, true) {
+				go func() {
+					defer c.pinging.Store(false)
+					if err := c.Ping(); err != nil {
+						c.closeWith(err)
+					}
+				}()
+			}
+		}
+	}
+}
+
+func (c *Conn) write(f func(enc *Encoder) error) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	if c.opts.WriteTimeout > 0 {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+	err := f(c.enc)
+	if errors.Is(err, ErrMessageAborted) {
+		// The peer can't decode past the aborted message, so the connection is closed rather than left hanging.
+		c.closeWith(err)
+	}
+	return err
+}
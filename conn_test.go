@@ -0,0 +1,180 @@
+package bisp_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConn_SendReceive(t *testing.T) {
+	client, server := net.Pipe()
+	sender := bisp.NewConn(client, nil)
+	receiver := bisp.NewConn(server, nil)
+	defer sender.Close()
+	defer receiver.Close()
+
+	go func() {
+		assert.NoError(t, sender.Send(&bisp.Message{Body: "Hello"}))
+		assert.NoError(t, sender.SendProcedure(pString, bisp.Call, &bisp.EncodeProcedureOpts{TransactionID: testTransactionID}))
+	}()
+	msg, err := receiver.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", msg.Body)
+	msg, err = receiver.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, testTransactionID, msg.Header.TransactionID)
+	assert.Equal(t, "Hello", msg.Body.(TestProcedureString).String)
+}
+
+func TestConn_ConcurrentSend(t *testing.T) {
+	client, server := net.Pipe()
+	sender := bisp.NewConn(client, &bisp.ConnOpts{Encoder: bisp.EncoderOpts{Sync: true}})
+	receiver := bisp.NewConn(server, &bisp.ConnOpts{Decoder: bisp.DecoderOpts{Sync: true}})
+	defer sender.Close()
+	defer receiver.Close()
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := testStruct{A: i, B: "concurrent", C: true}
+			assert.NoError(t, sender.Send(&bisp.Message{Header: bisp.Header{Flags: bisp.FChecksum}, Body: body}))
+		}()
+	}
+	seen := make(map[int]bool, n)
+	for range n {
+		msg, err := receiver.Receive()
+		assert.NoError(t, err)
+		body := msg.Body.(testStruct)
+		assert.Equal(t, "concurrent", body.B)
+		seen[body.A] = true
+	}
+	wg.Wait()
+	assert.Len(t, seen, n)
+}
+
+func TestConn_ReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := bisp.NewConn(client, &bisp.ConnOpts{ReadTimeout: 20 * time.Millisecond})
+	defer conn.Close()
+
+	_, err := conn.Receive()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestConn_Close(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := bisp.NewConn(client, nil)
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := conn.Receive()
+		received <- err
+	}()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, conn.Close())
+	select {
+	case err := <-received:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("receive not unblocked by close")
+	}
+	assert.ErrorIs(t, conn.Send(&bisp.Message{Body: "Hello"}), net.ErrClosed)
+	_, err := conn.Receive()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestConn_Heartbeat(t *testing.T) {
+	client, server := net.Pipe()
+	pinger := bisp.NewConn(client, &bisp.ConnOpts{HeartbeatInterval: 10 * time.Millisecond, HeartbeatTimeout: 50 * time.Millisecond})
+	ponger := bisp.NewConn(server, nil)
+	defer ponger.Close()
+
+	received := make(chan *bisp.Message, 1)
+	go func() {
+		for {
+			msg, err := ponger.Receive()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := pinger.Receive()
+		errs <- err
+	}()
+
+	// Pings and pongs keep the connection alive without being delivered to Receive.
+	select {
+	case msg := <-received:
+		t.Fatalf("control frame delivered: %+v", msg)
+	case err := <-errs:
+		t.Fatalf("connection closed: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.NoError(t, pinger.Close())
+	assert.Error(t, <-errs)
+}
+
+func TestConn_HeartbeatTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	// The peer reads everything but never responds.
+	go func() {
+		_, _ = io.Copy(io.Discard, server)
+	}()
+	conn := bisp.NewConn(client, &bisp.ConnOpts{HeartbeatInterval: 10 * time.Millisecond, HeartbeatTimeout: 50 * time.Millisecond})
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Receive()
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, bisp.ErrPeerTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("dead peer not detected")
+	}
+}
+
+func TestConn_PongCoalesced(t *testing.T) {
+	client, server := net.Pipe()
+	conn := bisp.NewConn(server, nil)
+	defer conn.Close()
+	go func() {
+		_, _ = conn.Receive()
+	}()
+
+	// The pongs can't be written while nothing reads them, so the pings received meanwhile are answered together.
+	enc := bisp.NewEncoder(client)
+	for range 100 {
+		assert.NoError(t, enc.EncodeControl(bisp.ControlPing))
+	}
+	dec := bisp.NewDecoder(client)
+	pongs := 0
+	for {
+		assert.NoError(t, client.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		h, err := dec.DecodeHeader()
+		if err != nil {
+			assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+			break
+		}
+		assert.Equal(t, bisp.ControlPong, h.Type)
+		pongs++
+	}
+	assert.GreaterOrEqual(t, pongs, 1)
+	assert.Less(t, pongs, 10)
+}
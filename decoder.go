@@ -1,35 +1,166 @@
 package bisp
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"iter"
 	"reflect"
 	"unsafe"
 )
 
+// ErrChecksumMismatch is returned when the CRC32C trailer of a message with FChecksum set doesn't match its header
+// and body.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrSyncLost is returned in sync framing mode when a frame doesn't start with SyncWord. Call Decoder.Resync to skip to
+// the next frame.
+var ErrSyncLost = errors.New("sync word not found")
+
+// DefaultMaxDepth is the maximum nesting depth of decoded values when DecoderOpts.MaxDepth is not set.
+const DefaultMaxDepth = 64
+
+// DefaultMaxChunkedSize is the maximum number of bytes of a chunked body buffered while it is decoded, when
+// DecoderOpts.MaxMessageSize is not set.
+const DefaultMaxChunkedSize = 64 << 20
+
+// DefaultMaxZeroSizeLength is the maximum length of slices and maps whose elements encode to zero bytes, such as
+// []struct{}, when DecoderOpts.MaxCollectionLength is not set. Their length isn't bounded by the body length.
+const DefaultMaxZeroSizeLength = 1 << 16
+
+// maxBodyPrealloc caps how much of the body length is allocated before the body is read, so a length from the wire
+// can't allocate more than what is actually received.
+const maxBodyPrealloc = MaxTcpMessageBodySize
+
+type DecoderOpts struct {
+	// MaxMessageSize is the maximum body length of a message. Zero means no limit beyond Max32bMessageBodySize for
+	// single frames, and DefaultMaxChunkedSize for chunked bodies.
+	MaxMessageSize uint32
+	// MaxCollectionLength is the maximum length of strings, slices and maps. Zero means no limit beyond the body
+	// length, or DefaultMaxZeroSizeLength for elements that encode to zero bytes.
+	MaxCollectionLength int
+	// MaxDepth is the maximum nesting depth of slices, arrays, maps and structs. Zero means DefaultMaxDepth.
+	MaxDepth int
+	// MaxAlloc is the maximum number of bytes allocated for strings, slices and maps while decoding a single message.
+	// Zero means no limit.
+	MaxAlloc int
+	// Sync expects SyncWord before every frame, as written by an Encoder with EncoderOpts.Sync set, and enables
+	// Decoder.Resync. The reader is buffered in this mode.
+	Sync bool
+}
+
 type Decoder struct {
 	buf    *bytes.Buffer
 	reader io.Reader
+	opts   DecoderOpts
+	depth  int
+	alloc  int
+	// checksum is set by DecodeHeader when the message has FChecksum set, and crc holds the checksum of the header.
+	checksum bool
+	crc      uint32
+	// onControl is called with the headers of control frames skipped by Decode.
+	onControl func(h *Header)
+	// frame holds the encoded header of the last frame read by DecodeHeader, without the sync word.
+	frame []byte
+	// peeked is the header returned by Peek, until its frame is decoded, skipped or forwarded.
+	peeked *Header
+	// chunks reads the rest of the chunked body being decoded, of which buffered bytes have been read into buf, up to
+	// maxBuffered. stream is the io.Reader field ending the last chunked body, until it is read to the end.
+	chunks      *chunkReader
+	buffered    int
+	maxBuffered int
+	stream      *streamReader
+	// err is set once a chunked body is too large to be read to the end, so the next frame can't be found. It is
+	// returned by every decode until Resync.
+	err error
 }
 
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{
+	return NewDecoderWithOpts(r, nil)
+}
+
+// NewDecoderWithOpts returns a Decoder enforcing the resource limits in opts.
+func NewDecoderWithOpts(r io.Reader, opts *DecoderOpts) *Decoder {
+	d := &Decoder{
 		buf:    new(bytes.Buffer),
 		reader: r,
 	}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if d.opts.MaxDepth == 0 {
+		d.opts.MaxDepth = DefaultMaxDepth
+	}
+	if d.opts.Sync {
+		br, ok := r.(*bufio.Reader)
+		if !ok {
+			br = bufio.NewReader(r)
+		}
+		d.reader = br
+	}
+	return d
+}
+
+// Resync skips forward to the next SyncWord followed by a supported version, so the next call to Decode or
+// DecodeHeader reads the frame after a corrupted one. It is only available in sync framing mode. A sync word can occur
+// inside a body, so set FChecksum to detect frames resynchronized on a false match.
+func (d *Decoder) Resync() error {
+	br, ok := d.reader.(*bufio.Reader)
+	if !d.opts.Sync || !ok {
+		return errors.New("resync requires DecoderOpts.Sync")
+	}
+	d.buf.Reset()
+	d.peeked = nil
+	d.chunks = nil
+	d.stream = nil
+	d.err = nil
+	for {
+		b, err := br.Peek(SyncSize + VersionSize)
+		if err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint16(b) == SyncWord && Version(b[SyncSize]) == CurrentVersion {
+			return nil
+		}
+		if _, err = br.Discard(1); err != nil {
+			return err
+		}
+	}
 }
 
 func (d *Decoder) Decode(msg *Message) error {
+	if err := d.endStream(); err != nil {
+		return err
+	}
 	d.buf.Reset()
-	header, err := d.DecodeHeader()
+	header, err := d.nextHeader()
 	if err != nil {
 		return err
 	}
-	var body interface{}
-	if header.HasFlag(FProcedure) {
+	return d.decodeMessage(header, msg)
+}
+
+// decodeMessage decodes the body of the message with the given header, which has been decoded.
+func (d *Decoder) decodeMessage(header *Header, msg *Message) error {
+	var (
+		body interface{}
+		err  error
+	)
+	if header.HasExtension(ExtMore) {
+		body, err = d.decodeChunked(header)
+		if err != nil {
+			return err
+		}
+	} else if header.HasFlag(FProcedure) && header.Type == BatchID {
+		body, err = d.DecodeBatch(uint32(header.Length))
+		if err != nil {
+			return err
+		}
+	} else if header.HasFlag(FProcedure) {
 		body, err = d.DecodeProcedure(header.Type, uint32(header.Length))
 		if err != nil {
 			return err
@@ -67,8 +198,9 @@ func TDecode[T any](d *Decoder) (*TMessage[T], error) {
 func TDecodeProcedure[P any](d *Decoder) (*TMessage[P], error) {
 	var (
 		procedureID ID
+		ok          bool
 	)
-	header, err := d.DecodeHeader()
+	header, err := d.nextHeader()
 	if err != nil {
 		return nil, err
 	}
@@ -88,16 +220,128 @@ func TDecodeProcedure[P any](d *Decoder) (*TMessage[P], error) {
 	if err != nil {
 		return nil, err
 	}
-	p = pBody.(P)
+	if p, ok = pBody.(P); !ok {
+		return nil, errors.New(fmt.Sprintf("expected procedure of type %s, got %s", reflect.TypeOf(p), reflect.TypeOf(pBody)))
+	}
 	return &TMessage[P]{
 		Header: *header,
 		Body:   p,
 	}, nil
 }
 
+// Messages returns an iterator over the messages decoded from the stream. It ends once the stream ends at a frame
+// boundary, or after yielding the first decoding error.
+func (d *Decoder) Messages() iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		for {
+			msg := new(Message)
+			if err := d.Decode(msg); err != nil {
+				if err != io.EOF {
+					yield(nil, err)
+				}
+				return
+			}
+			if !yield(msg, nil) {
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator over the bodies of the messages decoded from the stream, which must all be of type T. The
+// type ID of every message is checked against the ID T is registered with, as a type or a procedure. If T is an
+// interface type, the bodies are type asserted to it instead. Error messages and messages of another type are yielded
+// as errors, and iteration continues after them. It ends once the stream ends at a frame boundary, or after yielding
+// the first decoding error.
+func All[T any](d *Decoder) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var (
+			zero       T
+			id         ID
+			err        error
+			typ        = reflect.TypeFor[T]()
+			registered bool
+			procedure  bool
+		)
+		// Interface types share the ID of the nil type, so only their concrete bodies can be checked.
+		if typ.Kind() != reflect.Interface {
+			id, err = GetIDFromType(zero)
+			registered = err == nil
+			if !registered {
+				id, err = GetProcedureID(zero)
+				registered, procedure = err == nil, err == nil
+			}
+		}
+		for msg, err := range d.Messages() {
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			if msg.IsError() {
+				if !yield(zero, msg.Error()) {
+					return
+				}
+				continue
+			}
+			body, ok := msg.Body.(T)
+			if msg.Body == nil && typ.Kind() == reflect.Interface {
+				ok = true
+			}
+			if registered && (msg.Header.Type != id || msg.Header.HasFlag(FProcedure) != procedure) {
+				ok = false
+			}
+			if !ok {
+				body = zero
+				err = errors.New(fmt.Sprintf("expected body of type %s, got %s with type id %d", typ, reflect.TypeOf(msg.Body), msg.Header.Type))
+			}
+			if !yield(body, err) {
+				return
+			}
+		}
+	}
+}
+
+// DecodeHeader decodes the header of the next frame, or returns the header returned by Peek. The body is decoded
+// with DecodeBody.
 func (d *Decoder) DecodeHeader() (*Header, error) {
+	if d.peeked != nil {
+		header := d.peeked
+		d.peeked = nil
+		return header, nil
+	}
+	return d.decodeHeader()
+}
+
+func (d *Decoder) decodeHeader() (*Header, error) {
 	var header Header
-	n, err := io.CopyN(d.buf, d.reader, HeaderSize)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := d.endStream(); err != nil {
+		return nil, err
+	}
+	d.buf.Reset()
+	d.frame = d.frame[:0]
+	d.crc = 0
+	d.checksum = false
+	if d.opts.Sync {
+		// The sync word is only consumed once it matches, so Resync can find a frame right after the bytes that didn't.
+		br := d.reader.(*bufio.Reader)
+		sync, err := br.Peek(SyncSize)
+		if err != nil {
+			if err == io.EOF && len(sync) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if binary.BigEndian.Uint16(sync) != SyncWord {
+			return nil, ErrSyncLost
+		}
+		if _, err = br.Discard(SyncSize); err != nil {
+			return nil, err
+		}
+	}
+	n, err := d.readHeader(HeaderSize)
 	if err != nil {
 		return nil, err
 	}
@@ -124,7 +368,7 @@ func (d *Decoder) DecodeHeader() (*Header, error) {
 		return nil, err
 	}
 	if (Flag(flags) & FTransaction) == FTransaction {
-		n, err = io.CopyN(d.buf, d.reader, TransactionIDSize)
+		n, err = d.readHeader(TransactionIDSize)
 		var tn int
 		if tn, err = d.buf.Read(transID[:]); err != nil {
 			return nil, err
@@ -134,7 +378,7 @@ func (d *Decoder) DecodeHeader() (*Header, error) {
 		}
 	}
 	if (Flag(flags) & F32b) == F32b {
-		n, err = io.CopyN(d.buf, d.reader, LengthSize)
+		n, err = d.readHeader(LengthSize)
 		if err != nil {
 			return nil, err
 		}
@@ -157,22 +401,181 @@ func (d *Decoder) DecodeHeader() (*Header, error) {
 	header.Type = ID(typeID)
 	header.TransactionID = transID
 	header.Length = Length(length)
+	if header.HasFlag(FExtension) {
+		if err = d.decodeExtension(&header); err != nil {
+			return nil, err
+		}
+	}
+	d.checksum = header.HasFlag(FChecksum)
 
 	return &header, nil
 }
 
-func (d *Decoder) DecodeBody(typeID ID, l uint32, l32 bool) (any, error) {
-	d.buf.Reset()
-	d.buf.Grow(int(l))
-	n, err := io.CopyN(d.buf, d.reader, int64(l))
+// Peek decodes the header of the next frame, control frames included, and leaves its body unread. Calling Peek again
+// returns the same header until the frame is consumed by Decode, DecodeHeader, Skip or Forward.
+func (d *Decoder) Peek() (*Header, error) {
+	if d.peeked == nil {
+		header, err := d.decodeHeader()
+		if err != nil {
+			return nil, err
+		}
+		d.peeked = header
+	}
+	header := *d.peeked
+	return &header, nil
+}
+
+// Skip discards the next message, or the message of the header returned by Peek, without buffering its body. Every
+// frame of a chunked body is discarded, along with control frames sent between them. Checksums aren't verified.
+func (d *Decoder) Skip() error {
+	return d.copyMessage(io.Discard, false)
+}
+
+// Forward copies the next message, or the message of the header returned by Peek, to w as it was read, sync words and
+// checksum trailers included. Every frame of a chunked body is copied, along with control frames sent between them.
+// Checksums aren't verified.
+func (d *Decoder) Forward(w io.Writer) error {
+	return d.copyMessage(w, true)
+}
+
+// copyMessage copies the frames of the next message to w, until the last frame of a chunked body. Only the bodies and
+// checksum trailers are copied unless headers is set.
+func (d *Decoder) copyMessage(w io.Writer, headers bool) error {
+	header, err := d.DecodeHeader()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if n != int64(l) {
-		return nil, errors.New("unexpected end of body")
+	more := header.HasExtension(ExtMore)
+	for {
+		if err = d.copyFrame(w, header, headers); err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+		if header, err = d.decodeHeader(); err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		// Control frames sent between the chunks don't end the message.
+		if !header.HasFlag(FControl) {
+			more = header.HasExtension(ExtMore)
+		}
+	}
+}
+
+// copyFrame copies the frame with the given header, which has been decoded, to w. The header is written first, with
+// the sync word in sync framing mode, if withHeader is set.
+func (d *Decoder) copyFrame(w io.Writer, header *Header, withHeader bool) error {
+	if withHeader {
+		if d.opts.Sync {
+			if _, err := w.Write(binary.BigEndian.AppendUint16(nil, SyncWord)); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(d.frame); err != nil {
+			return err
+		}
 	}
-	var typ reflect.Type
-	typ, err = GetTypeFromID(typeID)
+	n := int64(header.Length)
+	if d.checksum {
+		n += ChecksumSize
+	}
+	d.checksum = false
+	if _, err := io.CopyN(w, d.reader, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// nextHeader decodes the header of the next frame that isn't a control frame. The bodies of control frames are
+// skipped.
+func (d *Decoder) nextHeader() (*Header, error) {
+	for {
+		header, err := d.DecodeHeader()
+		if err != nil {
+			return nil, err
+		}
+		if !header.HasFlag(FControl) {
+			return header, nil
+		}
+		if err = d.skipControl(header); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// skipControl skips the body of the control frame of h, which has been decoded, and passes h to onControl.
+func (d *Decoder) skipControl(h *Header) error {
+	if err := d.readBody(uint32(h.Length), "control frame"); err != nil {
+		return err
+	}
+	if d.onControl != nil {
+		d.onControl(h)
+	}
+	return nil
+}
+
+func (d *Decoder) decodeExtension(h *Header) error {
+	if _, err := d.readHeader(ExtensionSize); err != nil {
+		return err
+	}
+	ext, err := d.decodeUint8(reflect.Value{}, false)
+	if err != nil {
+		return err
+	}
+	h.Extensions = Extension(ext)
+	if h.Extensions&^(ExtStream|ExtMore|ExtSeq) != 0 {
+		return errors.New(fmt.Sprintf("unsupported header extension %08b", ext))
+	}
+	if h.HasExtension(ExtStream) {
+		if _, err = d.readHeader(StreamIDSize); err != nil {
+			return err
+		}
+		if h.StreamID, err = d.decodeUint32(reflect.Value{}, false); err != nil {
+			return err
+		}
+	}
+	if h.HasExtension(ExtSeq) {
+		if _, err = d.readHeader(SeqSize); err != nil {
+			return err
+		}
+		if h.Seq, err = d.decodeUint32(reflect.Value{}, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHeader reads n bytes of the header into the buffer, adding them to the header checksum.
+func (d *Decoder) readHeader(n int64) (int64, error) {
+	start := d.buf.Len()
+	n, err := io.CopyN(d.buf, d.reader, n)
+	read := d.buf.Bytes()[start:]
+	d.crc = crc32.Update(d.crc, crc32c, read)
+	// io.EOF is only returned when the stream ends at a frame boundary.
+	if err == io.EOF && (n > 0 || len(d.frame) > 0 || d.opts.Sync) {
+		err = io.ErrUnexpectedEOF
+	}
+	d.frame = append(d.frame, read...)
+	return n, err
+}
+
+func (d *Decoder) DecodeBody(typeID ID, l uint32, l32 bool) (any, error) {
+	if err := d.readBody(l, "body"); err != nil {
+		return nil, err
+	}
+	return d.decodeBody(typeID, l32)
+}
+
+// decodeBody decodes a body of type typeID that has been read into the buffer.
+func (d *Decoder) decodeBody(typeID ID, l32 bool) (any, error) {
+	typ, err := GetTypeFromID(typeID)
 	if err != nil {
 		return nil, err
 	}
@@ -191,17 +594,15 @@ func (d *Decoder) DecodeBody(typeID ID, l uint32, l32 bool) (any, error) {
 }
 
 func (d *Decoder) DecodeProcedure(procedureID ID, l uint32) (any, error) {
-	d.buf.Reset()
-	d.buf.Grow(int(l))
-	n, err := io.CopyN(d.buf, d.reader, int64(l))
-	if err != nil {
+	if err := d.readBody(l, "procedure"); err != nil {
 		return nil, err
 	}
-	if n != int64(l) {
-		return nil, errors.New("unexpected end of procedure")
-	}
-	var typ reflect.Type
-	typ, err = GetProcedureFromID(procedureID)
+	return d.decodeProcedureBody(procedureID)
+}
+
+// decodeProcedureBody decodes a procedure that has been read into the buffer.
+func (d *Decoder) decodeProcedureBody(procedureID ID) (any, error) {
+	typ, err := GetProcedureFromID(procedureID)
 	if err != nil {
 		return nil, err
 	}
@@ -219,9 +620,59 @@ func (d *Decoder) DecodeProcedure(procedureID ID, l uint32) (any, error) {
 	return val.Interface(), nil
 }
 
+// readBody reads a body of length l into the buffer, and resets the limits tracked per message.
+func (d *Decoder) readBody(l uint32, what string) error {
+	if d.opts.MaxMessageSize > 0 && l > d.opts.MaxMessageSize {
+		return &LimitError{Err: ErrMessageTooLarge, Value: int(l), Max: int(d.opts.MaxMessageSize)}
+	}
+	// The body of a peeked frame can be read with DecodeBody, which consumes the frame.
+	d.peeked = nil
+	d.buf.Reset()
+	d.buf.Grow(min(int(l), maxBodyPrealloc))
+	d.depth = 0
+	d.alloc = 0
+	n, err := io.CopyN(d.buf, d.reader, int64(l))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if n != int64(l) {
+		return errors.New(fmt.Sprintf("unexpected end of %s", what))
+	}
+	if d.checksum {
+		return d.verifyChecksum()
+	}
+	return nil
+}
+
+// verifyChecksum reads the checksum trailer following the body, and compares it to the checksum of the header and body.
+func (d *Decoder) verifyChecksum() error {
+	d.checksum = false
+	var trailer [ChecksumSize]byte
+	if _, err := io.ReadFull(d.reader, trailer[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(trailer[:]) != crc32.Update(d.crc, crc32c, d.buf.Bytes()) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// sub returns a Decoder reading from b, with the limits of d.
+func (d *Decoder) sub(b []byte) *Decoder {
+	return &Decoder{
+		buf:   bytes.NewBuffer(b),
+		opts:  d.opts,
+		depth: d.depth,
+		alloc: d.alloc,
+	}
+}
+
 func (d *Decoder) decodeProcedure(p reflect.Value, procedureID ID) error {
-	typ, ok := pReverseRegistry[procedureID]
-	if !ok {
+	typ, err := GetProcedureFromID(procedureID)
+	if err != nil {
 		return errors.New(fmt.Sprintf("procedure %s not registered", p.Type().Name()))
 	}
 	t := p.Type()
@@ -233,9 +684,12 @@ func (d *Decoder) decodeProcedure(p reflect.Value, procedureID ID) error {
 		return err
 	}
 	kind := PKind(k)
-	p.FieldByName("Kind").Set(reflect.ValueOf(kind))
+	if kind == Unknown || kind > Notify {
+		return errors.New(fmt.Sprintf("invalid procedure kind %d", k))
+	}
+	procedureValue(p, "Kind").Set(reflect.ValueOf(kind))
 	if kind == Response {
-		field := p.FieldByName("Out")
+		field := procedureValue(p, "Out")
 		if !field.IsValid() {
 			return errors.New("procedure must have a valid Out field")
 		}
@@ -245,11 +699,10 @@ func (d *Decoder) decodeProcedure(p reflect.Value, procedureID ID) error {
 		}
 	} else {
 		for i := range t.NumField() {
-			tField := t.Field(i)
-			if tField.Name == "Procedure" {
+			if isProcedureField(t, i) {
 				continue
 			}
-			field := p.FieldByName(tField.Name)
+			field := p.Field(i)
 			err = d.decodeValue(field, field.Type(), field.Kind(), false)
 			if err != nil {
 				return err
@@ -263,6 +716,14 @@ func (d *Decoder) decodeProcedure(p reflect.Value, procedureID ID) error {
 func (d *Decoder) decodeValue(v reflect.Value, t reflect.Type, k reflect.Kind, l32 bool) error {
 	var val interface{}
 	var err error
+	if d.stream != nil {
+		// A value follows the io.Reader field, so its segments are read first.
+		r := d.stream
+		d.stream = nil
+		if err = r.buffer(); err != nil {
+			return err
+		}
+	}
 	switch k {
 	case reflect.Uint:
 		val, err = d.decodeUint(v, l32)
@@ -447,6 +908,16 @@ func (d *Decoder) decodeValue(v reflect.Value, t reflect.Type, k reflect.Kind, l
 		}
 		v.Set(reflect.ValueOf(val))
 		return nil
+	case reflect.Interface:
+		if t != tReader {
+			return errors.New("unsupported type")
+		}
+		val, err = d.decodeReader(v, l32)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(val))
+		return nil
 	default:
 		return errors.New("unsupported type")
 	}
@@ -463,79 +934,118 @@ func (d *Decoder) decodeLength(v reflect.Value, l32 bool) (int, error) {
 
 func (d *Decoder) decodeUint(_ reflect.Value, _ bool) (uint, error) {
 	var value uint64
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(8)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return uint(value), err
 }
 
 func (d *Decoder) decodeUint8(_ reflect.Value, _ bool) (uint8, error) {
 	var value uint8
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(1)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeUint16(_ reflect.Value, _ bool) (uint16, error) {
 	var value uint16
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(2)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeUint32(_ reflect.Value, _ bool) (uint32, error) {
 	var value uint32
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(4)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeUint64(_ reflect.Value, _ bool) (uint64, error) {
 	var value uint64
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(8)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeInt(_ reflect.Value, _ bool) (int, error) {
 	var value int64
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(8)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return int(value), err
 }
 
 func (d *Decoder) decodeInt8(_ reflect.Value, _ bool) (int8, error) {
 	var value int8
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(1)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeInt16(_ reflect.Value, _ bool) (int16, error) {
 	var value int16
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(2)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeInt32(_ reflect.Value, _ bool) (int32, error) {
 	var value int32
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(4)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeInt64(_ reflect.Value, _ bool) (int64, error) {
 	var value int64
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(8)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeFloat32(_ reflect.Value, _ bool) (float32, error) {
 	var value float32
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(4)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeFloat64(_ reflect.Value, _ bool) (float64, error) {
 	var value float64
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(8)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
 func (d *Decoder) decodeBool(_ reflect.Value, _ bool) (bool, error) {
 	var value bool
-	err := binary.Read(d.buf, binary.BigEndian, &value)
+	err := d.need(1)
+	if err == nil {
+		err = binary.Read(d.buf, binary.BigEndian, &value)
+	}
 	return value, err
 }
 
@@ -544,6 +1054,9 @@ func (d *Decoder) decodeString(v reflect.Value, l32 bool) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if err = d.checkCollection(length, 1, 1); err != nil {
+		return "", err
+	}
 	var n int
 	buf := make([]byte, length)
 	n, err = io.ReadFull(d.buf, buf)
@@ -563,6 +1076,13 @@ func (d *Decoder) decodeSlice(v reflect.Value, l32 bool) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = d.checkCollection(length, minEncodedSize(elType), int(elType.Size())); err != nil {
+		return nil, err
+	}
+	if err = d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
 	slice := reflect.MakeSlice(reflect.SliceOf(elType), length, length)
 	if length == 0 {
 		return slice.Interface(), nil
@@ -585,6 +1105,17 @@ func (d *Decoder) decodeArray(v reflect.Value, l32 bool) (interface{}, error) {
 	if v.Len() == 0 {
 		return array.Interface(), nil
 	}
+	size := v.Len() * minEncodedSize(t)
+	if err := d.need(size); err != nil {
+		return nil, err
+	}
+	if size > d.buf.Len() {
+		return nil, &LimitError{Err: ErrTruncated, Value: size, Max: d.buf.Len()}
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
 	for i := 0; i < v.Len(); i++ {
 		val := v.Index(i)
 		err := d.decodeValue(val, t, kind, l32)
@@ -602,6 +1133,10 @@ func (d *Decoder) decodeStruct(v reflect.Value, l32 bool) (interface{}, error) {
 	if n == 0 {
 		return v.Interface(), nil
 	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
 	for i := 0; i < n; i++ {
 		field := v.Field(i)
 		if field.IsValid() && field.CanSet() {
@@ -629,6 +1164,13 @@ func (d *Decoder) decodeMap(v reflect.Value, l32 bool) (interface{}, error) {
 	if length == 0 {
 		return v.Interface(), nil
 	}
+	if err = d.checkCollection(length, minEncodedSize(keyType)+minEncodedSize(valueType), int(keyType.Size()+valueType.Size())); err != nil {
+		return nil, err
+	}
+	if err = d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
 	for i := 0; i < length; i++ {
 		key := reflect.New(keyType).Elem()
 		value := reflect.New(valueType).Elem()
@@ -1,9 +1,13 @@
 package bisp_test
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/sindrebakk1/bisp"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -198,20 +202,137 @@ func TestDecodeMessage_32bLengths(t *testing.T) {
 	client.Close()
 }
 
-func testDecodeBody(t *testing.T, testCases []testCase) {
+func TestDecodeBody_Limits(t *testing.T) {
+	testCases := []struct {
+		name  string
+		value any
+		opts  bisp.DecoderOpts
+		err   error
+	}{
+		{name: "message size", value: "Hello", opts: bisp.DecoderOpts{MaxMessageSize: 4}, err: bisp.ErrMessageTooLarge},
+		{name: "string length", value: "Hello", opts: bisp.DecoderOpts{MaxCollectionLength: 4}, err: bisp.ErrCollectionTooLong},
+		{name: "slice length", value: []int{1, 2, 3}, opts: bisp.DecoderOpts{MaxCollectionLength: 2}, err: bisp.ErrCollectionTooLong},
+		{name: "map length", value: map[string]int{"a": 1, "b": 2}, opts: bisp.DecoderOpts{MaxCollectionLength: 1}, err: bisp.ErrCollectionTooLong},
+		{name: "depth", value: testStructStructField{testStruct{1, "a", true}, "b"}, opts: bisp.DecoderOpts{MaxDepth: 1}, err: bisp.ErrMaxDepth},
+		{name: "alloc", value: []string{"abc", "def"}, opts: bisp.DecoderOpts{MaxAlloc: 32}, err: bisp.ErrAllocLimit},
+	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			encoded, err := encodeTestValue(tc.value, false)
 			assert.Nil(t, err)
+			typeID, err := bisp.GetIDFromType(tc.value)
+			assert.Nil(t, err)
+
+			decoder := bisp.NewDecoderWithOpts(bytes.NewBuffer(encoded), &tc.opts)
+			_, err = decoder.DecodeBody(typeID, uint32(len(encoded)), false)
+			assert.ErrorIs(t, err, tc.err)
+			var limitErr *bisp.LimitError
+			assert.ErrorAs(t, err, &limitErr)
+
+			decoder = bisp.NewDecoder(bytes.NewBuffer(encoded))
+			_, err = decoder.DecodeBody(typeID, uint32(len(encoded)), false)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestDecodeBody_TruncatedLength(t *testing.T) {
+	testCases := []struct {
+		name  string
+		value any
+	}{
+		{name: "string", value: ""},
+		{name: "slice", value: []int{}},
+		{name: "map", value: map[string]int{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			typeID, err := bisp.GetIDFromType(tc.value)
+			assert.Nil(t, err)
+			// A length prefix claiming far more elements than the body holds.
+			encoded := []byte{0xFF, 0xFF, 0x00, 0x00}
+			decoder := bisp.NewDecoder(bytes.NewReader(encoded))
+			_, err = decoder.DecodeBody(typeID, uint32(len(encoded)), false)
+			assert.ErrorIs(t, err, bisp.ErrTruncated)
+		})
+	}
+}
+
+func TestDecodeBody_TruncatedArray(t *testing.T) {
+	encoded, err := encodeTestValue([3]int{1, 2, 3}, false)
+	assert.Nil(t, err)
+	typeID, err := bisp.GetIDFromType([3]int{})
+	assert.Nil(t, err)
+	encoded = encoded[:len(encoded)-1]
+	decoder := bisp.NewDecoder(bytes.NewReader(encoded))
+	_, err = decoder.DecodeBody(typeID, uint32(len(encoded)), false)
+	assert.ErrorIs(t, err, bisp.ErrTruncated)
+}
 
-			client, server := net.Pipe()
-			go func() {
-				_, err = server.Write(encoded)
-				assert.Nil(t, err)
-				server.Close()
-			}()
+func TestDecodeBody_ZeroSizeSlice(t *testing.T) {
+	testCases := []testCase{
+		{value: []testStructPrivateFields{{1, "a", true}, {}, {}}, expected: []testStructPrivateFields{{}, {}, {}}, name: "slice of zero size elements"},
+	}
+	testDecodeBody(t, testCases)
+
+	typeID, err := bisp.GetIDFromType([]testStructPrivateFields{})
+	assert.Nil(t, err)
+	encoded := []byte{0xFF, 0xFF, 0xFF, 0xFF}
+	decoder := bisp.NewDecoder(bytes.NewReader(encoded))
+	_, err = decoder.DecodeBody(typeID, uint32(len(encoded)), true)
+	assert.ErrorIs(t, err, bisp.ErrCollectionTooLong)
+
+	encoded = []byte{0x00, 0x10}
+	decoder = bisp.NewDecoderWithOpts(bytes.NewReader(encoded), &bisp.DecoderOpts{MaxCollectionLength: 8})
+	_, err = decoder.DecodeBody(typeID, uint32(len(encoded)), false)
+	assert.ErrorIs(t, err, bisp.ErrCollectionTooLong)
+}
 
-			decoder := bisp.NewDecoder(client)
+func TestDecoder_Resync(t *testing.T) {
+	// Noise shorter than the sync word must not make Resync skip the frame right after it.
+	for _, noise := range [][]byte{{0x00}, {0x00, 0xB1, 0x01}, {0x00, 0xB1, 0x01, 0x02}} {
+		buf := new(bytes.Buffer)
+		buf.Write(noise)
+		encoder := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{Sync: true})
+		for _, body := range []string{"first", "second", "third"} {
+			err := encoder.Encode(&bisp.Message{Header: bisp.Header{Flags: bisp.FChecksum}, Body: body})
+			assert.NoError(t, err)
+		}
+		encoded := buf.Bytes()
+		// Corrupt the body of the second frame.
+		frameLen := bisp.SyncSize + bisp.HeaderSize + bisp.LengthSize + len("first") + bisp.ChecksumSize
+		encoded[len(noise)+frameLen+bisp.SyncSize+bisp.HeaderSize+bisp.LengthSize] ^= 0x01
+
+		decoder := bisp.NewDecoderWithOpts(bytes.NewReader(encoded), &bisp.DecoderOpts{Sync: true})
+		var msg bisp.Message
+		err := decoder.Decode(&msg)
+		assert.ErrorIs(t, err, bisp.ErrSyncLost)
+		assert.NoError(t, decoder.Resync())
+		assert.NoError(t, decoder.Decode(&msg))
+		assert.Equal(t, "first", msg.Body)
+
+		err = decoder.Decode(&msg)
+		assert.ErrorIs(t, err, bisp.ErrChecksumMismatch)
+		assert.NoError(t, decoder.Resync())
+		assert.NoError(t, decoder.Decode(&msg))
+		assert.Equal(t, "third", msg.Body)
+
+		assert.ErrorIs(t, decoder.Resync(), io.EOF)
+	}
+}
+
+func TestDecoder_ResyncWithoutSync(t *testing.T) {
+	decoder := bisp.NewDecoder(bytes.NewReader(nil))
+	assert.Error(t, decoder.Resync())
+}
+
+func testDecodeBody(t *testing.T, testCases []testCase) {
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded, err := encodeTestValue(tc.value, false)
+			assert.Nil(t, err)
+
+			decoder := bisp.NewDecoder(bytes.NewBuffer(encoded))
 
 			var typeID bisp.ID
 			typeID, err = bisp.GetIDFromType(tc.value)
@@ -228,3 +349,294 @@ func testDecodeBody(t *testing.T, testCases []testCase) {
 		})
 	}
 }
+
+func FuzzDecode(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoder := bisp.NewDecoder(bytes.NewReader(data))
+		var msg bisp.Message
+		_ = decoder.Decode(&msg)
+	})
+}
+
+func FuzzDecodeHeader(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoder := bisp.NewDecoder(bytes.NewReader(data))
+		_, _ = decoder.DecodeHeader()
+	})
+}
+
+func FuzzDecodeProcedure(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoder := bisp.NewDecoder(bytes.NewReader(data))
+		header, err := decoder.DecodeHeader()
+		if err != nil {
+			return
+		}
+		_, _ = decoder.DecodeProcedure(header.Type, uint32(header.Length))
+	})
+}
+
+func FuzzTDecode(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = bisp.TDecode[testStructStructFieldSliceField](bisp.NewDecoder(bytes.NewReader(data)))
+		_, _ = bisp.TDecode[map[string][]int](bisp.NewDecoder(bytes.NewReader(data)))
+		_, _ = bisp.TDecodeProcedure[TestProcedureMultipleParams](bisp.NewDecoder(bytes.NewReader(data)))
+	})
+}
+
+// addFuzzSeeds seeds f with the encoded messages and procedures of the decoder and procedure tests.
+func addFuzzSeeds(f *testing.F) {
+	bodies := []any{
+		"Hello", 42, uint(42), int8(-1), uint16(2), float32(1.1), float64(2.2), true,
+		[]int{1, 2, 3}, []string{"a", "b", "c"}, [3]int{1, 2, 3}, [3]testStruct{{1, "a", true}, {2, "b", false}, {3, "c", true}},
+		testStruct{1, "a", true}, testStructStructField{testStruct{1, "a", true}, "b"},
+		testStructStructFieldSliceField{[]testStruct{{1, "a", true}, {2, "b", false}}},
+		testStructEnum{TestEnum1, TestEnum2, []TestEnum{TestEnum3}},
+		map[int]string{1: "a", 2: "b"}, map[string][]int{"a": {1, 2}},
+	}
+	for _, body := range bodies {
+		for _, flags := range []bisp.Flag{0, bisp.FTransaction, bisp.F32b} {
+			buf := new(bytes.Buffer)
+			msg := bisp.Message{Header: bisp.Header{Flags: flags, TransactionID: testTransactionID}, Body: body}
+			if err := bisp.NewEncoder(buf).Encode(&msg); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+	procedures := []any{pString, pInt, pSlice, pArray, pStruct, pMap, pEnum, pMultipleParams}
+	for _, p := range procedures {
+		for _, kind := range []bisp.PKind{bisp.Call, bisp.Response} {
+			buf := new(bytes.Buffer)
+			if err := bisp.NewEncoder(buf).EncodeProcedure(p, kind, &bisp.EncodeProcedureOpts{TransactionID: testTransactionID}); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := bisp.NewEncoder(buf).EncodeProcedure(pNotification, bisp.Notify, nil); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+}
+
+func TestDecode_SkipsControlFrames(t *testing.T) {
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoder(buf)
+	assert.NoError(t, encoder.EncodeControl(bisp.ControlPing))
+	assert.NoError(t, encoder.Encode(&bisp.Message{Body: "Hello"}))
+	assert.NoError(t, encoder.EncodeControl(bisp.ControlPong))
+
+	decoder := bisp.NewDecoder(buf)
+	header, err := decoder.DecodeHeader()
+	assert.NoError(t, err)
+	assert.True(t, header.HasFlag(bisp.FControl))
+	assert.Equal(t, bisp.ControlPing, header.Type)
+
+	var msg bisp.Message
+	assert.NoError(t, decoder.Decode(&msg))
+	assert.Equal(t, "Hello", msg.Body)
+	assert.ErrorIs(t, decoder.Decode(&msg), io.EOF)
+}
+
+func TestDecoder_Messages(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoder(buf)
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "first"}))
+	assert.NoError(t, enc.EncodeControl(bisp.ControlPing))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: 2}}))
+
+	var bodies []any
+	for msg, err := range bisp.NewDecoder(buf).Messages() {
+		assert.NoError(t, err)
+		bodies = append(bodies, msg.Body)
+	}
+	assert.Equal(t, []any{"first", testStruct{A: 2}}, bodies)
+
+	// A frame cut short is yielded as an error, ending the iteration.
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "truncated"}))
+	var errs []error
+	for _, err := range bisp.NewDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-2])).Messages() {
+		errs = append(errs, err)
+	}
+	if assert.Len(t, errs, 1) {
+		assert.Error(t, errs[0])
+	}
+}
+
+func TestAll(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoder(buf)
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: 1}}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "not a struct"}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Header: bisp.Header{Flags: bisp.FError}, Body: "failed"}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: 2}}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: 3}}))
+
+	var (
+		bodies []testStruct
+		errs   []string
+	)
+	for body, err := range bisp.All[testStruct](bisp.NewDecoder(buf)) {
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		bodies = append(bodies, body)
+		if body.A == 2 {
+			break
+		}
+	}
+	assert.Equal(t, []testStruct{{A: 1}, {A: 2}}, bodies)
+	if assert.Len(t, errs, 2) {
+		assert.Contains(t, errs[0], "expected body of type bisp_test.testStruct")
+		assert.Equal(t, "failed", errs[1])
+	}
+
+	buf.Reset()
+	assert.NoError(t, enc.EncodeProcedure(TestProcedureAdd{A: 1, B: 2}, bisp.Call, nil))
+	for p, err := range bisp.All[TestProcedureAdd](bisp.NewDecoder(buf)) {
+		assert.NoError(t, err)
+		assert.Equal(t, 3, p.A+p.B)
+	}
+}
+
+func TestAll_Interface(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoder(buf)
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "first"}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: 2}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: 3}}))
+
+	var bodies []any
+	for body, err := range bisp.All[any](bisp.NewDecoder(bytes.NewReader(buf.Bytes()))) {
+		assert.NoError(t, err)
+		bodies = append(bodies, body)
+	}
+	assert.Equal(t, []any{"first", 2, testStruct{A: 3}}, bodies)
+
+	// Bodies not implementing the interface are yielded as errors.
+	var errs []string
+	for _, err := range bisp.All[fmt.Stringer](bisp.NewDecoder(buf)) {
+		if assert.Error(t, err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	if assert.Len(t, errs, 3) {
+		assert.Contains(t, errs[0], "expected body of type fmt.Stringer, got string")
+	}
+}
+
+func TestDecoder_Peek(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoder(buf)
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "first"}))
+	assert.NoError(t, enc.EncodeProcedure(pString, bisp.Call, &bisp.EncodeProcedureOpts{Checksum: true}))
+	assert.NoError(t, enc.EncodeControl(bisp.ControlPing))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: 2}}))
+
+	decoder := bisp.NewDecoder(buf)
+	header, err := decoder.Peek()
+	assert.NoError(t, err)
+	again, err := decoder.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, header, again)
+
+	var msg bisp.Message
+	assert.NoError(t, decoder.Decode(&msg))
+	assert.Equal(t, "first", msg.Body)
+
+	header, err = decoder.Peek()
+	assert.NoError(t, err)
+	assert.True(t, header.HasFlag(bisp.FProcedure|bisp.FChecksum))
+	assert.NoError(t, decoder.Skip())
+
+	// Peek returns control frames, which Decode skips.
+	header, err = decoder.Peek()
+	assert.NoError(t, err)
+	assert.True(t, header.HasFlag(bisp.FControl))
+	assert.Equal(t, bisp.ControlPing, header.Type)
+	assert.NoError(t, decoder.Decode(&msg))
+	assert.Equal(t, testStruct{A: 2}, msg.Body)
+
+	_, err = decoder.Peek()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestDecoder_Forward(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{Sync: true})
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "first"}))
+	assert.NoError(t, enc.EncodeProcedure(pString, bisp.Call, &bisp.EncodeProcedureOpts{Checksum: true}))
+	assert.NoError(t, enc.EncodeControl(bisp.ControlPing))
+	assert.NoError(t, enc.Encode(&bisp.Message{Header: bisp.Header{Flags: bisp.F32b}, Body: testStruct{A: 2}}))
+	encoded := bytes.Clone(buf.Bytes())
+
+	out := new(bytes.Buffer)
+	decoder := bisp.NewDecoderWithOpts(buf, &bisp.DecoderOpts{Sync: true})
+	_, err := decoder.Peek()
+	assert.NoError(t, err)
+	for err = decoder.Forward(out); err == nil; err = decoder.Forward(out) {
+	}
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, encoded, out.Bytes())
+
+	// A frame cut short fails with io.ErrUnexpectedEOF.
+	decoder = bisp.NewDecoderWithOpts(bytes.NewReader(encoded[:10]), &bisp.DecoderOpts{Sync: true})
+	assert.ErrorIs(t, decoder.Skip(), io.ErrUnexpectedEOF)
+}
+
+func TestDecoder_PeekDecodeBody(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoder(buf)
+	assert.NoError(t, enc.Encode(&bisp.Message{Header: bisp.Header{Flags: bisp.FChecksum}, Body: "first"}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "after"}))
+
+	decoder := bisp.NewDecoder(buf)
+	header, err := decoder.Peek()
+	assert.NoError(t, err)
+	body, err := decoder.DecodeBody(header.Type, uint32(header.Length), header.HasFlag(bisp.F32b))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", body)
+
+	var msg bisp.Message
+	assert.NoError(t, decoder.Decode(&msg))
+	assert.Equal(t, "after", msg.Body)
+}
+
+func TestDecoder_SkipChunked(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoderWithOpts(buf, &bisp.EncoderOpts{Sync: true, ChunkSize: 8})
+	assert.NoError(t, enc.Encode(&bisp.Message{Header: bisp.Header{Flags: bisp.FChecksum}, Body: strings.Repeat("chunked ", 8)}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "after"}))
+	encoded := bytes.Clone(buf.Bytes())
+
+	decoder := bisp.NewDecoderWithOpts(bytes.NewReader(encoded), &bisp.DecoderOpts{Sync: true})
+	header, err := decoder.Peek()
+	assert.NoError(t, err)
+	assert.True(t, header.HasExtension(bisp.ExtMore))
+	assert.NoError(t, decoder.Skip())
+	var msg bisp.Message
+	assert.NoError(t, decoder.Decode(&msg))
+	assert.Equal(t, "after", msg.Body)
+
+	out := new(bytes.Buffer)
+	decoder = bisp.NewDecoderWithOpts(bytes.NewReader(encoded), &bisp.DecoderOpts{Sync: true})
+	assert.NoError(t, decoder.Forward(out))
+	assert.NoError(t, decoder.Decode(&msg))
+	assert.Equal(t, "after", msg.Body)
+	assert.Equal(t, encoded[:out.Len()], out.Bytes())
+
+	decoder = bisp.NewDecoderWithOpts(out, &bisp.DecoderOpts{Sync: true})
+	assert.NoError(t, decoder.Decode(&msg))
+	assert.Equal(t, strings.Repeat("chunked ", 8), msg.Body)
+
+	// A chunked body cut short fails with io.ErrUnexpectedEOF.
+	decoder = bisp.NewDecoderWithOpts(bytes.NewReader(encoded[:40]), &bisp.DecoderOpts{Sync: true})
+	assert.ErrorIs(t, decoder.Skip(), io.ErrUnexpectedEOF)
+}
@@ -5,23 +5,67 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"reflect"
 )
 
+type EncoderOpts struct {
+	// Sync writes SyncWord before every frame, so a Decoder with DecoderOpts.Sync set can resynchronize to the next
+	// frame after a corrupted one.
+	Sync bool
+	// ChunkSize splits the bodies written by Encode that are larger than ChunkSize into frames of at most ChunkSize
+	// bytes, written as the body is encoded. Chunked bodies are neither buffered whole nor limited by the length field,
+	// and are reassembled by Decode. An encoding error after some frames were written fails the encoder with
+	// ErrMessageAborted. Zero disables chunking.
+	ChunkSize int
+}
+
+// Encoder is not safe for concurrent use, as encodes share a buffer. Use a Conn to send from multiple goroutines.
 type Encoder struct {
 	buf    *bytes.Buffer
 	writer io.Writer
+	opts   EncoderOpts
+	// chunk is the header of the message Encode is chunking, chunkType its type and chunkSize the size of its frames.
+	// chunks is the number of frames written so far.
+	chunk     *Header
+	chunkType ID
+	chunkSize int
+	chunks    int
+	// err is set once a message is aborted after some of its frames were written, and fails every later write.
+	err error
 }
 
+// ErrMessageAborted is returned by an Encoder that failed after writing some of the frames of a message. The reader
+// would decode the frames written next as the rest of the message, so the encoder fails every later write, and the
+// stream must be closed.
+var ErrMessageAborted = errors.New("message aborted after some of its frames were written")
+
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{
+	return NewEncoderWithOpts(w, nil)
+}
+
+func NewEncoderWithOpts(w io.Writer, opts *EncoderOpts) *Encoder {
+	e := &Encoder{
 		buf:    new(bytes.Buffer),
 		writer: w,
 	}
+	if opts != nil {
+		e.opts = *opts
+	}
+	return e
 }
 
 func (e *Encoder) Encode(m *Message) error {
+	err := e.encode(m)
+	if err != nil && e.chunks > 0 {
+		err = e.abort(err)
+	}
+	e.endChunks()
+	return err
+}
+
+func (e *Encoder) encode(m *Message) error {
 	e.buf.Reset()
 	var (
 		err      error
@@ -34,11 +78,22 @@ func (e *Encoder) Encode(m *Message) error {
 		return err
 	}
 	l32 := m.Header.HasFlag(F32b)
+	if e.opts.ChunkSize > 0 {
+		e.startChunks(&m.Header, typeID, l32)
+	}
 	err = e.EncodeBody(m.Body, l32)
 	if err != nil {
 		return err
 	}
 	length = e.buf.Len()
+	if e.chunks > 0 {
+		// The rest of a chunked body is sent in the last frame, which is at most a chunk long.
+		msgBytes, err = e.EncodeHeader(&m.Header, typeID, length)
+		if err != nil {
+			return err
+		}
+		return e.write(&m.Header, msgBytes)
+	}
 	if l32 && length > Max32bMessageBodySize {
 		return errors.New(fmt.Sprintf("message body too large. length: %d max: %d", length, Max32bMessageBodySize))
 	}
@@ -49,18 +104,28 @@ func (e *Encoder) Encode(m *Message) error {
 	if err != nil {
 		return err
 	}
-	msgBytes = append(msgBytes, e.buf.Bytes()...)
-	_, err = e.writer.Write(msgBytes)
-	return err
+	return e.write(&m.Header, msgBytes)
 }
 
 type EncodeProcedureOpts struct {
 	TransactionID TransactionID
+	// Checksum sets FChecksum, appending a CRC32C trailer to the message.
+	Checksum bool
+}
+
+func (o *EncodeProcedureOpts) apply(h *Header) {
+	if o == nil {
+		return
+	}
+	h.TransactionID = o.TransactionID
+	if o.Checksum {
+		h.SetFlag(FChecksum)
+	}
 }
 
 func (e *Encoder) EncodeProcedure(p any, kind PKind, opts *EncodeProcedureOpts) error {
 	if kind == Unknown {
-		return errors.New(fmt.Sprintf("kind %s, set either %s or %s", Unknown, Call, Response))
+		return errors.New(fmt.Sprintf("kind %s, set either %s, %s or %s", Unknown, Call, Response, Notify))
 	}
 	e.buf.Reset()
 	var (
@@ -80,9 +145,7 @@ func (e *Encoder) EncodeProcedure(p any, kind PKind, opts *EncodeProcedureOpts)
 	if err = e.encodeProcedure(v, procedureID, kind); err != nil {
 		return err
 	}
-	if opts != nil {
-		header.TransactionID = opts.TransactionID
-	}
+	opts.apply(&header)
 	length = e.buf.Len()
 	if length > MaxTcpMessageBodySize {
 		return errors.New(fmt.Sprintf("message body too large. length: %d max: %d", length, MaxTcpMessageBodySize))
@@ -91,11 +154,56 @@ func (e *Encoder) EncodeProcedure(p any, kind PKind, opts *EncodeProcedureOpts)
 	if err != nil {
 		return err
 	}
-	msgBytes = append(msgBytes, e.buf.Bytes()...)
-	_, err = e.writer.Write(msgBytes)
+	return e.write(&header, msgBytes)
+}
+
+// write appends the encoded body, and the checksum trailer if h has FChecksum set, to the encoded header and writes
+// the frame, preceded by SyncWord in sync framing mode.
+func (e *Encoder) write(h *Header, msgBytes []byte) error {
+	return e.writeBody(h, msgBytes, e.buf.Bytes())
+}
+
+func (e *Encoder) writeBody(h *Header, msgBytes []byte, body []byte) error {
+	if e.err != nil {
+		return e.err
+	}
+	frame := make([]byte, 0, SyncSize+len(msgBytes)+len(body)+ChecksumSize)
+	if e.opts.Sync {
+		frame = binary.BigEndian.AppendUint16(frame, SyncWord)
+	}
+	start := len(frame)
+	frame = append(frame, msgBytes...)
+	frame = append(frame, body...)
+	if h.HasFlag(FChecksum) {
+		frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(frame[start:], crc32c))
+	}
+	_, err := e.writer.Write(frame)
 	return err
 }
 
+// EncodeControl encodes and writes an empty control frame of type typ, such as ControlPing.
+func (e *Encoder) EncodeControl(typ ID) error {
+	return e.encodeFrame(&Header{Flags: FControl}, typ, nil)
+}
+
+// encodeFrame writes a frame with an already encoded body.
+func (e *Encoder) encodeFrame(h *Header, typeID ID, body []byte) error {
+	var limit uint64 = MaxTcpMessageBodySize
+	if h.HasFlag(F32b) {
+		limit = Max32bMessageBodySize
+	}
+	if uint64(len(body)) > limit {
+		return errors.New(fmt.Sprintf("message body too large. length: %d max: %d", len(body), limit))
+	}
+	e.buf.Reset()
+	e.buf.Write(body)
+	msgBytes, err := e.EncodeHeader(h, typeID, len(body))
+	if err != nil {
+		return err
+	}
+	return e.write(h, msgBytes)
+}
+
 func (e *Encoder) Bytes() []byte {
 	return e.buf.Bytes()
 }
@@ -106,16 +214,19 @@ func (e *Encoder) EncodeHeader(h *Header, typeID ID, length int) ([]byte, error)
 	h.Length = Length(length)
 
 	buf := new(bytes.Buffer)
-	buf.Grow(h.Len() + length)
+	buf.Grow(h.FrameLen())
 
+	if h.HasTransactionID() {
+		h.SetFlag(FTransaction)
+	}
+	if h.Extensions != 0 {
+		h.SetFlag(FExtension)
+	}
 	buf.WriteByte(byte(h.Version))
 	buf.WriteByte(byte(h.Flags))
 	if err := binary.Write(buf, binary.BigEndian, uint16(h.Type)); err != nil {
 		return nil, err
 	}
-	if h.HasTransactionID() {
-		h.SetFlag(FTransaction)
-	}
 	if h.HasFlag(FTransaction) {
 		if err := binary.Write(buf, binary.BigEndian, h.TransactionID); err != nil {
 			return nil, err
@@ -130,6 +241,15 @@ func (e *Encoder) EncodeHeader(h *Header, typeID ID, length int) ([]byte, error)
 			return nil, err
 		}
 	}
+	if h.HasFlag(FExtension) {
+		buf.WriteByte(byte(h.Extensions))
+		if h.HasExtension(ExtStream) {
+			buf.Write(binary.BigEndian.AppendUint32(nil, h.StreamID))
+		}
+		if h.HasExtension(ExtSeq) {
+			buf.Write(binary.BigEndian.AppendUint32(nil, h.Seq))
+		}
+	}
 	return buf.Bytes(), nil
 }
 
@@ -154,26 +274,28 @@ func (e *Encoder) EncodeBody(v any, l32 bool) error {
 }
 
 func (e *Encoder) encodeProcedure(p reflect.Value, procedureID ID, kind PKind) error {
-	t, ok := pReverseRegistry[procedureID]
-	if !ok {
+	t, err := GetProcedureFromID(procedureID)
+	if err != nil {
 		return errors.New(fmt.Sprintf("procedure %s not registered", p.Type().Name()))
 	}
 	if err := e.encodeUint8(reflect.ValueOf(uint8(kind)), false); err != nil {
 		return err
 	}
 	if kind == Response {
-		field := p.FieldByName("Out")
+		field := procedureValue(p, "Out")
+		if !field.IsValid() {
+			return errors.New(fmt.Sprintf("procedure %s is a notification and has no %s", t.Name(), Response))
+		}
 		if err := e.encodeValue(field, field.Kind(), false); err != nil {
 			return err
 		}
 		return nil
 	}
 	for i := range t.NumField() {
-		tField := t.Field(i)
-		if tField.Name == "Procedure" {
+		if isProcedureField(t, i) {
 			continue
 		}
-		field := p.FieldByName(tField.Name)
+		field := p.Field(i)
 		if err := e.encodeValue(field, field.Kind(), false); err != nil {
 			return err
 		}
@@ -220,6 +342,11 @@ func (e *Encoder) encodeValue(val reflect.Value, kind reflect.Kind, l32 bool) er
 		err = e.encodeStruct(val, l32)
 	case reflect.Map:
 		err = e.encodeMap(val, l32)
+	case reflect.Interface:
+		if val.Type() != tReader {
+			return errors.New("unsupported type")
+		}
+		err = e.encodeReader(val, l32)
 	default:
 		return errors.New("unsupported type")
 	}
@@ -298,8 +425,20 @@ func (e *Encoder) encodeString(v reflect.Value, l32 bool) error {
 	if err := e.encodeLength(v.Len(), l32); err != nil {
 		return err
 	}
-	_, err := e.buf.WriteString(v.String())
-	return err
+	s := v.String()
+	if e.chunk == nil {
+		_, err := e.buf.WriteString(s)
+		return err
+	}
+	for len(s) > 0 {
+		n := min(len(s), e.chunkSize)
+		e.buf.WriteString(s[:n])
+		s = s[n:]
+		if err := e.flushChunks(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (e *Encoder) encodeSlice(v reflect.Value, l32 bool) error {
@@ -316,6 +455,9 @@ func (e *Encoder) encodeSlice(v reflect.Value, l32 bool) error {
 		if err := e.encodeValue(v, elemKind, l32); err != nil {
 			return err
 		}
+		if err := e.flushChunks(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -327,6 +469,9 @@ func (e *Encoder) encodeArray(v reflect.Value, l32 bool) error {
 		if err := e.encodeValue(val, elemKind, l32); err != nil {
 			return err
 		}
+		if err := e.flushChunks(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -360,6 +505,9 @@ func (e *Encoder) encodeMap(v reflect.Value, l32 bool) error {
 		if err := e.encodeValue(value, valKind, l32); err != nil {
 			return err
 		}
+		if err := e.flushChunks(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -34,6 +34,30 @@ func TestEncodeHeader(t *testing.T) {
 	server.Close()
 }
 
+func TestEncodeHeader_TransactionIDFlag(t *testing.T) {
+	_, server := net.Pipe()
+
+	// The FTransaction flag is set for headers with a TransactionID, before the flags are written.
+	header := bisp.Header{
+		Version:       bisp.V1,
+		Type:          1,
+		TransactionID: testTransactionID,
+	}
+
+	encoder := bisp.NewEncoder(server)
+	bytes, err := encoder.EncodeHeader(&header, 1, 0)
+	assert.NoError(t, err)
+
+	expected := encodeTestHeader(&bisp.Header{
+		Version:       bisp.V1,
+		Flags:         bisp.FTransaction,
+		Type:          1,
+		TransactionID: testTransactionID,
+	}, false, true)
+	assert.Equal(t, expected, bytes)
+	server.Close()
+}
+
 func TestEncodeBody_String(t *testing.T) {
 	testCases := []testCase{
 		{value: "Hello", name: "Hello"},
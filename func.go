@@ -0,0 +1,171 @@
+package bisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"reflect"
+	"strconv"
+)
+
+var (
+	tContext      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	tError        = reflect.TypeOf((*error)(nil)).Elem()
+	tPKind        = reflect.TypeOf(Unknown)
+	tNotification = reflect.TypeOf(Notification{})
+)
+
+type FuncOpts struct {
+	// ArgNames names the arguments of the function, excluding the context. Defaults to Arg0, Arg1, ...
+	ArgNames []string
+	// ResultNames names the results of the function, excluding the error. Defaults to Ret0, Ret1, ...
+	ResultNames []string
+}
+
+// RegisterFunc registers fn as a procedure named name, and returns its ID. fn must be a function taking a
+// context.Context followed by any number of arguments, and returning any number of results followed by an error.
+//
+// The wire layout is derived from the signature: a call carries the arguments in order, and a response carries the
+// results in order. Only the signature of fn is used, so it may be a nil function of the right type. Servers call
+// functions registered with HandleFunc.
+//
+// Registering name again returns the same ID if the signature and opts match, and panics otherwise.
+func RegisterFunc(name string, fn any, opts *FuncOpts) ID {
+	v := reflect.ValueOf(fn)
+	if !v.IsValid() || v.Kind() != reflect.Func {
+		panic("procedure must be a function")
+	}
+	t := v.Type()
+	if t.IsVariadic() {
+		panic("procedure function must not be variadic")
+	}
+	if t.NumIn() == 0 || t.In(0) != tContext {
+		panic("procedure function must take a context.Context as its first argument")
+	}
+	if t.NumOut() == 0 || t.Out(t.NumOut()-1) != tError {
+		panic("procedure function must return an error as its last result")
+	}
+	if opts == nil {
+		opts = &FuncOpts{}
+	}
+
+	results := make([]reflect.StructField, t.NumOut()-1)
+	for i := range results {
+		results[i] = funcField(opts.ResultNames, "Ret", i, t.Out(i))
+	}
+	args := make([]reflect.StructField, t.NumIn()-1)
+	for i := range args {
+		args[i] = funcField(opts.ArgNames, "Arg", i, t.In(i+1))
+	}
+	p := funcType(name, args, results)
+	pmu.Lock()
+	defer pmu.Unlock()
+	if id, ok := pNameRegistry[name]; ok {
+		if pReverseRegistry[id] != p {
+			panic(fmt.Sprintf("procedure %s is already registered as %s", name, pReverseRegistry[id]))
+		}
+		return id
+	}
+	registerParamTypes(p)
+	id := allocPID()
+	registerProcedureType(name, p, id)
+	return id
+}
+
+// funcType returns the procedure type of a function procedure, holding its Kind, its results in Out, and its arguments.
+func funcType(name string, args, results []reflect.StructField) reflect.Type {
+	fields := []reflect.StructField{
+		// The tag makes the type unique to the procedure, functions with the same signature would otherwise share it.
+		{Name: "Kind", Type: tPKind, Tag: reflect.StructTag("bisp:" + strconv.Quote(name))},
+		{Name: "Out", Type: reflect.StructOf(results)},
+	}
+	return reflect.StructOf(append(fields, args...))
+}
+
+func funcField(names []string, prefix string, i int, t reflect.Type) reflect.StructField {
+	name := fmt.Sprintf("%s%d", prefix, i)
+	if i < len(names) {
+		name = names[i]
+	}
+	if !token.IsIdentifier(name) || !token.IsExported(name) {
+		panic(fmt.Sprintf("procedure function field name %q must be an exported identifier", name))
+	}
+	kind := t.Kind()
+	if kind == reflect.Interface || kind == reflect.Ptr || kind == reflect.Func || kind == reflect.Chan {
+		panic(fmt.Sprintf("procedure function field %s must be a concrete type", name))
+	}
+	return reflect.StructField{Name: name, Type: t}
+}
+
+// NewFuncCall returns a call to the function procedure name, with the arguments set from args.
+func NewFuncCall(name string, args ...any) (any, error) {
+	_, t, ok := lookupProcedure(name)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("procedure not registered: %s", name))
+	}
+	if !isFunc(t) {
+		return nil, errors.New(fmt.Sprintf("procedure %s is not a function", name))
+	}
+	if n := t.NumField() - 2; len(args) != n {
+		return nil, errors.New(fmt.Sprintf("procedure %s takes %d arguments, got %d", name, n, len(args)))
+	}
+	p := reflect.New(t).Elem()
+	for i, arg := range args {
+		field := p.Field(i + 2)
+		val := reflect.ValueOf(arg)
+		if !val.IsValid() || !val.Type().AssignableTo(field.Type()) {
+			return nil, errors.New(fmt.Sprintf("procedure %s argument %s must be %s, got %s", name, t.Field(i+2).Name, field.Type(), reflect.TypeOf(arg)))
+		}
+		field.Set(val)
+	}
+	return p.Interface(), nil
+}
+
+// FuncResults returns the results of a function procedure response.
+func FuncResults(p any) ([]any, error) {
+	v := reflect.ValueOf(p)
+	if !v.IsValid() || !isFunc(v.Type()) {
+		return nil, errors.New(fmt.Sprintf("expected function procedure, got %s", reflect.TypeOf(p)))
+	}
+	out := v.Field(1)
+	results := make([]any, out.NumField())
+	for i := range results {
+		results[i] = out.Field(i).Interface()
+	}
+	return results, nil
+}
+
+// isFunc reports whether t is a procedure type registered with RegisterFunc.
+func isFunc(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || t.NumField() < 2 {
+		return false
+	}
+	kind := t.Field(0)
+	_, ok := kind.Tag.Lookup("bisp")
+	return ok && kind.Name == "Kind" && kind.Type == tPKind && t.Field(1).Name == "Out"
+}
+
+// callFunc calls fn, the function of procedure id, with the arguments of p, and returns p with Out set to the results.
+func callFunc(ctx context.Context, id ID, fn reflect.Value, p any) (any, error) {
+	v := reflect.ValueOf(p)
+	if t, _ := GetProcedureFromID(id); v.Type() != t {
+		return nil, errors.New(fmt.Sprintf("procedure type mismatch: %s != %s", v.Type(), t))
+	}
+	args := make([]reflect.Value, v.NumField()-1)
+	args[0] = reflect.ValueOf(ctx)
+	for i := 2; i < v.NumField(); i++ {
+		args[i-1] = v.Field(i)
+	}
+	results := fn.Call(args)
+	if err, _ := results[len(results)-1].Interface().(error); err != nil {
+		return nil, err
+	}
+	res := reflect.New(v.Type()).Elem()
+	res.Set(v)
+	out := res.Field(1)
+	for i := 0; i < out.NumField(); i++ {
+		out.Field(i).Set(results[i])
+	}
+	return res.Interface(), nil
+}
@@ -0,0 +1,178 @@
+package bisp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func testFuncDivMod(ctx context.Context, a, b int) (int, int, error) {
+	if b == 0 {
+		return 0, 0, errors.New("division by zero")
+	}
+	return a / b, a % b, nil
+}
+
+var testFuncDivModOpts = &bisp.FuncOpts{
+	ArgNames:    []string{"A", "B"},
+	ResultNames: []string{"Quotient", "Remainder"},
+}
+
+func testFuncConcat(ctx context.Context, a string, b []string, sep string) (string, error) {
+	res := a
+	for _, s := range b {
+		res += sep + s
+	}
+	return res, nil
+}
+
+func TestRegisterFunc(t *testing.T) {
+	id := bisp.RegisterFunc("DivMod", testFuncDivMod, testFuncDivModOpts)
+	assert.Equal(t, id, bisp.RegisterFunc("DivMod", testFuncDivMod, testFuncDivModOpts))
+	// The function itself isn't registered, so any function with the same signature matches.
+	var nilDivMod func(context.Context, int, int) (int, int, error)
+	assert.Equal(t, id, bisp.RegisterFunc("DivMod", nilDivMod, testFuncDivModOpts))
+
+	// Functions with the same signature must be registered as distinct procedures.
+	modDiv, err := bisp.NewFuncCall("ModDiv", 7, 2)
+	assert.NoError(t, err)
+	modDivID, err := bisp.GetProcedureID(modDiv)
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, modDivID)
+
+	p, err := bisp.NewFuncCall("DivMod", 7, 2)
+	assert.NoError(t, err)
+	pID, err := bisp.GetProcedureID(p)
+	assert.NoError(t, err)
+	assert.Equal(t, id, pID)
+}
+
+func TestRegisterFunc_Conflict(t *testing.T) {
+	// A different signature, different field names, and a procedure that isn't a function.
+	tcs := []struct {
+		name string
+		fn   any
+	}{
+		{name: "DivMod", fn: testFuncConcat},
+		{name: "DivMod", fn: testFuncDivMod},
+		{name: "TestProcedureAdd", fn: testFuncDivMod},
+	}
+	for _, tc := range tcs {
+		assert.Panics(t, func() {
+			bisp.RegisterFunc(tc.name, tc.fn, nil)
+		})
+	}
+}
+
+func TestRegisterFunc_Invalid(t *testing.T) {
+	tcs := []struct {
+		name string
+		fn   any
+		opts *bisp.FuncOpts
+	}{
+		{name: "not a function", fn: 42},
+		{name: "no context", fn: func(a int) error { return nil }},
+		{name: "no error", fn: func(ctx context.Context, a int) int { return a }},
+		{name: "pointer argument", fn: func(ctx context.Context, a *int) error { return nil }},
+		{name: "variadic", fn: func(ctx context.Context, a ...int) error { return nil }},
+		{name: "unexported name", fn: testFuncDivMod, opts: &bisp.FuncOpts{ArgNames: []string{"a", "b"}}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Panics(t, func() {
+				bisp.RegisterFunc("Invalid"+tc.name, tc.fn, tc.opts)
+			})
+		})
+	}
+}
+
+func TestNewFuncCall_Invalid(t *testing.T) {
+	_, err := bisp.NewFuncCall("NotRegistered")
+	assert.Error(t, err)
+	_, err = bisp.NewFuncCall("DivMod", 1)
+	assert.Error(t, err)
+	_, err = bisp.NewFuncCall("DivMod", 1, "2")
+	assert.Error(t, err)
+	_, err = bisp.NewFuncCall("TestProcedureAdd", 1, 2)
+	assert.Error(t, err)
+}
+
+func TestEncodeDecodeFunc(t *testing.T) {
+	p, err := bisp.NewFuncCall("Concat", "a", []string{"b", "c"}, "-")
+	assert.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoder(buf)
+	err = encoder.EncodeProcedure(p, bisp.Call, nil)
+	assert.NoError(t, err)
+
+	expected := []byte{byte(bisp.Call)}
+	for _, arg := range []any{"a", []string{"b", "c"}, "-"} {
+		b, err := encodeTestValue(arg, false)
+		assert.NoError(t, err)
+		expected = append(expected, b...)
+	}
+	assert.Equal(t, expected, buf.Bytes()[bisp.HeaderSize:])
+
+	decoder := bisp.NewDecoder(buf)
+	var msg bisp.Message
+	err = decoder.Decode(&msg)
+	assert.NoError(t, err)
+	assert.Equal(t, bisp.Call, reflect.ValueOf(msg.Body).FieldByName("Kind").Interface())
+	assert.Equal(t, "a", reflect.ValueOf(msg.Body).FieldByName("Arg0").Interface())
+}
+
+func TestClient_CallFunc(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	client := bisp.NewClient(conn, nil)
+
+	res, err := client.CallFunc(context.Background(), "DivMod", 7, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{3, 1}, res)
+
+	_, err = client.CallFunc(context.Background(), "DivMod", 7, 0)
+	assert.EqualError(t, err, "division by zero")
+
+	res, err = client.CallFunc(context.Background(), "Concat", "a", []string{"b", "c"}, "-")
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"a-b-c"}, res)
+}
+
+func TestClient_CallFuncNoHandler(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	client := bisp.NewClient(conn, nil)
+
+	_, err := client.CallFunc(context.Background(), "Remote", "a")
+	assert.Error(t, err)
+	// Registered with a function, but not handled by this server.
+	_, err = client.CallFunc(context.Background(), "ModDiv", 7, 2)
+	assert.Error(t, err)
+}
+
+func TestHandleFunc(t *testing.T) {
+	srv, conn := newTestServer(t, nil)
+	bisp.HandleFunc(srv, "ModDiv", func(ctx context.Context, a, b int) (int, int, error) {
+		return a % b, a / b, nil
+	}, nil)
+	client := bisp.NewClient(conn, nil)
+
+	res, err := client.CallFunc(context.Background(), "ModDiv", 7, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{1, 3}, res)
+
+	assert.Panics(t, func() {
+		bisp.HandleFunc(srv, "Remote", (func(context.Context, string) (string, error))(nil), nil)
+	})
+}
+
+func init() {
+	bisp.RegisterFunc("DivMod", testFuncDivMod, testFuncDivModOpts)
+	bisp.RegisterFunc("ModDiv", testFuncDivMod, nil)
+	bisp.RegisterFunc("Concat", testFuncConcat, nil)
+	bisp.RegisterFunc("Remote", (func(context.Context, string) (string, error))(nil), nil)
+}
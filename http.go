@@ -0,0 +1,229 @@
+package bisp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ContentType is the media type of the bodies of bisp requests and responses over HTTP.
+const ContentType = "application/x-bisp"
+
+// maxHTTPErrorSize is how much of the body of a failed HTTP response is included in the error.
+const maxHTTPErrorSize = 512
+
+// DefaultMaxHTTPBodySize is the maximum size of the body of requests to HTTPHandler when DecoderOpts.MaxMessageSize is
+// not set.
+const DefaultMaxHTTPBodySize = 4 << 20
+
+// maxHTTPFrameOverhead leaves room for the header and trailer of the frame when the body of requests is limited by
+// DecoderOpts.MaxMessageSize.
+const maxHTTPFrameOverhead = 64
+
+// HTTPHandler returns a handler serving the procedures of s over HTTP. Requests are POSTs with a procedure or batch frame
+// as their body, and the frame of the response is written as the body of the response. Notifications are answered with
+// 204 No Content. Frames are decoded with the decoder options of ServerOpts.ConnOpts, without sync framing. Bodies
+// and messages larger than DecoderOpts.MaxMessageSize, or DefaultMaxHTTPBodySize, are rejected with 413 Request Entity
+// Too Large.
+func HTTPHandler(s *Server) http.Handler {
+	var opts DecoderOpts
+	if s.opts.ConnOpts != nil {
+		opts = s.opts.ConnOpts.Decoder
+	}
+	opts.Sync = false
+	maxBodySize := int64(DefaultMaxHTTPBodySize)
+	if opts.MaxMessageSize > 0 {
+		maxBodySize = int64(opts.MaxMessageSize) + maxHTTPFrameOverhead
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != ContentType {
+			http.Error(w, fmt.Sprintf("unsupported content type, expected %s", ContentType), http.StatusUnsupportedMediaType)
+			return
+		}
+		var msg Message
+		if err := NewDecoderWithOpts(http.MaxBytesReader(w, r.Body, maxBodySize), &opts).Decode(&msg); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) || errors.Is(err, ErrMessageTooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !msg.IsProcedure() {
+			http.Error(w, fmt.Sprintf("expected procedure message, got %s", reflect.TypeOf(msg.Body)), http.StatusBadRequest)
+			return
+		}
+		buf := new(bytes.Buffer)
+		rep := &encoderReplier{enc: NewEncoder(buf)}
+		s.dispatch(r.Context(), rep, &msg)
+		if rep.err != nil {
+			http.Error(w, rep.err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if buf.Len() == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			s.reportError(err)
+		}
+	})
+}
+
+// encoderReplier encodes the response of a procedure dispatched by HTTPHandler, and keeps the error of the last send.
+type encoderReplier struct {
+	enc *Encoder
+	err error
+}
+
+func (r *encoderReplier) Send(msg *Message) error {
+	r.err = r.enc.Encode(msg)
+	return r.err
+}
+
+func (r *encoderReplier) SendProcedure(p any, kind PKind, opts *EncodeProcedureOpts) error {
+	r.err = r.enc.EncodeProcedure(p, kind, opts)
+	return r.err
+}
+
+func (r *encoderReplier) SendBatch(b Batch, opts *EncodeProcedureOpts) error {
+	r.err = r.enc.EncodeBatch(b, opts)
+	return r.err
+}
+
+type HTTPClientOpts struct {
+	// Transport sends the requests. Zero means http.DefaultTransport.
+	Transport http.RoundTripper
+	// UnaryInterceptors are called in order around procedure calls.
+	UnaryInterceptors []UnaryInterceptor
+	// NotifyInterceptors are called in order around notifications.
+	NotifyInterceptors []NotifyInterceptor
+	// Checksum appends a CRC32C trailer to sent requests. The server responds with checksums to requests that have them.
+	Checksum bool
+	// Decoder holds the options of the decoder of responses.
+	Decoder DecoderOpts
+}
+
+// HTTPClient calls procedures served by HTTPHandler, sending each call as a POST request.
+type HTTPClient struct {
+	url  string
+	opts HTTPClientOpts
+}
+
+// NewHTTPClient returns an HTTPClient calling the procedures served at url.
+func NewHTTPClient(url string, opts *HTTPClientOpts) *HTTPClient {
+	c := &HTTPClient{url: url}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Transport == nil {
+		c.opts.Transport = http.DefaultTransport
+	}
+	c.opts.Decoder.Sync = false
+	return c
+}
+
+// CallFunc calls the function procedure name, registered with RegisterFunc, and returns its results.
+func (c *HTTPClient) CallFunc(ctx context.Context, name string, args ...any) ([]any, error) {
+	p, err := NewFuncCall(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	var res any
+	if res, err = c.call(ctx, p); err != nil {
+		return nil, err
+	}
+	return FuncResults(res)
+}
+
+func (c *HTTPClient) call(ctx context.Context, p any) (any, error) {
+	t := reflect.TypeOf(p)
+	id, err := GetProcedureID(p)
+	if err != nil {
+		return nil, err
+	}
+	if isNotification(t) {
+		return nil, errors.New(fmt.Sprintf("procedure %s is a notification, use HTTPClient.Notify", t))
+	}
+	tID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	info := newCallInfo(&Header{Flags: FProcedure, Type: id, TransactionID: tID}, p, Call)
+	return chainUnary(c.opts.UnaryInterceptors, info, func(ctx context.Context, p any) (any, error) {
+		return c.roundTrip(ctx, p, tID)
+	})(ctx, p)
+}
+
+// Notify sends p as a one-way procedure call, and returns once the server has dispatched it.
+func (c *HTTPClient) Notify(ctx context.Context, p any) error {
+	id, err := GetProcedureID(p)
+	if err != nil {
+		return err
+	}
+	info := newCallInfo(&Header{Flags: FProcedure, Type: id}, p, Notify)
+	return chainNotify(c.opts.NotifyInterceptors, info, func(ctx context.Context, p any) error {
+		res, err := c.post(ctx, p, Notify, TransactionID{})
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	})(ctx, p)
+}
+
+func (c *HTTPClient) roundTrip(ctx context.Context, p any, tID TransactionID) (any, error) {
+	res, err := c.post(ctx, p, Call, tID)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var msg Message
+	if err = NewDecoderWithOpts(res.Body, &c.opts.Decoder).Decode(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Header.TransactionID != tID {
+		return nil, errors.New("response transaction ID doesn't match the call")
+	}
+	if msg.IsError() {
+		return nil, msg.Error()
+	}
+	return msg.Body, nil
+}
+
+// post sends p as a procedure of the given kind. Responses with a status other than 200 OK or 204 No Content are
+// returned as errors.
+func (c *HTTPClient) post(ctx context.Context, p any, kind PKind, tID TransactionID) (*http.Response, error) {
+	buf := new(bytes.Buffer)
+	err := NewEncoder(buf).EncodeProcedure(p, kind, &EncodeProcedureOpts{TransactionID: tID, Checksum: c.opts.Checksum})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	res, err := c.opts.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		defer res.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(res.Body, maxHTTPErrorSize))
+		return nil, errors.New(fmt.Sprintf("http status %s: %s", res.Status, strings.TrimSpace(string(b))))
+	}
+	return res, nil
+}
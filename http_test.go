@@ -0,0 +1,114 @@
+package bisp_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHTTPServer(t *testing.T, opts *bisp.ServerOpts) (*bisp.Server, *httptest.Server) {
+	srv := bisp.NewServer(opts)
+	handleTestProcedures(srv)
+	ts := httptest.NewServer(bisp.HTTPHandler(srv))
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func TestHTTPClient_Call(t *testing.T) {
+	_, ts := newTestHTTPServer(t, nil)
+	client := bisp.NewHTTPClient(ts.URL, &bisp.HTTPClientOpts{Transport: ts.Client().Transport, Checksum: true})
+
+	res, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 40, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, bisp.Response, res.Kind)
+	assert.Equal(t, 42, res.Out)
+
+	_, err = bisp.CallProcedure(context.Background(), client, TestProcedureFail{Reason: "boom"})
+	assert.EqualError(t, err, "boom")
+}
+
+func TestHTTPClient_Notify(t *testing.T) {
+	received := make(chan TestNotificationMetric, 1)
+	srv, ts := newTestHTTPServer(t, nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestNotificationMetric) error {
+		received <- *p
+		return nil
+	})
+	var intercepted []bisp.PKind
+	client := bisp.NewHTTPClient(ts.URL, &bisp.HTTPClientOpts{
+		NotifyInterceptors: []bisp.NotifyInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.NotifyHandler) error {
+				intercepted = append(intercepted, info.Kind)
+				return next(ctx, p)
+			},
+		},
+	})
+
+	assert.NoError(t, client.Notify(context.Background(), TestNotificationMetric{Name: "requests", Value: 1.5}))
+	p := <-received
+	assert.Equal(t, "requests", p.Name)
+	assert.Equal(t, []bisp.PKind{bisp.Notify}, intercepted)
+
+	_, err := bisp.CallProcedure(context.Background(), client, TestNotificationMetric{Name: "requests"})
+	assert.Error(t, err)
+}
+
+func TestHTTPHandler_BadRequest(t *testing.T) {
+	_, ts := newTestHTTPServer(t, nil)
+
+	res, err := http.Get(ts.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res, err = http.Post(ts.URL, "application/json", bytes.NewReader([]byte("{}")))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, bisp.NewEncoder(buf).Encode(&bisp.Message{Body: "Hello"}))
+	res, err = http.Post(ts.URL, bisp.ContentType, buf)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// A truncated frame.
+	res, err = http.Post(ts.URL, bisp.ContentType, bytes.NewReader([]byte{1, 16}))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestHTTPHandler_BodyLimit(t *testing.T) {
+	_, ts := newTestHTTPServer(t, nil)
+	buf := new(bytes.Buffer)
+	large := &bisp.Message{Header: bisp.Header{Flags: bisp.F32b}, Body: strings.Repeat("a", bisp.DefaultMaxHTTPBodySize)}
+	assert.NoError(t, bisp.NewEncoder(buf).Encode(large))
+	res, err := http.Post(ts.URL, bisp.ContentType, buf)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	_, ts = newTestHTTPServer(t, &bisp.ServerOpts{ConnOpts: &bisp.ConnOpts{Decoder: bisp.DecoderOpts{MaxMessageSize: 1024}}})
+	client := bisp.NewHTTPClient(ts.URL, nil)
+	_, err = bisp.CallProcedure(context.Background(), client, TestProcedureFail{Reason: strings.Repeat("a", 2048)})
+	assert.ErrorContains(t, err, "413")
+	_, err = bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+}
+
+func TestHTTPClient_Status(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	client := bisp.NewHTTPClient(ts.URL, nil)
+
+	_, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 1, B: 2})
+	assert.ErrorContains(t, err, "404")
+}
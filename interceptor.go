@@ -0,0 +1,127 @@
+package bisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// CallInfo describes the procedure call seen by an interceptor.
+type CallInfo struct {
+	Header Header
+	Name   string
+	Kind   PKind
+}
+
+// UnaryHandler handles a procedure call, and returns the procedure with its Out field set.
+type UnaryHandler func(ctx context.Context, p any) (any, error)
+
+// UnaryInterceptor intercepts procedure calls that expect a response. It must call next to continue the chain.
+type UnaryInterceptor func(ctx context.Context, info *CallInfo, p any, next UnaryHandler) (any, error)
+
+// NotifyHandler handles a one-way procedure call.
+type NotifyHandler func(ctx context.Context, p any) error
+
+// NotifyInterceptor intercepts one-way procedure calls, sent with Notify, that never produce a response. It must call
+// next to continue the chain.
+type NotifyInterceptor func(ctx context.Context, info *CallInfo, p any, next NotifyHandler) error
+
+// StreamInfo describes the Session stream seen by a stream interceptor.
+type StreamInfo struct {
+	ID uint32
+	// Opened is set for streams opened by Session.Run, and unset for streams accepted by Session.Serve.
+	Opened bool
+}
+
+// StreamHandler handles a Session stream. The stream is closed once it returns.
+type StreamHandler func(ctx context.Context, st *Stream) error
+
+// StreamInterceptor intercepts the handlers of Session streams, both accepted and opened. It must call next to
+// continue the chain.
+type StreamInterceptor func(ctx context.Context, info *StreamInfo, st *Stream, next StreamHandler) error
+
+// chainUnary returns a handler calling the interceptors in order, the first interceptor being the outermost.
+func chainUnary(interceptors []UnaryInterceptor, info *CallInfo, final UnaryHandler) UnaryHandler {
+	h := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, p any) (any, error) {
+			return interceptor(ctx, info, p, next)
+		}
+	}
+	return h
+}
+
+// chainNotify returns a handler calling the interceptors in order, the first interceptor being the outermost.
+func chainNotify(interceptors []NotifyInterceptor, info *CallInfo, final NotifyHandler) NotifyHandler {
+	h := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, p any) error {
+			return interceptor(ctx, info, p, next)
+		}
+	}
+	return h
+}
+
+// chainStream returns a handler calling the interceptors in order, the first interceptor being the outermost.
+func chainStream(interceptors []StreamInterceptor, info *StreamInfo, final StreamHandler) StreamHandler {
+	h := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, st *Stream) error {
+			return interceptor(ctx, info, st, next)
+		}
+	}
+	return h
+}
+
+func newCallInfo(h *Header, p any, kind PKind) *CallInfo {
+	info := &CallInfo{
+		Header: *h,
+		Kind:   kind,
+	}
+	if t, err := GetProcedureFromID(h.Type); err == nil {
+		info.Name = procedureName(t)
+	} else if t = reflect.TypeOf(p); t != nil {
+		info.Name = procedureName(t)
+	}
+	return info
+}
+
+// RecoverUnary returns an interceptor turning panics in the rest of the chain into errors.
+func RecoverUnary() UnaryInterceptor {
+	return func(ctx context.Context, info *CallInfo, p any, next UnaryHandler) (res any, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New(fmt.Sprintf("procedure %s panicked: %v", info.Name, r))
+			}
+		}()
+		return next(ctx, p)
+	}
+}
+
+// RecoverNotify returns an interceptor turning panics in the rest of the chain into errors.
+func RecoverNotify() NotifyInterceptor {
+	return func(ctx context.Context, info *CallInfo, p any, next NotifyHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New(fmt.Sprintf("procedure %s panicked: %v", info.Name, r))
+			}
+		}()
+		return next(ctx, p)
+	}
+}
+
+// RecoverStream returns an interceptor turning panics in the rest of the chain into errors.
+func RecoverStream() StreamInterceptor {
+	return func(ctx context.Context, info *StreamInfo, st *Stream, next StreamHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New(fmt.Sprintf("stream %d panicked: %v", info.ID, r))
+			}
+		}()
+		return next(ctx, st)
+	}
+}
@@ -0,0 +1,267 @@
+package bisp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+type TestProcedurePanic struct {
+	bisp.Procedure[int]
+}
+
+func TestServer_UnaryInterceptors(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+		infos []bisp.CallInfo
+	)
+	record := func(name string) bisp.UnaryInterceptor {
+		return func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.UnaryHandler) (any, error) {
+			mu.Lock()
+			calls = append(calls, name)
+			infos = append(infos, *info)
+			mu.Unlock()
+			return next(ctx, p)
+		}
+	}
+	_, conn := newTestServer(t, &bisp.ServerOpts{
+		UnaryInterceptors: []bisp.UnaryInterceptor{record("first"), record("second")},
+	})
+	client := bisp.NewClient(conn, nil)
+
+	res, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Out)
+
+	id, err := bisp.GetProcedureID(TestProcedureAdd{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, calls)
+	assert.Equal(t, "TestProcedureAdd", infos[0].Name)
+	assert.Equal(t, bisp.Call, infos[0].Kind)
+	assert.Equal(t, id, infos[0].Header.Type)
+	assert.True(t, infos[0].Header.HasTransactionID())
+}
+
+func TestServer_UnaryInterceptorReject(t *testing.T) {
+	_, conn := newTestServer(t, &bisp.ServerOpts{
+		UnaryInterceptors: []bisp.UnaryInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.UnaryHandler) (any, error) {
+				if add, ok := p.(TestProcedureAdd); ok && add.A < 0 {
+					return nil, errors.New("unauthorized")
+				}
+				return next(ctx, p)
+			},
+		},
+	})
+	client := bisp.NewClient(conn, nil)
+
+	_, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: -1, B: 2})
+	assert.EqualError(t, err, "unauthorized")
+	res, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Out)
+}
+
+func TestServer_RecoverUnary(t *testing.T) {
+	srv, conn := newTestServer(t, &bisp.ServerOpts{
+		UnaryInterceptors: []bisp.UnaryInterceptor{bisp.RecoverUnary()},
+	})
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedurePanic) error {
+		panic("boom")
+	})
+	client := bisp.NewClient(conn, nil)
+
+	_, err := bisp.CallProcedure(context.Background(), client, TestProcedurePanic{})
+	assert.EqualError(t, err, "procedure TestProcedurePanic panicked: boom")
+}
+
+func TestServer_NotifyInterceptors(t *testing.T) {
+	infos := make(chan bisp.CallInfo, 1)
+	srv, conn := newTestServer(t, &bisp.ServerOpts{
+		NotifyInterceptors: []bisp.NotifyInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.NotifyHandler) error {
+				infos <- *info
+				return next(ctx, p)
+			},
+		},
+	})
+	received := make(chan TestNotificationMetric, 1)
+	bisp.Handle(srv, func(ctx context.Context, p *TestNotificationMetric) error {
+		received <- *p
+		return nil
+	})
+	client := bisp.NewClient(conn, nil)
+
+	err := bisp.NotifyProcedure(context.Background(), client, TestNotificationMetric{Name: "requests"})
+	assert.NoError(t, err)
+	select {
+	case info := <-infos:
+		assert.Equal(t, "TestNotificationMetric", info.Name)
+		assert.Equal(t, bisp.Notify, info.Kind)
+	case <-time.After(time.Second):
+		t.Fatal("interceptor not called")
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("notification not dispatched")
+	}
+}
+
+func TestClient_Interceptors(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	var (
+		unary  []bisp.CallInfo
+		stream []bisp.CallInfo
+	)
+	client := bisp.NewClient(conn, &bisp.ClientOpts{
+		UnaryInterceptors: []bisp.UnaryInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.UnaryHandler) (any, error) {
+				unary = append(unary, *info)
+				add := p.(TestProcedureAdd)
+				add.B *= 10
+				return next(ctx, add)
+			},
+		},
+		NotifyInterceptors: []bisp.NotifyInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.NotifyHandler) error {
+				stream = append(stream, *info)
+				return errors.New("dropped")
+			},
+		},
+	})
+
+	res, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 21, res.Out)
+	assert.Len(t, unary, 1)
+	assert.Equal(t, "TestProcedureAdd", unary[0].Name)
+
+	err = bisp.NotifyProcedure(context.Background(), client, TestNotificationMetric{Name: "requests"})
+	assert.EqualError(t, err, "dropped")
+	assert.Len(t, stream, 1)
+	assert.Equal(t, bisp.Notify, stream[0].Kind)
+}
+
+func TestClient_BatchInterceptors(t *testing.T) {
+	received := make(chan TestNotificationMetric, 1)
+	srv, conn := newTestServer(t, nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestNotificationMetric) error {
+		received <- *p
+		return nil
+	})
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	client := bisp.NewClient(conn, &bisp.ClientOpts{
+		UnaryInterceptors: []bisp.UnaryInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.UnaryHandler) (any, error) {
+				mu.Lock()
+				names = append(names, info.Name)
+				mu.Unlock()
+				add, ok := p.(TestProcedureAdd)
+				if !ok {
+					return nil, errors.New("unauthorized")
+				}
+				add.B *= 10
+				return next(ctx, add)
+			},
+		},
+		NotifyInterceptors: []bisp.NotifyInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.NotifyHandler) error {
+				mu.Lock()
+				names = append(names, info.Name)
+				mu.Unlock()
+				return next(ctx, p)
+			},
+		},
+	})
+
+	res, err := client.CallBatch(context.Background(),
+		bisp.BatchEntry{Kind: bisp.Call, Procedure: TestProcedureAdd{A: 1, B: 2}},
+		bisp.BatchEntry{Kind: bisp.Notify, Procedure: TestNotificationMetric{Name: "requests"}},
+		bisp.BatchEntry{Kind: bisp.Call, Procedure: TestProcedureFail{Reason: "boom"}},
+	)
+	assert.NoError(t, err)
+	if assert.Len(t, res, 3) {
+		assert.NoError(t, res[0].Err)
+		assert.Equal(t, 21, res[0].Procedure.(TestProcedureAdd).Out)
+		assert.Equal(t, bisp.Notify, res[1].Kind)
+		assert.NoError(t, res[1].Err)
+		// The rejected call isn't sent.
+		assert.EqualError(t, res[2].Err, "unauthorized")
+	}
+	assert.ElementsMatch(t, []string{"TestProcedureAdd", "TestNotificationMetric", "TestProcedureFail"}, names)
+	select {
+	case p := <-received:
+		assert.Equal(t, "requests", p.Name)
+	case <-time.After(time.Second):
+		t.Fatal("notification not dispatched")
+	}
+}
+
+func TestClient_NotifyInterceptorContext(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	type ctxKey struct{}
+	var values []any
+	client := bisp.NewClient(conn, &bisp.ClientOpts{
+		NotifyInterceptors: []bisp.NotifyInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.NotifyHandler) error {
+				values = append(values, ctx.Value(ctxKey{}))
+				return next(ctx, p)
+			},
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	assert.NoError(t, bisp.NotifyProcedure(ctx, client, TestNotificationMetric{Name: "requests"}))
+	cancel()
+	assert.ErrorIs(t, bisp.NotifyProcedure(ctx, client, TestNotificationMetric{Name: "requests"}), context.Canceled)
+	assert.Equal(t, []any{"value", "value"}, values)
+}
+
+func TestClient_FuncInterceptorName(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	var names []string
+	client := bisp.NewClient(conn, &bisp.ClientOpts{
+		UnaryInterceptors: []bisp.UnaryInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.UnaryHandler) (any, error) {
+				names = append(names, info.Name)
+				return next(ctx, p)
+			},
+		},
+	})
+
+	_, err := client.CallFunc(context.Background(), "DivMod", 7, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DivMod"}, names)
+}
+
+func TestRecoverNotify(t *testing.T) {
+	conn, server := net.Pipe()
+	defer server.Close()
+	client := bisp.NewClient(conn, &bisp.ClientOpts{
+		NotifyInterceptors: []bisp.NotifyInterceptor{
+			bisp.RecoverNotify(),
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.NotifyHandler) error {
+				panic("boom")
+			},
+		},
+	})
+	defer client.Close()
+
+	err := bisp.NotifyProcedure(context.Background(), client, TestNotificationMetric{Name: "requests"})
+	assert.EqualError(t, err, "procedure TestNotificationMetric panicked: boom")
+}
+
+func init() {
+	bisp.RegisterProcedure[TestProcedurePanic]()
+}
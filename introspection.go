@@ -0,0 +1,317 @@
+package bisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Reserved procedure IDs of the introspection procedures, counting down from the top so registered procedures keep
+// their IDs.
+const (
+	ListProceduresID    ID = 1<<16 - 1
+	DescribeProcedureID ID = 1<<16 - 2
+)
+
+// TypeDescriptor describes the wire layout of a type.
+type TypeDescriptor struct {
+	Kind reflect.Kind
+	// Name is the Go name of the type, e.g. "int", "[]string" or "main.Point".
+	Name string
+	// Len is the length of arrays.
+	Len int
+	// Elem holds the element type of slices, arrays and maps, and Key holds the key type of maps. They hold a single
+	// descriptor when set.
+	Elem []TypeDescriptor
+	Key  []TypeDescriptor
+	// Fields holds the encoded fields of structs, in wire order.
+	Fields []FieldDescriptor
+}
+
+type FieldDescriptor struct {
+	Name string
+	Type TypeDescriptor
+}
+
+// ProcedureDescriptor describes a registered procedure. Args are the fields of a Call, and Results the fields of a
+// Response, in wire order. Procedures registered with RegisterProcedure have a single result named Out.
+type ProcedureDescriptor struct {
+	ID           ID
+	Name         string
+	Notification bool
+	Args         []FieldDescriptor
+	Results      []FieldDescriptor
+}
+
+// ListProcedures returns the descriptors of all procedures handled by the server.
+type ListProcedures struct {
+	Procedure[[]ProcedureDescriptor]
+}
+
+// DescribeProcedure returns the descriptor of the procedure handled by the server as Name.
+type DescribeProcedure struct {
+	Procedure[ProcedureDescriptor]
+	Name string
+}
+
+// GetProcedureDescriptors returns the descriptors of all registered procedures, ordered by ID.
+func GetProcedureDescriptors() []ProcedureDescriptor {
+	return describeProcedures(func(ID) bool {
+		return true
+	})
+}
+
+// describeProcedures returns the descriptors of the registered procedures for which include returns true, ordered by
+// ID.
+func describeProcedures(include func(id ID) bool) []ProcedureDescriptor {
+	// The registry is copied, so include isn't called with pmu held.
+	pmu.RLock()
+	procedures := make(map[ID]reflect.Type, len(pReverseRegistry))
+	for id, t := range pReverseRegistry {
+		procedures[id] = t
+	}
+	pmu.RUnlock()
+	descriptors := make([]ProcedureDescriptor, 0, len(procedures))
+	for id, t := range procedures {
+		if include(id) {
+			descriptors = append(descriptors, describeProcedure(id, t))
+		}
+	}
+	sort.Slice(descriptors, func(i, j int) bool {
+		return descriptors[i].ID < descriptors[j].ID
+	})
+	return descriptors
+}
+
+// GetProcedureDescriptor returns the descriptor of the procedure registered as name.
+func GetProcedureDescriptor(name string) (ProcedureDescriptor, error) {
+	id, t, ok := lookupProcedure(name)
+	if !ok {
+		return ProcedureDescriptor{}, errors.New(fmt.Sprintf("procedure not registered: %s", name))
+	}
+	return describeProcedure(id, t), nil
+}
+
+// RegisterProcedureDescriptor registers a procedure from its descriptor, as received from ListProcedures or
+// DescribeProcedure, under the same ID. The procedure is registered as a function procedure, so it can be called with
+// Client.CallFunc without its Go type. It is safe to call while connections are in use.
+func RegisterProcedureDescriptor(d ProcedureDescriptor) (ID, error) {
+	args, err := descriptorFields(d.Args)
+	if err != nil {
+		return 0, err
+	}
+	var results []reflect.StructField
+	if results, err = descriptorFields(d.Results); err != nil {
+		return 0, err
+	}
+	pmu.Lock()
+	defer pmu.Unlock()
+	if id, ok := pNameRegistry[d.Name]; ok {
+		if id != d.ID {
+			return 0, errors.New(fmt.Sprintf("procedure %s registered with id %d, not %d", d.Name, id, d.ID))
+		}
+		return id, nil
+	}
+	if t, ok := pReverseRegistry[d.ID]; ok || d.ID == BatchID {
+		return 0, errors.New(fmt.Sprintf("procedure id %d already registered as %s", d.ID, t))
+	}
+	registerProcedureType(d.Name, funcType(d.Name, args, results), d.ID)
+	if d.ID >= nextPID && d.ID < DescribeProcedureID {
+		nextPID = d.ID + 1
+	}
+	return d.ID, nil
+}
+
+// Type returns a type with the wire layout described by d. Named types are returned as their underlying type.
+func (d *TypeDescriptor) Type() (reflect.Type, error) {
+	switch d.Kind {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+		return getUnderlyingType(reflect.Value{}, d.Kind), nil
+	case reflect.Slice, reflect.Array:
+		if len(d.Elem) != 1 {
+			return nil, errors.New(fmt.Sprintf("%s descriptor must have an element type", d.Kind))
+		}
+		elem, err := d.Elem[0].Type()
+		if err != nil {
+			return nil, err
+		}
+		if d.Kind == reflect.Array {
+			if d.Len < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid array length %d", d.Len))
+			}
+			return reflect.ArrayOf(d.Len, elem), nil
+		}
+		return reflect.SliceOf(elem), nil
+	case reflect.Map:
+		if len(d.Elem) != 1 || len(d.Key) != 1 {
+			return nil, errors.New("map descriptor must have a key and element type")
+		}
+		key, err := d.Key[0].Type()
+		if err != nil {
+			return nil, err
+		}
+		var elem reflect.Type
+		if elem, err = d.Elem[0].Type(); err != nil {
+			return nil, err
+		}
+		if !key.Comparable() {
+			return nil, errors.New(fmt.Sprintf("invalid map key type %s", key))
+		}
+		return reflect.MapOf(key, elem), nil
+	case reflect.Struct:
+		fields, err := descriptorFields(d.Fields)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.StructOf(fields), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported type %s", d.Kind))
+	}
+}
+
+func descriptorFields(descriptors []FieldDescriptor) (fields []reflect.StructField, err error) {
+	// StructOf panics on invalid or duplicate field names.
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("invalid fields: %v", r))
+		}
+	}()
+	fields = make([]reflect.StructField, len(descriptors))
+	for i, f := range descriptors {
+		var t reflect.Type
+		if t, err = f.Type.Type(); err != nil {
+			return nil, err
+		}
+		fields[i] = reflect.StructField{Name: f.Name, Type: t}
+	}
+	reflect.StructOf(fields)
+	return fields, nil
+}
+
+func describeProcedure(id ID, t reflect.Type) ProcedureDescriptor {
+	d := ProcedureDescriptor{
+		ID:           id,
+		Name:         procedureName(t),
+		Notification: isNotification(t),
+		Args:         make([]FieldDescriptor, 0, t.NumField()),
+	}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if isProcedureField(t, i) {
+			continue
+		}
+		d.Args = append(d.Args, FieldDescriptor{Name: field.Name, Type: describeType(field.Type)})
+	}
+	if d.Notification {
+		return d
+	}
+	out, _ := procedureField(t, "Out")
+	if isFunc(t) {
+		for i := range out.Type.NumField() {
+			field := out.Type.Field(i)
+			d.Results = append(d.Results, FieldDescriptor{Name: field.Name, Type: describeType(field.Type)})
+		}
+	} else {
+		d.Results = []FieldDescriptor{{Name: out.Name, Type: describeType(out.Type)}}
+	}
+	return d
+}
+
+func describeType(t reflect.Type) TypeDescriptor {
+	return describeTypeSeen(t, make(map[reflect.Type]bool))
+}
+
+// describeTypeSeen describes t, leaving out the fields of structs already being described to stop at recursive types.
+func describeTypeSeen(t reflect.Type, seen map[reflect.Type]bool) TypeDescriptor {
+	d := TypeDescriptor{
+		Kind: t.Kind(),
+		Name: t.String(),
+	}
+	switch t.Kind() {
+	case reflect.Array:
+		d.Len = t.Len()
+		d.Elem = []TypeDescriptor{describeTypeSeen(t.Elem(), seen)}
+	case reflect.Slice:
+		d.Elem = []TypeDescriptor{describeTypeSeen(t.Elem(), seen)}
+	case reflect.Map:
+		d.Key = []TypeDescriptor{describeTypeSeen(t.Key(), seen)}
+		d.Elem = []TypeDescriptor{describeTypeSeen(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return d
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if field.IsExported() {
+				d.Fields = append(d.Fields, FieldDescriptor{Name: field.Name, Type: describeTypeSeen(field.Type, seen)})
+			}
+		}
+	}
+	return d
+}
+
+// ListProcedures returns the descriptors of all procedures registered on the server.
+func (c *Client) ListProcedures(ctx context.Context) ([]ProcedureDescriptor, error) {
+	res, err := CallProcedure(ctx, c, ListProcedures{})
+	if err != nil {
+		return nil, err
+	}
+	return res.Out, nil
+}
+
+// DescribeProcedure returns the descriptor of the procedure registered on the server as name.
+func (c *Client) DescribeProcedure(ctx context.Context, name string) (ProcedureDescriptor, error) {
+	res, err := CallProcedure(ctx, c, DescribeProcedure{Name: name})
+	if err != nil {
+		return ProcedureDescriptor{}, err
+	}
+	return res.Out, nil
+}
+
+// SyncProcedures lists the procedures handled by the server, and registers them with RegisterProcedureDescriptor, so
+// they can be called with CallFunc. It fails if a procedure is registered locally with another ID. ReconnectingClient
+// runs it on every new connection, unless ReconnectOpts.DisableProcedureSync is set.
+func SyncProcedures(ctx context.Context, c *Client) error {
+	descriptors, err := c.ListProcedures(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, d := range descriptors {
+		if _, err = RegisterProcedureDescriptor(d); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// handleIntrospection registers the handlers of the introspection procedures on s. They describe the procedures s
+// handles, rather than every registered procedure.
+func handleIntrospection(s *Server) {
+	Handle(s, func(ctx context.Context, p *ListProcedures) error {
+		p.Out = describeProcedures(s.handles)
+		return nil
+	})
+	Handle(s, func(ctx context.Context, p *DescribeProcedure) error {
+		d, err := GetProcedureDescriptor(p.Name)
+		if err != nil {
+			return err
+		}
+		if !s.handles(d.ID) {
+			return errors.New(fmt.Sprintf("procedure not handled: %s", p.Name))
+		}
+		p.Out = d
+		return nil
+	})
+}
+
+func init() {
+	registerProcedureType("ListProcedures", reflect.TypeOf(ListProcedures{}), ListProceduresID)
+	registerProcedureType("DescribeProcedure", reflect.TypeOf(DescribeProcedure{}), DescribeProcedureID)
+}
@@ -0,0 +1,249 @@
+package bisp_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+var dynamicDescriptor = bisp.ProcedureDescriptor{
+	ID:   0x7000,
+	Name: "Dynamic",
+	Args: []bisp.FieldDescriptor{
+		{Name: "A", Type: bisp.TypeDescriptor{Kind: reflect.Int}},
+		{Name: "B", Type: bisp.TypeDescriptor{Kind: reflect.Slice, Elem: []bisp.TypeDescriptor{{Kind: reflect.String}}}},
+	},
+	Results: []bisp.FieldDescriptor{
+		{Name: "Out", Type: bisp.TypeDescriptor{Kind: reflect.Map, Key: []bisp.TypeDescriptor{{Kind: reflect.String}}, Elem: []bisp.TypeDescriptor{{Kind: reflect.Int}}}},
+	},
+}
+
+func TestGetProcedureDescriptor(t *testing.T) {
+	id, err := bisp.GetProcedureID(TestProcedureStruct{})
+	assert.NoError(t, err)
+	d, err := bisp.GetProcedureDescriptor("TestProcedureStruct")
+	assert.NoError(t, err)
+
+	pStructType := bisp.TypeDescriptor{
+		Kind: reflect.Struct,
+		Name: "bisp_test.PStruct",
+		Fields: []bisp.FieldDescriptor{
+			{Name: "A", Type: bisp.TypeDescriptor{Kind: reflect.Int, Name: "int"}},
+			{Name: "B", Type: bisp.TypeDescriptor{Kind: reflect.String, Name: "string"}},
+			{Name: "C", Type: bisp.TypeDescriptor{Kind: reflect.Bool, Name: "bool"}},
+		},
+	}
+	assert.Equal(t, bisp.ProcedureDescriptor{
+		ID:      id,
+		Name:    "TestProcedureStruct",
+		Args:    []bisp.FieldDescriptor{{Name: "Struct", Type: pStructType}},
+		Results: []bisp.FieldDescriptor{{Name: "Out", Type: pStructType}},
+	}, d)
+
+	_, err = bisp.GetProcedureDescriptor("NotRegistered")
+	assert.Error(t, err)
+}
+
+func TestGetProcedureDescriptor_Func(t *testing.T) {
+	d, err := bisp.GetProcedureDescriptor("DivMod")
+	assert.NoError(t, err)
+	assert.Equal(t, "DivMod", d.Name)
+	assert.Equal(t, []string{"A", "B"}, descriptorNames(d.Args))
+	assert.Equal(t, []string{"Quotient", "Remainder"}, descriptorNames(d.Results))
+}
+
+func TestGetProcedureDescriptor_Notification(t *testing.T) {
+	d, err := bisp.GetProcedureDescriptor("TestNotification")
+	assert.NoError(t, err)
+	assert.True(t, d.Notification)
+	assert.Equal(t, []string{"String", "Int"}, descriptorNames(d.Args))
+	assert.Empty(t, d.Results)
+}
+
+func TestClient_ListProcedures(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	client := bisp.NewClient(conn, nil)
+
+	res, err := client.ListProcedures(context.Background())
+	assert.NoError(t, err)
+
+	var names []string
+	for _, d := range res {
+		names = append(names, d.Name)
+	}
+	assert.Contains(t, names, "ListProcedures")
+	assert.Contains(t, names, "TestProcedureAdd")
+	assert.Contains(t, names, "DivMod")
+	// Registered, but not handled by the server.
+	assert.NotContains(t, names, "TestProcedureMultipleParams")
+
+	expected, err := bisp.GetProcedureDescriptor("TestProcedureAdd")
+	assert.NoError(t, err)
+	for _, d := range res {
+		if d.Name == expected.Name {
+			assertEqualEncoded(t, expected, d)
+		}
+	}
+}
+
+func TestClient_DescribeProcedure(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	client := bisp.NewClient(conn, nil)
+
+	res, err := client.DescribeProcedure(context.Background(), "TestProcedureAdd")
+	assert.NoError(t, err)
+	expected, err := bisp.GetProcedureDescriptor("TestProcedureAdd")
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Name, res.Name)
+	assertEqualEncoded(t, expected, res)
+
+	_, err = client.DescribeProcedure(context.Background(), "NotRegistered")
+	assert.EqualError(t, err, "procedure not registered: NotRegistered")
+	_, err = client.DescribeProcedure(context.Background(), "TestProcedureMultipleParams")
+	assert.EqualError(t, err, "procedure not handled: TestProcedureMultipleParams")
+}
+
+func TestServer_DisableIntrospection(t *testing.T) {
+	_, conn := newTestServer(t, &bisp.ServerOpts{DisableIntrospection: true})
+	client := bisp.NewClient(conn, nil)
+
+	_, err := client.ListProcedures(context.Background())
+	assert.Error(t, err)
+}
+
+func TestRegisterProcedureDescriptor_Concurrent(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	client := bisp.NewClient(conn, nil)
+
+	// Descriptors are registered, as by SyncProcedures on reconnect, while calls are encoded and decoded.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 50 {
+			d := dynamicDescriptor
+			d.ID = 0x7100 + bisp.ID(i)
+			d.Name = fmt.Sprintf("Concurrent%d", i)
+			_, err := bisp.RegisterProcedureDescriptor(d)
+			assert.NoError(t, err)
+		}
+	}()
+	for i := range 50 {
+		res, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: i, B: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, i+1, res.Out)
+	}
+	<-done
+}
+
+func TestRegisterProcedureDescriptor(t *testing.T) {
+	id, err := bisp.RegisterProcedureDescriptor(dynamicDescriptor)
+	assert.NoError(t, err)
+	assert.Equal(t, dynamicDescriptor.ID, id)
+
+	conflict := dynamicDescriptor
+	conflict.ID = 0x7001
+	_, err = bisp.RegisterProcedureDescriptor(conflict)
+	assert.Error(t, err)
+
+	conflict = dynamicDescriptor
+	conflict.Name = "DynamicConflict"
+	_, err = bisp.RegisterProcedureDescriptor(conflict)
+	assert.Error(t, err)
+
+	p, err := bisp.NewFuncCall("Dynamic", 42, []string{"a", "b"})
+	assert.NoError(t, err)
+	buf := new(bytes.Buffer)
+	encoder := bisp.NewEncoder(buf)
+	err = encoder.EncodeProcedure(p, bisp.Call, nil)
+	assert.NoError(t, err)
+
+	expected := []byte{byte(bisp.Call)}
+	for _, arg := range []any{42, []string{"a", "b"}} {
+		b, err := encodeTestValue(arg, false)
+		assert.NoError(t, err)
+		expected = append(expected, b...)
+	}
+	assert.Equal(t, expected, buf.Bytes()[bisp.HeaderSize:])
+}
+
+func TestTypeDescriptor_Type(t *testing.T) {
+	tcs := []struct {
+		name  string
+		value any
+	}{
+		{name: "int", value: 0},
+		{name: "enum", value: TestEnum1},
+		{name: "slice", value: []string{}},
+		{name: "array", value: [3]int{}},
+		{name: "map", value: map[string][]int{}},
+		{name: "struct", value: testStructStructFieldSliceField{}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			typ := reflect.TypeOf(tc.value)
+			expected, err := encodeTestValue(reflect.Zero(typ).Interface(), false)
+			assert.NoError(t, err)
+
+			described := describeTestType(typ)
+			res, err := described.Type()
+			assert.NoError(t, err)
+			encoded, err := encodeTestValue(reflect.Zero(res).Interface(), false)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, encoded)
+		})
+	}
+	invalid := bisp.TypeDescriptor{Kind: reflect.Struct, Fields: []bisp.FieldDescriptor{{Name: "a", Type: bisp.TypeDescriptor{Kind: reflect.Int}}}}
+	_, err := invalid.Type()
+	assert.Error(t, err)
+	invalid = bisp.TypeDescriptor{Kind: reflect.Ptr}
+	_, err = invalid.Type()
+	assert.Error(t, err)
+}
+
+func describeTestType(t reflect.Type) bisp.TypeDescriptor {
+	d := bisp.TypeDescriptor{Kind: t.Kind(), Name: t.String()}
+	switch t.Kind() {
+	case reflect.Array:
+		d.Len = t.Len()
+		d.Elem = []bisp.TypeDescriptor{describeTestType(t.Elem())}
+	case reflect.Slice:
+		d.Elem = []bisp.TypeDescriptor{describeTestType(t.Elem())}
+	case reflect.Map:
+		d.Key = []bisp.TypeDescriptor{describeTestType(t.Key())}
+		d.Elem = []bisp.TypeDescriptor{describeTestType(t.Elem())}
+	case reflect.Struct:
+		for i := range t.NumField() {
+			d.Fields = append(d.Fields, bisp.FieldDescriptor{Name: t.Field(i).Name, Type: describeTestType(t.Field(i).Type)})
+		}
+	}
+	return d
+}
+
+// assertEqualEncoded compares values by their encoding, as decoding turns nil slices into empty slices.
+func assertEqualEncoded(t *testing.T, expected, actual any) {
+	encode := func(v any) []byte {
+		encoder := bisp.NewEncoder(new(bytes.Buffer))
+		assert.NoError(t, encoder.EncodeBody(v, false))
+		return encoder.Bytes()
+	}
+	assert.Equal(t, encode(expected), encode(actual))
+}
+
+func descriptorNames(fields []bisp.FieldDescriptor) []string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+func init() {
+	if _, err := bisp.RegisterProcedureDescriptor(dynamicDescriptor); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,103 @@
+package bisp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	ErrMessageTooLarge   = errors.New("message too large")
+	ErrCollectionTooLong = errors.New("collection too long")
+	ErrMaxDepth          = errors.New("max nesting depth exceeded")
+	ErrAllocLimit        = errors.New("allocation limit exceeded")
+	// ErrTruncated is returned when a length prefix claims more data than the rest of the body holds.
+	ErrTruncated = errors.New("length exceeds remaining body")
+	// ErrPacketTooLarge is returned by PacketConn and ReliableConn for frames larger than their MaxPacketSize.
+	ErrPacketTooLarge = errors.New("packet too large")
+)
+
+// LimitError is returned by the Decoder when a message exceeds one of the limits in DecoderOpts, and by PacketConn and
+// ReliableConn for packets larger than their MaxPacketSize. It wraps one of ErrMessageTooLarge, ErrCollectionTooLong,
+// ErrMaxDepth, ErrAllocLimit, ErrTruncated or ErrPacketTooLarge.
+type LimitError struct {
+	Err   error
+	Value int
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s. value: %d max: %d", e.Err, e.Value, e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// checkCollection checks the length of a collection read from the wire before it is allocated. minSize is the minimum
+// encoded size of an element, and size the number of bytes allocated per element. The length of collections of
+// elements that encode to zero bytes can't be bounded by the body, so it is bounded by DefaultMaxZeroSizeLength unless
+// DecoderOpts.MaxCollectionLength is set.
+func (d *Decoder) checkCollection(length, minSize, size int) error {
+	maxLength := d.opts.MaxCollectionLength
+	if maxLength <= 0 && minSize == 0 {
+		maxLength = DefaultMaxZeroSizeLength
+	}
+	if maxLength > 0 && length > maxLength {
+		return &LimitError{Err: ErrCollectionTooLong, Value: length, Max: maxLength}
+	}
+	if minSize > 0 {
+		if err := d.need(length * minSize); err != nil {
+			return err
+		}
+	}
+	if minSize > 0 && length > d.buf.Len()/minSize {
+		return &LimitError{Err: ErrTruncated, Value: length, Max: d.buf.Len() / minSize}
+	}
+	d.alloc += length * size
+	if d.opts.MaxAlloc > 0 && d.alloc > d.opts.MaxAlloc {
+		return &LimitError{Err: ErrAllocLimit, Value: d.alloc, Max: d.opts.MaxAlloc}
+	}
+	return nil
+}
+
+// enter is called when decoding a nested value, and checks the nesting depth. It must be paired with a call to leave.
+func (d *Decoder) enter() error {
+	d.depth++
+	if d.depth > d.opts.MaxDepth {
+		return &LimitError{Err: ErrMaxDepth, Value: d.depth, Max: d.opts.MaxDepth}
+	}
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// minEncodedSize returns the minimum number of bytes a value of type t is encoded to.
+func minEncodedSize(t reflect.Type) int {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4
+	case reflect.Int, reflect.Uint, reflect.Int64, reflect.Uint64, reflect.Float64:
+		return 8
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Interface:
+		return LengthSize
+	case reflect.Array:
+		return t.Len() * minEncodedSize(t.Elem())
+	case reflect.Struct:
+		size := 0
+		for i := range t.NumField() {
+			if field := t.Field(i); field.IsExported() {
+				size += minEncodedSize(field.Type)
+			}
+		}
+		return size
+	default:
+		return 0
+	}
+}
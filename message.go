@@ -3,6 +3,7 @@ package bisp
 import (
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"reflect"
 )
 
@@ -12,8 +13,16 @@ const (
 	TypeIDSize        = 2
 	TransactionIDSize = 16
 	LengthSize        = 2
+	ChecksumSize      = 4
+	SyncSize          = 2
+	ExtensionSize     = 1
+	StreamIDSize      = 4
+	SeqSize           = 4
 )
 
+// SyncWord precedes every frame in sync framing mode, see EncoderOpts.Sync and DecoderOpts.Sync.
+const SyncWord uint16 = 0xB15F
+
 type Version uint8
 
 const (
@@ -35,12 +44,61 @@ const (
 	FHuff Flag = 1 << 3
 	// FProcedure Flag is set if the message is a Procedure call.
 	FProcedure Flag = 1 << 4
+	// FChecksum Flag is set if the message is followed by a CRC32C trailer covering the header and body.
+	FChecksum Flag = 1 << 5
+	// FControl Flag is set if the message is a control frame, such as a heartbeat ping or pong. The type is one of the
+	// Control IDs. Control frames are handled by the Decoder and Conn, and never returned by Decode.
+	FControl Flag = 1 << 6
+	// FExtension Flag is set if the length is followed by a header extension: an Extension mask, followed by the fields
+	// of the set extensions in the order of their bits.
+	FExtension Flag = 1 << 7
+)
+
+// Extension is a mask of the fields in a header extension.
+type Extension uint8
+
+const (
+	// ExtStream adds the StreamID of the Session stream the frame belongs to.
+	ExtStream Extension = 1 << iota
+	// ExtMore is set on every frame of a chunked body but the last. It has no fields.
+	ExtMore
+	// ExtSeq adds the Seq of a message sent by a ReliableConn, or the cumulative acknowledgement of a ControlAck frame.
+	ExtSeq
+)
+
+// Control frame types.
+const (
+	ControlPing ID = iota + 1
+	ControlPong
+	// ControlStreamOpen opens a Session stream.
+	ControlStreamOpen
+	// ControlStreamData carries a chunk of the data written to a Session stream.
+	ControlStreamData
+	// ControlStreamClose closes the sending side of a Session stream.
+	ControlStreamClose
+	// ControlFragment carries a fragment of a frame too large for a PacketConn packet.
+	ControlFragment
+	// ControlAck acknowledges every message sent by a ReliableConn up to the Seq of its header.
+	ControlAck
+	// ControlGoAway tells the peer the connection is being shut down, so no new calls should be sent on it.
+	ControlGoAway
+	// ControlSubscribe subscribes the connection to the Broker topic in its body.
+	ControlSubscribe
+	// ControlUnsubscribe unsubscribes the connection from the Broker topic in its body.
+	ControlUnsubscribe
+	// ControlPublish carries a message published to a Broker topic.
+	ControlPublish
+	// ControlStreamWindow grants the peer the number of bytes in its body, a uint32, of credit to write to a Session
+	// stream.
+	ControlStreamWindow
 )
 
 const HeaderSize = VersionSize + FlagsSize + TypeIDSize + LengthSize
 
 const HeaderSizeWithTransactionID = HeaderSize + TransactionIDSize
 
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
 // MaxTcpMessageBodySize is the maximum size of a message in bytes
 // max tcp packet size is 64KB, hence the subtraction of max header size, just to be safe
 const MaxTcpMessageBodySize = 1<<16 - 1
@@ -59,6 +117,10 @@ type Header struct {
 	Type          ID
 	TransactionID TransactionID
 	Length        Length
+	// Extensions is the mask of header extension fields present, which are only encoded when it is non-zero.
+	Extensions Extension
+	StreamID   uint32
+	Seq        uint32
 }
 
 func (h *Header) IsError() bool {
@@ -100,6 +162,28 @@ func (h *Header) Len() int {
 	if h.HasFlag(F32b) {
 		l += LengthSize
 	}
+	if h.Extensions != 0 {
+		l += ExtensionSize
+	}
+	if h.HasExtension(ExtStream) {
+		l += StreamIDSize
+	}
+	if h.HasExtension(ExtSeq) {
+		l += SeqSize
+	}
+	return l
+}
+
+func (h *Header) HasExtension(e Extension) bool {
+	return h.Extensions&e == e
+}
+
+// FrameLen returns the length of the whole frame: the header, the body and the checksum trailer if FChecksum is set.
+func (h *Header) FrameLen() int {
+	l := h.Len() + int(h.Length)
+	if h.HasFlag(FChecksum) {
+		l += ChecksumSize
+	}
 	return l
 }
 
@@ -1,6 +1,7 @@
 package bisp_test
 
 import (
+	"bytes"
 	"github.com/sindrebakk1/bisp"
 	"github.com/stretchr/testify/assert"
 	"net"
@@ -438,6 +439,66 @@ func TestEncodeDecodeMessage_32bLengths(t *testing.T) {
 	testEncodeDecodeMessages(t, tcs)
 }
 
+func TestEncodeDecodeMessage_Checksum(t *testing.T) {
+	tcs := []testCase{
+		{value: bisp.Message{Header: bisp.Header{Flags: bisp.FChecksum}, Body: "Hello"}, name: "checksum"},
+		{
+			value: bisp.Message{
+				Header: bisp.Header{Flags: bisp.FChecksum | bisp.FTransaction | bisp.F32b, TransactionID: testTransactionID},
+				Body:   testStruct{1, "a", true},
+			}, name: "checksum with transaction ID and 32 bit lengths",
+		},
+	}
+	testEncodeDecodeMessages(t, tcs)
+}
+
+func TestEncodeDecodeMessage_Extension(t *testing.T) {
+	tcs := []testCase{
+		{value: bisp.Message{Header: bisp.Header{Extensions: bisp.ExtStream, StreamID: 7}, Body: "Hello"}, name: "stream"},
+		{
+			value: bisp.Message{
+				Header: bisp.Header{Flags: bisp.FChecksum | bisp.F32b, Extensions: bisp.ExtStream, StreamID: 1 << 31},
+				Body:   "Hello",
+			}, name: "stream with checksum and 32 bit lengths",
+		},
+	}
+	testEncodeDecodeMessages(t, tcs)
+}
+
+func TestDecodeMessage_ChecksumMismatch(t *testing.T) {
+	msg := bisp.Message{Header: bisp.Header{Flags: bisp.FChecksum | bisp.FTransaction, TransactionID: testTransactionID}, Body: "Hello"}
+	buf := new(bytes.Buffer)
+	err := bisp.NewEncoder(buf).Encode(&msg)
+	assert.NoError(t, err)
+	encoded := buf.Bytes()
+	assert.Len(t, encoded, msg.Header.FrameLen())
+
+	for _, i := range []int{bisp.VersionSize + bisp.FlagsSize, bisp.HeaderSizeWithTransactionID + 2, len(encoded) - 1} {
+		corrupted := bytes.Clone(encoded)
+		corrupted[i] ^= 0x01
+		var res bisp.Message
+		err = bisp.NewDecoder(bytes.NewReader(corrupted)).Decode(&res)
+		assert.ErrorIs(t, err, bisp.ErrChecksumMismatch)
+	}
+}
+
+func TestEncodeDecodeProcedure_Checksum(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := bisp.NewEncoder(buf).EncodeProcedure(pString, bisp.Call, &bisp.EncodeProcedureOpts{Checksum: true})
+	assert.NoError(t, err)
+	decoder := bisp.NewDecoder(bytes.NewReader(buf.Bytes()))
+	res, err := bisp.TDecodeProcedure[TestProcedureString](decoder)
+	assert.NoError(t, err)
+	assert.True(t, res.Header.HasFlag(bisp.FChecksum))
+	assert.Equal(t, "Hello", res.Body.String)
+
+	corrupted := buf.Bytes()
+	corrupted[len(corrupted)-bisp.ChecksumSize-1] ^= 0x01
+	decoder = bisp.NewDecoder(bytes.NewReader(corrupted))
+	_, err = bisp.TDecodeProcedure[TestProcedureString](decoder)
+	assert.ErrorIs(t, err, bisp.ErrChecksumMismatch)
+}
+
 func TestEncodeDecodeMessage_TypedDecode(t *testing.T) {
 	msg := bisp.Message{
 		Body: TestStruct{
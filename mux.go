@@ -0,0 +1,173 @@
+package bisp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+)
+
+type MuxOpts struct {
+	// Fallback is called with messages that have no handler, including procedure and error messages. Messages of
+	// unregistered types or procedures are passed with their header only and a nil Body, as their body is skipped.
+	// Messages without a handler are dropped if it isn't set.
+	Fallback func(msg *Message)
+	// Workers is the number of goroutines Serve handles messages on. Zero means messages are handled one at a time, in
+	// the order they are received, by the goroutine calling Serve.
+	Workers int
+	// OnError is called with messages whose body doesn't match the type of their handler.
+	OnError func(err error)
+}
+
+// Mux dispatches messages to handlers by the type ID of their body, for messages that aren't procedures. Handlers are
+// registered with On.
+type Mux struct {
+	opts     MuxOpts
+	mu       sync.RWMutex
+	handlers map[ID]func(msg *Message)
+}
+
+func NewMux(opts *MuxOpts) *Mux {
+	m := &Mux{
+		handlers: make(map[ID]func(msg *Message), 16),
+	}
+	if opts != nil {
+		m.opts = *opts
+	}
+	return m
+}
+
+// On registers h as the handler for messages with a body of type T, keyed by the type ID of T. T must be registered
+// with RegisterType beforehand, so its ID matches the peer's. A later handler for the same type replaces the earlier
+// one.
+func On[T any](m *Mux, h func(hdr Header, body T)) {
+	var zero T
+	if reflect.TypeFor[T]().Kind() == reflect.Interface {
+		panic("mux handler body must be a concrete type")
+	}
+	id, err := GetIDFromType(zero)
+	if err != nil {
+		panic(fmt.Sprintf("type %s must be registered before handling it", reflect.TypeFor[T]()))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[id] = func(msg *Message) {
+		body, ok := msg.Body.(T)
+		if !ok {
+			m.reportError(errors.New(fmt.Sprintf("expected body of type %s, got %s", reflect.TypeOf(zero), reflect.TypeOf(msg.Body))))
+			return
+		}
+		h(msg.Header, body)
+	}
+}
+
+// Handle dispatches msg to the handler of its body type, or to MuxOpts.Fallback.
+func (m *Mux) Handle(msg *Message) {
+	var (
+		h  func(msg *Message)
+		ok bool
+	)
+	// The type of procedure messages is a procedure ID, and the body of error messages is always a string.
+	if !msg.Header.HasFlag(FProcedure) && !msg.Header.IsError() {
+		m.mu.RLock()
+		h, ok = m.handlers[msg.Header.Type]
+		m.mu.RUnlock()
+	}
+	switch {
+	case ok:
+		h(msg)
+	case m.opts.Fallback != nil:
+		m.opts.Fallback(msg)
+	}
+}
+
+// Serve decodes messages from d and dispatches them until decoding fails. The bodies of messages of unregistered types
+// are skipped, and the messages passed to MuxOpts.Fallback. It returns nil once the stream ends or the connection is
+// closed, after every message has been handled.
+func (m *Mux) Serve(d *Decoder) error {
+	var (
+		wg   sync.WaitGroup
+		msgs chan *Message
+	)
+	if m.opts.Workers > 0 {
+		msgs = make(chan *Message, m.opts.Workers)
+		for range m.opts.Workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for msg := range msgs {
+					m.Handle(msg)
+				}
+			}()
+		}
+	}
+	defer func() {
+		if msgs != nil {
+			close(msgs)
+		}
+		wg.Wait()
+	}()
+	for {
+		msg, err := m.decode(d)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if msgs != nil {
+			msgs <- msg
+		} else {
+			m.Handle(msg)
+		}
+	}
+}
+
+// decode decodes the next message, or skips its body and returns its header if its type isn't registered, so a single
+// unknown message doesn't end the stream.
+func (m *Mux) decode(d *Decoder) (*Message, error) {
+	header, err := d.Peek()
+	for err == nil && header.HasFlag(FControl) {
+		if header, err = d.DecodeHeader(); err == nil {
+			err = d.skipControl(header)
+		}
+		if err == nil {
+			header, err = d.Peek()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !header.IsError() && !registered(header) {
+		if err = d.Skip(); err != nil {
+			return nil, err
+		}
+		return &Message{Header: *header}, nil
+	}
+	msg := new(Message)
+	if err = d.Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// registered reports whether the type or procedure of the frame of h is registered.
+func registered(h *Header) bool {
+	var err error
+	switch {
+	case h.HasFlag(FProcedure) && h.Type == BatchID:
+	case h.HasFlag(FProcedure):
+		_, err = GetProcedureFromID(h.Type)
+	default:
+		_, err = GetTypeFromID(h.Type)
+	}
+	return err == nil
+}
+
+func (m *Mux) reportError(err error) {
+	if m.opts.OnError != nil {
+		m.opts.OnError(err)
+	}
+}
@@ -0,0 +1,124 @@
+package bisp_test
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMux_Serve(t *testing.T) {
+	var (
+		structs  []testStruct
+		strings  []string
+		enums    []TestEnum
+		fallback []*bisp.Message
+	)
+	mux := bisp.NewMux(&bisp.MuxOpts{
+		Fallback: func(msg *bisp.Message) {
+			fallback = append(fallback, msg)
+		},
+	})
+	bisp.On(mux, func(hdr bisp.Header, body testStruct) {
+		structs = append(structs, body)
+	})
+	bisp.On(mux, func(hdr bisp.Header, body string) {
+		assert.False(t, hdr.IsError())
+		strings = append(strings, body)
+	})
+	bisp.On(mux, func(hdr bisp.Header, body TestEnum) {
+		enums = append(enums, body)
+	})
+
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoder(buf)
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: 1, B: "one", C: true}}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "hello"}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: TestEnum2}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: int32(7)}))
+	assert.NoError(t, enc.Encode(&bisp.Message{Header: bisp.Header{Flags: bisp.FError}, Body: "failed"}))
+	assert.NoError(t, enc.EncodeProcedure(TestProcedureAdd{A: 1, B: 2}, bisp.Notify, nil))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: 2, B: "two"}}))
+
+	assert.NoError(t, mux.Serve(bisp.NewDecoder(buf)))
+	assert.Equal(t, []testStruct{{A: 1, B: "one", C: true}, {A: 2, B: "two"}}, structs)
+	assert.Equal(t, []string{"hello"}, strings)
+	assert.Equal(t, []TestEnum{TestEnum2}, enums)
+	if assert.Len(t, fallback, 3) {
+		assert.Equal(t, int32(7), fallback[0].Body)
+		assert.True(t, fallback[1].IsError())
+		assert.True(t, fallback[2].IsProcedure())
+	}
+}
+
+func TestMux_Workers(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		seen  = make(map[int]bool)
+		count atomic.Int32
+	)
+	mux := bisp.NewMux(&bisp.MuxOpts{Workers: 4})
+	bisp.On(mux, func(hdr bisp.Header, body testStruct) {
+		mu.Lock()
+		seen[body.A] = true
+		mu.Unlock()
+		count.Add(1)
+	})
+
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoder(buf)
+	for i := range 100 {
+		assert.NoError(t, enc.Encode(&bisp.Message{Body: testStruct{A: i}}))
+	}
+	// Serve returns once every message has been handled.
+	assert.NoError(t, mux.Serve(bisp.NewDecoder(buf)))
+	assert.Equal(t, int32(100), count.Load())
+	assert.Len(t, seen, 100)
+}
+
+func TestMux_OnUnregistered(t *testing.T) {
+	type unregistered struct {
+		A int
+	}
+	mux := bisp.NewMux(nil)
+	assert.PanicsWithValue(t, "type bisp_test.unregistered must be registered before handling it", func() {
+		bisp.On(mux, func(hdr bisp.Header, body unregistered) {})
+	})
+	assert.Panics(t, func() {
+		bisp.On(mux, func(hdr bisp.Header, body any) {})
+	})
+	_, err := bisp.GetIDFromType(unregistered{})
+	assert.Error(t, err)
+}
+
+func TestMux_ServeUnregistered(t *testing.T) {
+	var (
+		fallback []*bisp.Message
+		strings  []string
+	)
+	mux := bisp.NewMux(&bisp.MuxOpts{
+		Fallback: func(msg *bisp.Message) {
+			fallback = append(fallback, msg)
+		},
+	})
+	bisp.On(mux, func(hdr bisp.Header, body string) {
+		strings = append(strings, body)
+	})
+
+	buf := new(bytes.Buffer)
+	buf.Write(encodeTestHeader(&bisp.Header{Version: bisp.V1, Type: 999, Length: 3}, false, false))
+	buf.Write([]byte{1, 2, 3})
+	enc := bisp.NewEncoder(buf)
+	assert.NoError(t, enc.EncodeControl(bisp.ControlPing))
+	assert.NoError(t, enc.Encode(&bisp.Message{Body: "after"}))
+
+	assert.NoError(t, mux.Serve(bisp.NewDecoder(buf)))
+	assert.Equal(t, []string{"after"}, strings)
+	if assert.Len(t, fallback, 1) {
+		assert.Equal(t, bisp.ID(999), fallback[0].Header.Type)
+		assert.Nil(t, fallback[0].Body)
+	}
+}
@@ -0,0 +1,350 @@
+package bisp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxPacketSize is the maximum size of a packet when PacketConnOpts.MaxPacketSize is not set. It is the minimum
+// IPv6 MTU less the IPv6 and UDP headers, so packets aren't fragmented by IP on any path.
+const DefaultMaxPacketSize = 1280 - 40 - 8
+
+// DefaultFragmentTimeout is how long the fragments of an incomplete message are kept when
+// PacketConnOpts.FragmentTimeout is not set.
+const DefaultFragmentTimeout = 5 * time.Second
+
+// DefaultMaxPendingMessages is the number of incomplete fragmented messages kept when PacketConnOpts.MaxPendingMessages
+// is not set.
+const DefaultMaxPendingMessages = 64
+
+// DefaultMaxFragmentedSize is the maximum body size of a fragmented message when DecoderOpts.MaxMessageSize is not set.
+const DefaultMaxFragmentedSize = 1 << 20
+
+// FragmentHeaderSize is the size of the index and count preceding the data of a fragment.
+const FragmentHeaderSize = 4
+
+// maxUDPPayload is the size of the buffer packets are read into, so packets larger than the maximum packet size are
+// detected rather than truncated.
+const maxUDPPayload = 1<<16 - 1
+
+type PacketConnOpts struct {
+	// MaxPacketSize is the maximum size of sent and received packets. Zero means DefaultMaxPacketSize.
+	MaxPacketSize int
+	// Fragment splits frames larger than MaxPacketSize into ControlFragment frames, reassembled by the receiver.
+	// Fragments are grouped by the TransactionID of the message, which is set to a random one if it is empty.
+	Fragment bool
+	// FragmentTimeout is how long the fragments of an incomplete message are kept. Zero means DefaultFragmentTimeout.
+	FragmentTimeout time.Duration
+	// MaxPendingMessages is the number of incomplete messages kept, the oldest is dropped beyond it. Zero means
+	// DefaultMaxPendingMessages.
+	MaxPendingMessages int
+	// OnError is called with a *PacketError for every packet dropped because it is malformed, too large or the rest of
+	// its message timed out.
+	OnError func(err error)
+	// Encoder holds the options of the encoder of packets. Sync framing and chunking are not used, as every packet holds
+	// a frame.
+	Encoder EncoderOpts
+	// Decoder holds the options of the decoder of packets. Sync framing is not used, as every packet holds a frame.
+	// Fragmented messages with a body larger than MaxMessageSize, or DefaultMaxFragmentedSize, are dropped from their
+	// first fragment.
+	Decoder DecoderOpts
+}
+
+// PacketError is reported to PacketConnOpts.OnError for dropped packets.
+type PacketError struct {
+	Addr net.Addr
+	Err  error
+}
+
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("packet from %s dropped: %s", e.Addr, e.Err)
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+// PacketConn sends and receives messages over a net.PacketConn, with a single frame per packet. Malformed packets are
+// dropped without affecting the packets after them. Sends are serialized, so a PacketConn is safe for concurrent use,
+// while ReceiveFrom is meant to be called from a single read loop.
+type PacketConn struct {
+	conn net.PacketConn
+	opts PacketConnOpts
+	wmu  sync.Mutex
+	wbuf bytes.Buffer
+	enc  *Encoder
+	rmu  sync.Mutex
+	rbuf []byte
+	// pending holds the fragments of incomplete messages.
+	pending map[fragmentKey]*fragments
+}
+
+type fragmentKey struct {
+	addr string
+	tID  TransactionID
+}
+
+type fragments struct {
+	addr     net.Addr
+	parts    [][]byte
+	received int
+	deadline time.Time
+}
+
+func NewPacketConn(conn net.PacketConn, opts *PacketConnOpts) *PacketConn {
+	c := &PacketConn{
+		conn:    conn,
+		rbuf:    make([]byte, maxUDPPayload),
+		pending: make(map[fragmentKey]*fragments, 16),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.MaxPacketSize <= 0 {
+		c.opts.MaxPacketSize = DefaultMaxPacketSize
+	}
+	if c.opts.FragmentTimeout <= 0 {
+		c.opts.FragmentTimeout = DefaultFragmentTimeout
+	}
+	if c.opts.MaxPendingMessages <= 0 {
+		c.opts.MaxPendingMessages = DefaultMaxPendingMessages
+	}
+	c.opts.Encoder.Sync = false
+	c.opts.Encoder.ChunkSize = 0
+	c.opts.Decoder.Sync = false
+	c.enc = NewEncoderWithOpts(&c.wbuf, &c.opts.Encoder)
+	return c
+}
+
+// SendTo encodes msg and writes it to addr in a single packet, or in fragments if it is larger than
+// PacketConnOpts.MaxPacketSize and PacketConnOpts.Fragment is set. msg is not modified.
+func (c *PacketConn) SendTo(msg *Message, addr net.Addr) error {
+	// The message is copied, as fragmenting sets its transaction ID.
+	m := *msg
+	msg = &m
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf.Reset()
+	if err := c.enc.Encode(msg); err != nil {
+		return err
+	}
+	if c.wbuf.Len() <= c.opts.MaxPacketSize {
+		_, err := c.conn.WriteTo(c.wbuf.Bytes(), addr)
+		return err
+	}
+	if !c.opts.Fragment {
+		return &LimitError{Err: ErrPacketTooLarge, Value: c.wbuf.Len(), Max: c.opts.MaxPacketSize}
+	}
+	if !msg.Header.HasTransactionID() {
+		tID, err := newTransactionID()
+		if err != nil {
+			return err
+		}
+		msg.Header.TransactionID = tID
+		c.wbuf.Reset()
+		if err = c.enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return c.sendFragments(bytes.Clone(c.wbuf.Bytes()), msg.Header.TransactionID, addr)
+}
+
+// sendFragments writes frame in ControlFragment frames, each holding the index of the fragment, the number of
+// fragments and a part of the frame.
+func (c *PacketConn) sendFragments(frame []byte, tID TransactionID, addr net.Addr) error {
+	header := Header{Flags: FControl, TransactionID: tID}
+	size := c.opts.MaxPacketSize - header.Len() - FragmentHeaderSize
+	if size <= 0 {
+		return errors.New(fmt.Sprintf("max packet size %d too small for fragments", c.opts.MaxPacketSize))
+	}
+	count := (len(frame) + size - 1) / size
+	if count > 1<<16-1 {
+		return &LimitError{Err: ErrPacketTooLarge, Value: len(frame), Max: (1<<16 - 1) * size}
+	}
+	body := make([]byte, 0, FragmentHeaderSize+size)
+	for i := range count {
+		part := frame[i*size : min(len(frame), (i+1)*size)]
+		body = binary.BigEndian.AppendUint16(body[:0], uint16(i))
+		body = binary.BigEndian.AppendUint16(body, uint16(count))
+		body = append(body, part...)
+		c.wbuf.Reset()
+		h := header
+		if err := c.enc.encodeFrame(&h, ControlFragment, body); err != nil {
+			return err
+		}
+		if _, err := c.conn.WriteTo(c.wbuf.Bytes(), addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReceiveFrom reads packets until a message is complete, and returns it with the address it was sent from. Packets that
+// can't be decoded are dropped and reported to PacketConnOpts.OnError.
+func (c *PacketConn) ReceiveFrom() (*Message, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		n, addr, err := c.conn.ReadFrom(c.rbuf)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.expire(time.Now())
+		if n > c.opts.MaxPacketSize {
+			c.drop(addr, &LimitError{Err: ErrPacketTooLarge, Value: n, Max: c.opts.MaxPacketSize})
+			continue
+		}
+		frame := c.rbuf[:n]
+		if isFragment(frame) {
+			if frame, err = c.addFragment(frame, addr); err != nil {
+				c.drop(addr, err)
+				continue
+			}
+			if frame == nil {
+				continue
+			}
+		}
+		var msg *Message
+		if msg, err = c.decode(frame); err != nil {
+			c.drop(addr, err)
+			continue
+		}
+		return msg, addr, nil
+	}
+}
+
+// decode decodes a frame holding a single message, which must be the whole frame.
+func (c *PacketConn) decode(frame []byte) (*Message, error) {
+	r := bytes.NewReader(frame)
+	var msg Message
+	if err := NewDecoderWithOpts(r, &c.opts.Decoder).Decode(&msg); err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, errors.New(fmt.Sprintf("%d bytes after frame", r.Len()))
+	}
+	return &msg, nil
+}
+
+// isFragment reports whether frame is a ControlFragment frame, without decoding it.
+func isFragment(frame []byte) bool {
+	return len(frame) >= HeaderSize && Flag(frame[VersionSize])&FControl == FControl &&
+		ID(binary.BigEndian.Uint16(frame[VersionSize+FlagsSize:])) == ControlFragment
+}
+
+// addFragment adds a fragment to the message it belongs to, and returns the reassembled frame once all of its
+// fragments are received.
+func (c *PacketConn) addFragment(frame []byte, addr net.Addr) ([]byte, error) {
+	d := NewDecoderWithOpts(bytes.NewReader(frame), &c.opts.Decoder)
+	header, err := d.DecodeHeader()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.readBody(uint32(header.Length), "fragment"); err != nil {
+		return nil, err
+	}
+	body := d.buf.Bytes()
+	if len(body) < FragmentHeaderSize {
+		return nil, errors.New("unexpected end of fragment")
+	}
+	index := int(binary.BigEndian.Uint16(body))
+	count := int(binary.BigEndian.Uint16(body[2:]))
+	if count == 0 || index >= count {
+		return nil, errors.New(fmt.Sprintf("invalid fragment %d of %d", index, count))
+	}
+	if maxCount := c.maxFragments(); count > maxCount {
+		return nil, &LimitError{Err: ErrMessageTooLarge, Value: count, Max: maxCount}
+	}
+	key := fragmentKey{addr: addr.String(), tID: header.TransactionID}
+	f, ok := c.pending[key]
+	if !ok {
+		if len(c.pending) >= c.opts.MaxPendingMessages {
+			c.evictOldest()
+		}
+		f = &fragments{addr: addr, parts: make([][]byte, count), deadline: time.Now().Add(c.opts.FragmentTimeout)}
+		c.pending[key] = f
+	}
+	if len(f.parts) != count {
+		delete(c.pending, key)
+		return nil, errors.New(fmt.Sprintf("fragment count %d doesn't match %d", count, len(f.parts)))
+	}
+	if f.parts[index] != nil {
+		return nil, nil
+	}
+	f.parts[index] = bytes.Clone(body[FragmentHeaderSize:])
+	f.received++
+	if f.received < count {
+		return nil, nil
+	}
+	delete(c.pending, key)
+	return bytes.Join(f.parts, nil), nil
+}
+
+// maxFragments returns the number of fragments of the largest message accepted, with a body of
+// DecoderOpts.MaxMessageSize or DefaultMaxFragmentedSize bytes, so the fragments of larger messages aren't allocated.
+// A packet of slack covers the header and trailer of the reassembled frame.
+func (c *PacketConn) maxFragments() int {
+	maxSize := DefaultMaxFragmentedSize
+	if c.opts.Decoder.MaxMessageSize > 0 {
+		maxSize = int(c.opts.Decoder.MaxMessageSize)
+	}
+	size := max(c.opts.MaxPacketSize-HeaderSizeWithTransactionID-FragmentHeaderSize, 1)
+	return (maxSize + c.opts.MaxPacketSize + size - 1) / size
+}
+
+// expire drops the fragments of messages that weren't completed in time.
+func (c *PacketConn) expire(now time.Time) {
+	for key, f := range c.pending {
+		if now.After(f.deadline) {
+			delete(c.pending, key)
+			c.drop(f.addr, errors.New(fmt.Sprintf("fragmented message timed out with %d of %d fragments", f.received, len(f.parts))))
+		}
+	}
+}
+
+func (c *PacketConn) evictOldest() {
+	var (
+		oldest fragmentKey
+		f      *fragments
+	)
+	for key, p := range c.pending {
+		if f == nil || p.deadline.Before(f.deadline) {
+			oldest, f = key, p
+		}
+	}
+	if f != nil {
+		delete(c.pending, oldest)
+		c.drop(f.addr, errors.New("too many incomplete fragmented messages"))
+	}
+}
+
+func (c *PacketConn) drop(addr net.Addr, err error) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(&PacketError{Addr: addr, Err: err})
+	}
+}
+
+func (c *PacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
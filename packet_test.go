@@ -0,0 +1,121 @@
+package bisp_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPacketConns(t *testing.T, opts *bisp.PacketConnOpts) (*bisp.PacketConn, *bisp.PacketConn) {
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	sender := bisp.NewPacketConn(a, opts)
+	receiver := bisp.NewPacketConn(b, opts)
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	assert.NoError(t, receiver.SetReadDeadline(time.Now().Add(5*time.Second)))
+	return sender, receiver
+}
+
+func TestPacketConn_SendReceive(t *testing.T) {
+	sender, receiver := newTestPacketConns(t, nil)
+
+	assert.NoError(t, sender.SendTo(&bisp.Message{Body: testStruct{A: 1, B: "packet", C: true}}, receiver.LocalAddr()))
+	msg, addr, err := receiver.ReceiveFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, testStruct{A: 1, B: "packet", C: true}, msg.Body)
+	assert.Equal(t, sender.LocalAddr().String(), addr.String())
+
+	err = sender.SendTo(&bisp.Message{Body: strings.Repeat("a", bisp.DefaultMaxPacketSize)}, receiver.LocalAddr())
+	assert.ErrorIs(t, err, bisp.ErrPacketTooLarge)
+}
+
+func TestPacketConn_Fragment(t *testing.T) {
+	sender, receiver := newTestPacketConns(t, &bisp.PacketConnOpts{Fragment: true, MaxPacketSize: 512})
+
+	large := strings.Repeat("abcdefgh", 1000)
+	msg := bisp.Message{Header: bisp.Header{Flags: bisp.FChecksum}, Body: large}
+	assert.NoError(t, sender.SendTo(&msg, receiver.LocalAddr()))
+	assert.False(t, msg.Header.HasTransactionID())
+	assert.NoError(t, sender.SendTo(&bisp.Message{Body: "small"}, receiver.LocalAddr()))
+
+	res, _, err := receiver.ReceiveFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, large, res.Body)
+	assert.True(t, res.Header.HasTransactionID())
+	res, _, err = receiver.ReceiveFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "small", res.Body)
+}
+
+func TestPacketConn_FragmentLimit(t *testing.T) {
+	errs := make(chan error, 16)
+	sender, receiver := newTestPacketConns(t, &bisp.PacketConnOpts{
+		Fragment: true,
+		Decoder:  bisp.DecoderOpts{MaxMessageSize: 4096},
+		OnError: func(err error) {
+			errs <- err
+		},
+	})
+
+	// The first fragment of a message claiming the most fragments is dropped before they are allocated.
+	fragment := []byte{byte(bisp.CurrentVersion), byte(bisp.FControl | bisp.FTransaction), 0, byte(bisp.ControlFragment)}
+	fragment = append(fragment, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16)
+	fragment = append(fragment, 0, 5, 0, 0, 0xff, 0xff, 'a')
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer raw.Close()
+	_, err = raw.WriteTo(fragment, receiver.LocalAddr())
+	assert.NoError(t, err)
+
+	assert.NoError(t, sender.SendTo(&bisp.Message{Body: strings.Repeat("a", 4000)}, receiver.LocalAddr()))
+	msg, _, err := receiver.ReceiveFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 4000), msg.Body)
+	assert.ErrorIs(t, <-errs, bisp.ErrMessageTooLarge)
+
+	assert.NoError(t, sender.SendTo(&bisp.Message{Body: strings.Repeat("a", 8000)}, receiver.LocalAddr()))
+	assert.NoError(t, receiver.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err = receiver.ReceiveFrom()
+	assert.Error(t, err)
+	assert.ErrorIs(t, <-errs, bisp.ErrMessageTooLarge)
+}
+
+func TestPacketConn_Malformed(t *testing.T) {
+	errs := make(chan error, 4)
+	sender, receiver := newTestPacketConns(t, &bisp.PacketConnOpts{
+		OnError: func(err error) {
+			errs <- err
+		},
+	})
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer raw.Close()
+
+	// A truncated frame, a frame with trailing bytes, and a packet larger than the maximum packet size are dropped.
+	_, err = raw.WriteTo([]byte{byte(bisp.CurrentVersion), 0, 0, 0, 0, 10, 'a'}, receiver.LocalAddr())
+	assert.NoError(t, err)
+	_, err = raw.WriteTo([]byte{byte(bisp.CurrentVersion), 0, 0, 0, 0, 0, 'a'}, receiver.LocalAddr())
+	assert.NoError(t, err)
+	_, err = raw.WriteTo(make([]byte, bisp.DefaultMaxPacketSize+1), receiver.LocalAddr())
+	assert.NoError(t, err)
+	assert.NoError(t, sender.SendTo(&bisp.Message{Body: "Hello"}, receiver.LocalAddr()))
+
+	msg, _, err := receiver.ReceiveFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", msg.Body)
+	assert.Len(t, errs, 3)
+	var packetErr *bisp.PacketError
+	assert.ErrorAs(t, <-errs, &packetErr)
+	assert.Equal(t, raw.LocalAddr().String(), packetErr.Addr.String())
+	<-errs
+	assert.ErrorIs(t, <-errs, bisp.ErrPacketTooLarge)
+}
@@ -0,0 +1,254 @@
+package bisp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultPoolSize is the maximum number of connections of a Pool when PoolOpts.Size is not set.
+const DefaultPoolSize = 4
+
+// DefaultHealthCheckInterval is the interval between the health checks of a Pool when PoolOpts.HealthCheckInterval is
+// not set.
+const DefaultHealthCheckInterval = 30 * time.Second
+
+var ErrPoolClosed = errors.New("pool closed")
+
+type PoolOpts struct {
+	// Size is the maximum number of connections. A connection is dialed when every open connection has calls in flight,
+	// until Size is reached. Zero means DefaultPoolSize.
+	Size int
+	// MaxIdleTime is how long a connection can go without calls in flight before it is closed. Zero means connections
+	// are kept while idle.
+	MaxIdleTime time.Duration
+	// MaxLifetime is how long a connection is used for new calls. It is closed once the calls in flight on it are done,
+	// as are connections the server sent ControlGoAway on. Zero means connections are reused forever.
+	MaxLifetime time.Duration
+	// HealthCheckInterval is the interval between the pings sent on every connection. MaxIdleTime and MaxLifetime are
+	// checked at the same interval. Zero means DefaultHealthCheckInterval.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout is how long a connection can go without receiving anything, pongs included, before it is closed.
+	// Zero means three times HealthCheckInterval.
+	HealthCheckTimeout time.Duration
+	// ClientOpts are the options of the Client of each connection.
+	ClientOpts *ClientOpts
+}
+
+// Pool calls procedures over up to PoolOpts.Size connections to the same peer. Each call is sent over the connection
+// with the fewest calls in flight. Procedures are called with CallProcedure or CallFunc, as with a Client.
+type Pool struct {
+	dial Dialer
+	opts PoolOpts
+
+	mu      sync.Mutex
+	conns   []*pooledClient
+	dialing int
+	closed  bool
+	done    chan struct{}
+}
+
+type pooledClient struct {
+	client   *Client
+	inFlight int
+	created  time.Time
+	lastUsed time.Time
+	// retired is set once the connection has reached PoolOpts.MaxLifetime, or the server sent ControlGoAway.
+	retired bool
+}
+
+// NewPool returns a Pool calling procedures over connections opened by dial. Connections are dialed on demand.
+func NewPool(dial Dialer, opts *PoolOpts) *Pool {
+	p := &Pool{
+		dial: dial,
+		done: make(chan struct{}),
+	}
+	if opts != nil {
+		p.opts = *opts
+	}
+	if p.opts.Size <= 0 {
+		p.opts.Size = DefaultPoolSize
+	}
+	if p.opts.HealthCheckInterval <= 0 {
+		p.opts.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if p.opts.HealthCheckTimeout <= 0 {
+		p.opts.HealthCheckTimeout = 3 * p.opts.HealthCheckInterval
+	}
+	go p.maintain()
+	return p
+}
+
+// CallFunc calls the function procedure name, registered with RegisterFunc, and returns its results.
+func (p *Pool) CallFunc(ctx context.Context, name string, args ...any) ([]any, error) {
+	proc, err := NewFuncCall(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	var res any
+	if res, err = p.call(ctx, proc); err != nil {
+		return nil, err
+	}
+	return FuncResults(res)
+}
+
+func (p *Pool) call(ctx context.Context, proc any) (any, error) {
+	pc, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(pc)
+	return pc.client.call(ctx, proc)
+}
+
+// Len returns the number of open connections.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// Close closes every connection. Calls in flight fail with ErrClientClosed, and later calls with ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	close(p.done)
+	p.mu.Unlock()
+	var errs []error
+	for _, pc := range conns {
+		if err := pc.client.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// get returns the connection with the fewest calls in flight, dialing a new one if they all have calls in flight and
+// the pool isn't full.
+func (p *Pool) get(ctx context.Context) (*pooledClient, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	p.removeClosed()
+	var best *pooledClient
+	for _, pc := range p.conns {
+		if pc.client.conn.GoingAway() {
+			pc.retired = true
+		}
+		if !pc.retired && (best == nil || pc.inFlight < best.inFlight) {
+			best = pc
+		}
+	}
+	if best != nil && (best.inFlight == 0 || len(p.conns)+p.dialing >= p.opts.Size) {
+		best.inFlight++
+		p.mu.Unlock()
+		return best, nil
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	pc, err := p.connect(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if err != nil {
+		// Fall back to a busy connection rather than failing the call.
+		if best != nil && best.client.closeErr() == nil {
+			best.inFlight++
+			return best, nil
+		}
+		return nil, err
+	}
+	if p.closed {
+		_ = pc.client.Close()
+		return nil, ErrPoolClosed
+	}
+	pc.inFlight++
+	p.conns = append(p.conns, pc)
+	return pc, nil
+}
+
+func (p *Pool) put(pc *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.inFlight--
+	pc.lastUsed = time.Now()
+	if pc.retired && pc.inFlight == 0 {
+		p.remove(pc)
+	}
+}
+
+func (p *Pool) connect(ctx context.Context) (*pooledClient, error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &pooledClient{client: NewClient(conn, p.opts.ClientOpts), created: now, lastUsed: now}, nil
+}
+
+// maintain pings every connection, and closes connections that failed their health check, have been idle for longer
+// than PoolOpts.MaxIdleTime, or have reached PoolOpts.MaxLifetime.
+func (p *Pool) maintain() {
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			p.removeClosed()
+			for _, pc := range append([]*pooledClient(nil), p.conns...) {
+				switch {
+				case now.Sub(time.Unix(0, pc.client.conn.seen.Load())) > p.opts.HealthCheckTimeout:
+					pc.client.conn.closeWith(ErrPeerTimeout)
+					p.remove(pc)
+				case pc.client.conn.GoingAway() || p.opts.MaxLifetime > 0 && now.Sub(pc.created) > p.opts.MaxLifetime:
+					pc.retired = true
+					if pc.inFlight == 0 {
+						p.remove(pc)
+					}
+				case p.opts.MaxIdleTime > 0 && pc.inFlight == 0 && now.Sub(pc.lastUsed) > p.opts.MaxIdleTime:
+					p.remove(pc)
+				default:
+					// Ping from another goroutine, so a peer that stopped reading doesn't block the pool.
+					go func() {
+						_ = pc.client.conn.Ping()
+					}()
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// removeClosed removes the connections whose client has stopped. p.mu must be held.
+func (p *Pool) removeClosed() {
+	for i := 0; i < len(p.conns); i++ {
+		if p.conns[i].client.closeErr() != nil {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			i--
+		}
+	}
+}
+
+// remove closes the connection of pc and removes it from the pool. p.mu must be held.
+func (p *Pool) remove(pc *pooledClient) {
+	for i, c := range p.conns {
+		if c == pc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			break
+		}
+	}
+	_ = pc.client.Close()
+}
@@ -0,0 +1,130 @@
+package bisp_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+type TestProcedureWait struct {
+	bisp.Procedure[string]
+	Name string
+}
+
+// newTestPoolServer serves TestProcedureAdd, and TestProcedureWait, which responds once release is closed.
+func newTestPoolServer(t *testing.T, release chan struct{}) (*dropListener, *atomic.Int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	dl := &dropListener{Listener: l}
+	srv := bisp.NewServer(nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureAdd) error {
+		p.Out = p.A + p.B
+		return nil
+	})
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureWait) error {
+		<-release
+		p.Out = p.Name
+		return nil
+	})
+	go func() {
+		_ = srv.Serve(dl)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		dl.drop()
+	})
+	var dials atomic.Int32
+	return dl, &dials
+}
+
+func TestPool_LeastInFlight(t *testing.T) {
+	release := make(chan struct{})
+	l, dials := newTestPoolServer(t, release)
+	pool := bisp.NewPool(tcpDialer(l.Addr().String(), dials), &bisp.PoolOpts{Size: 2})
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Sequential calls reuse the same idle connection.
+	for range 3 {
+		res, err := bisp.CallProcedure(ctx, pool, TestProcedureAdd{A: 1, B: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, res.Out)
+	}
+	assert.Equal(t, int32(1), dials.Load())
+
+	// Waiting calls fill the pool, and the calls after them share the connections.
+	results := make(chan string, 4)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		go func() {
+			res, err := bisp.CallProcedure(ctx, pool, TestProcedureWait{Name: name})
+			assert.NoError(t, err)
+			results <- res.Out
+		}()
+	}
+	assert.Eventually(t, func() bool { return pool.Len() == 2 }, time.Second, time.Millisecond)
+	close(release)
+	for range 4 {
+		<-results
+	}
+	assert.Equal(t, int32(2), dials.Load())
+}
+
+func TestPool_MaxLifetime(t *testing.T) {
+	l, dials := newTestPoolServer(t, nil)
+	pool := bisp.NewPool(tcpDialer(l.Addr().String(), dials), &bisp.PoolOpts{
+		MaxLifetime:         20 * time.Millisecond,
+		HealthCheckInterval: 5 * time.Millisecond,
+	})
+	defer pool.Close()
+
+	_, err := bisp.CallProcedure(context.Background(), pool, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return pool.Len() == 0 }, time.Second, time.Millisecond)
+	_, err = bisp.CallProcedure(context.Background(), pool, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), dials.Load())
+}
+
+func TestPool_MaxIdleTime(t *testing.T) {
+	l, dials := newTestPoolServer(t, nil)
+	pool := bisp.NewPool(tcpDialer(l.Addr().String(), dials), &bisp.PoolOpts{
+		MaxIdleTime:         20 * time.Millisecond,
+		HealthCheckInterval: 5 * time.Millisecond,
+	})
+	defer pool.Close()
+
+	_, err := bisp.CallProcedure(context.Background(), pool, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pool.Len())
+	assert.Eventually(t, func() bool { return pool.Len() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestPool_HealthCheck(t *testing.T) {
+	pool := bisp.NewPool(func(ctx context.Context) (net.Conn, error) {
+		conn, peer := net.Pipe()
+		// The peer reads everything, but never responds to pings.
+		go func() {
+			_, _ = io.Copy(io.Discard, peer)
+		}()
+		return conn, nil
+	}, &bisp.PoolOpts{HealthCheckInterval: 5 * time.Millisecond})
+	defer pool.Close()
+
+	// The call fails once the connection is closed for failing its health check.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := bisp.CallProcedure(ctx, pool, TestProcedureAdd{A: 1, B: 2})
+	assert.ErrorIs(t, err, bisp.ErrPeerTimeout)
+	assert.Eventually(t, func() bool { return pool.Len() == 0 }, time.Second, time.Millisecond)
+
+	assert.NoError(t, pool.Close())
+	_, err = bisp.CallProcedure(context.Background(), pool, TestProcedureAdd{A: 1, B: 2})
+	assert.ErrorIs(t, err, bisp.ErrPoolClosed)
+}
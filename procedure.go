@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 )
 
 type PKind uint8
@@ -12,13 +14,21 @@ const (
 	Unknown PKind = iota
 	Call
 	Response
+	// Notify is a one-way Call, the receiver dispatches it without replying.
+	Notify
 )
 
 func (p PKind) String() string {
-	return []string{"Unknown", "Call", "Response"}[p]
+	if p > Notify {
+		return fmt.Sprintf("PKind(%d)", p)
+	}
+	return []string{"Unknown", "Call", "Response", "Notify"}[p]
 }
 
 var (
+	// pmu guards the procedure registries and nextPID, as procedures can be registered while connections are in use,
+	// e.g. by SyncProcedures on every reconnect.
+	pmu              sync.RWMutex
 	pNameRegistry       = make(map[string]ID, 16)
 	pTypeRegistry       = make(map[reflect.Type]ID, 16)
 	pReverseRegistry    = make(map[ID]reflect.Type, 16)
@@ -30,6 +40,11 @@ type Procedure[T any] struct {
 	Out  T
 }
 
+// Notification is embedded in place of Procedure for procedures that never produce a Response.
+type Notification struct {
+	Kind PKind
+}
+
 func RegisterProcedure[P any]() ID {
 	var p P
 	t := reflect.TypeOf(p)
@@ -37,45 +52,166 @@ func RegisterProcedure[P any]() ID {
 		panic("procedure must be a struct")
 	}
 	name := t.Name()
-	if _, ok := pNameRegistry[name]; ok {
-		return pNameRegistry[name]
+	if id, _, ok := lookupProcedure(name); ok {
+		return id
 	}
-	if _, ok := t.FieldByName("Procedure"); !ok {
-		panic("procedure must have an embedded Procedure")
+	embed := procedureEmbed(t)
+	if embed < 0 {
+		panic("procedure must have an embedded Procedure or Notification")
 	}
-	outField, ok := t.FieldByName("Out")
-	if !ok {
-		panic("procedure must have an Out field")
+	if t.Field(embed).Type != tNotification {
+		outField, ok := procedureField(t, "Out")
+		if !ok {
+			panic("procedure must have an Out field")
+		}
+		kind := outField.Type.Kind()
+		if kind == reflect.Interface || kind == reflect.Ptr || kind == reflect.Invalid {
+			panic("procedure Out field must be a concrete type and not invalid")
+		}
 	}
-	kind := outField.Type.Kind()
-	if kind == reflect.Interface || kind == reflect.Ptr || kind == reflect.Invalid {
-		panic("procedure Out field must be a concrete type and not invalid")
+	pmu.Lock()
+	defer pmu.Unlock()
+	if id, ok := pNameRegistry[name]; ok {
+		return id
 	}
-	if _, ok = pNameRegistry[name]; !ok {
-		registerParamTypes(t)
+	registerParamTypes(t)
+	id := allocPID()
+	registerProcedureType(name, t, id)
+	return id
+}
 
-		pNameRegistry[name] = nextPID
-		pTypeRegistry[t] = nextPID
-		pReverseRegistry[nextPID] = t
+// lookupProcedure returns the ID and type of the procedure registered as name.
+func lookupProcedure(name string) (ID, reflect.Type, bool) {
+	pmu.RLock()
+	defer pmu.RUnlock()
+	id, ok := pNameRegistry[name]
+	return id, pReverseRegistry[id], ok
+}
 
-		nextPID++
+// allocPID returns the next free procedure ID, and must be called with pmu held. It panics rather than handing out the
+// IDs reserved for introspection, from DescribeProcedureID up.
+func allocPID() ID {
+	if nextPID >= DescribeProcedureID {
+		panic(fmt.Sprintf("procedure IDs exhausted, IDs from %d up are reserved", DescribeProcedureID))
 	}
+	id := nextPID
+	nextPID++
+	return id
+}
 
-	return pNameRegistry[name]
+// registerProcedureType registers t as procedure id, and must be called with pmu held, except from init.
+func registerProcedureType(name string, t reflect.Type, id ID) {
+	pNameRegistry[name] = id
+	pTypeRegistry[t] = id
+	pReverseRegistry[id] = t
 }
 
 func registerParamTypes(t reflect.Type) {
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
-		if field.Name == "Procedure" || field.Name == "TransactionID" {
+		if isProcedureField(t, i) || field.Name == "TransactionID" {
 			continue
 		}
 		RegisterType(reflect.New(field.Type).Elem().Interface())
 	}
 }
 
+// procedureEmbed returns the index of the embedded Procedure or Notification of t, or -1 if it has none.
+func procedureEmbed(t reflect.Type) int {
+	if t.Kind() != reflect.Struct {
+		return -1
+	}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.Anonymous {
+			continue
+		}
+		// Instances of Procedure are named after their type argument, as in Procedure[int].
+		if field.Type == tNotification ||
+			field.Type.PkgPath() == tNotification.PkgPath() && strings.HasPrefix(field.Type.Name(), "Procedure[") {
+			return i
+		}
+	}
+	return -1
+}
+
+// isProcedureField reports whether field i of procedure type t is the embedded Procedure or Notification, or the Kind
+// and Out fields of a function procedure, rather than a parameter. Fields are matched by type and position, so
+// parameters can be named Kind or Out.
+func isProcedureField(t reflect.Type, i int) bool {
+	if isFunc(t) {
+		return i < 2
+	}
+	return i == procedureEmbed(t)
+}
+
+// procedureField returns the Kind or Out field of procedure type t, the one of its embedded Procedure or Notification
+// rather than a parameter of the same name.
+func procedureField(t reflect.Type, name string) (reflect.StructField, bool) {
+	if isFunc(t) {
+		switch name {
+		case "Kind":
+			return t.Field(0), true
+		case "Out":
+			return t.Field(1), true
+		}
+		return reflect.StructField{}, false
+	}
+	embed := procedureEmbed(t)
+	if embed < 0 {
+		return reflect.StructField{}, false
+	}
+	field, ok := t.Field(embed).Type.FieldByName(name)
+	if !ok {
+		return reflect.StructField{}, false
+	}
+	field.Index = append([]int{embed}, field.Index...)
+	return field, true
+}
+
+// procedureValue returns the Kind or Out field of procedure value v, or the zero Value if it has none.
+func procedureValue(v reflect.Value, name string) reflect.Value {
+	field, ok := procedureField(v.Type(), name)
+	if !ok {
+		return reflect.Value{}
+	}
+	return v.FieldByIndex(field.Index)
+}
+
+// isNotification reports whether the procedure type embeds Notification and thus has no Out field.
+func isNotification(t reflect.Type) bool {
+	embed := procedureEmbed(t)
+	return embed >= 0 && t.Field(embed).Type == tNotification
+}
+
+// procedureName returns the name a procedure type is registered with.
+func procedureName(t reflect.Type) string {
+	if isFunc(t) {
+		return t.Field(0).Tag.Get("bisp")
+	}
+	return t.Name()
+}
+
+// procedureKind returns the Kind of a decoded procedure value.
+func procedureKind(p any) PKind {
+	v := reflect.ValueOf(p)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return Unknown
+	}
+	kind := procedureValue(v, "Kind")
+	if !kind.IsValid() {
+		return Unknown
+	}
+	return PKind(kind.Uint())
+}
+
 func GetProcedureID(p any) (ID, error) {
+	pmu.RLock()
 	ID, ok := pTypeRegistry[reflect.TypeOf(p)]
+	pmu.RUnlock()
 	if !ok {
 		return 0, errors.New(fmt.Sprintf("procedure not registered: %s", reflect.TypeOf(p)))
 	}
@@ -83,7 +219,9 @@ func GetProcedureID(p any) (ID, error) {
 }
 
 func GetProcedureFromID(id ID) (reflect.Type, error) {
+	pmu.RLock()
 	typ, exists := pReverseRegistry[id]
+	pmu.RUnlock()
 	if !exists {
 		return nil, errors.New(fmt.Sprintf("procedure with id %d not registered", id))
 	}
@@ -42,6 +42,16 @@ type TestProcedureEnum struct {
 	bisp.Procedure[TestEnum]
 	Enum TestEnum
 }
+type TestProcedureShadowed struct {
+	bisp.Procedure[int]
+	Kind string
+	Out  string
+}
+type TestNotification struct {
+	bisp.Notification
+	String string
+	Int    int
+}
 type TestProcedureMultipleParams struct {
 	bisp.Procedure[string]
 	Int    int
@@ -110,9 +120,26 @@ var (
 		Map:    map[string]int{"a": 1},
 		Enum:   TestEnum2,
 	}
+	pShadowed = TestProcedureShadowed{
+		Procedure: bisp.Procedure[int]{
+			Out: 42,
+		},
+		Kind: "kind",
+		Out:  "out",
+	}
+	pNotification = TestNotification{
+		String: "Hello",
+		Int:    42,
+	}
 	testTransactionID = bisp.TransactionID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 )
 
+func TestPKind_String(t *testing.T) {
+	assert.Equal(t, "Call", bisp.Call.String())
+	assert.Equal(t, "Notify", bisp.Notify.String())
+	assert.Equal(t, "PKind(200)", bisp.PKind(200).String())
+}
+
 func TestEncodeProcedure_Call(t *testing.T) {
 	tcs := []testCase{
 		{name: "string", value: pString},
@@ -123,6 +150,7 @@ func TestEncodeProcedure_Call(t *testing.T) {
 		{name: "map", value: pMap},
 		{name: "enum", value: pEnum},
 		{name: "multiple", value: pMultipleParams},
+		{name: "shadowed", value: pShadowed},
 	}
 
 	testEncodeProcedures(t, tcs, bisp.Call)
@@ -138,6 +166,7 @@ func TestEncodeProcedure_Response(t *testing.T) {
 		{name: "map", value: pMap},
 		{name: "enum", value: pEnum},
 		{name: "multiple", value: pMultipleParams},
+		{name: "shadowed", value: pShadowed},
 	}
 
 	testEncodeProcedures(t, tcs, bisp.Response)
@@ -177,6 +206,23 @@ func TestEncodeProcedure_TransactionID(t *testing.T) {
 	})
 }
 
+func TestEncodeProcedure_Notify(t *testing.T) {
+	tcs := []testCase{
+		{name: "string", value: pString},
+		{name: "multiple", value: pMultipleParams},
+		{name: "notification", value: pNotification},
+	}
+
+	testEncodeProcedures(t, tcs, bisp.Notify)
+}
+
+func TestEncodeProcedure_NotificationResponse(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := bisp.NewEncoder(buf)
+	err := enc.EncodeProcedure(pNotification, bisp.Response, nil)
+	assert.Error(t, err)
+}
+
 func TestDecodeProcedure_Call(t *testing.T) {
 	tcs := []testCase{
 		{name: "string", value: pString, expected: TestProcedureString{Procedure: bisp.Procedure[string]{Kind: bisp.Call}, String: "Hello"}},
@@ -187,6 +233,7 @@ func TestDecodeProcedure_Call(t *testing.T) {
 		{name: "map", value: pMap, expected: TestProcedureMap{Procedure: bisp.Procedure[map[string]int]{Kind: bisp.Call}, Map: map[string]int{"a": 1}}},
 		{name: "enum", value: pEnum, expected: TestProcedureEnum{Procedure: bisp.Procedure[TestEnum]{Kind: bisp.Call}, Enum: 0x2}},
 		{name: "multiple", value: pMultipleParams, expected: TestProcedureMultipleParams{Procedure: bisp.Procedure[string]{Kind: bisp.Call}, Int: 42, String: "Hello", Bool: true, Slice: []int{1, 2, 3}, Array: [3]int{4, 5, 6}, Struct: PStruct{A: 1, B: "a", C: true}, Map: map[string]int{"a": 1}, Enum: TestEnum2}},
+		{name: "shadowed", value: pShadowed, expected: TestProcedureShadowed{Procedure: bisp.Procedure[int]{Kind: bisp.Call}, Kind: "kind", Out: "out"}},
 	}
 
 	testDecodeProcedures(t, tcs, bisp.Call)
@@ -202,11 +249,31 @@ func TestDecodeProcedure_Response(t *testing.T) {
 		{name: "map", value: pMap, expected: TestProcedureMap{Procedure: bisp.Procedure[map[string]int]{Kind: bisp.Response, Out: map[string]int{"a": 1}}}},
 		{name: "enum", value: pEnum, expected: TestProcedureEnum{Procedure: bisp.Procedure[TestEnum]{Kind: bisp.Response, Out: 0x1}, Enum: 0x0}},
 		{name: "multiple", value: pMultipleParams, expected: TestProcedureMultipleParams{Procedure: bisp.Procedure[string]{Kind: bisp.Response, Out: "World"}}},
+		{name: "shadowed", value: pShadowed, expected: TestProcedureShadowed{Procedure: bisp.Procedure[int]{Kind: bisp.Response, Out: 42}}},
 	}
 
 	testDecodeProcedures(t, tcs, bisp.Response)
 }
 
+func TestDecodeProcedure_Notify(t *testing.T) {
+	tcs := []testCase{
+		{name: "string", value: pString, expected: TestProcedureString{Procedure: bisp.Procedure[string]{Kind: bisp.Notify}, String: "Hello"}},
+		{name: "notification", value: pNotification, expected: TestNotification{Notification: bisp.Notification{Kind: bisp.Notify}, String: "Hello", Int: 42}},
+	}
+
+	testDecodeProcedures(t, tcs, bisp.Notify)
+}
+
+func TestRegisterProcedure_Notification(t *testing.T) {
+	id := bisp.RegisterProcedure[TestNotification]()
+	pID, err := bisp.GetProcedureID(pNotification)
+	assert.NoError(t, err)
+	assert.Equal(t, id, pID)
+	assert.Panics(t, func() {
+		bisp.RegisterProcedure[PStruct]()
+	})
+}
+
 func TestTDecodeProcedure_Call(t *testing.T) {
 	p := TestProcedureMultipleParams{
 		Procedure: bisp.Procedure[string]{
@@ -345,16 +412,17 @@ func encodeTestProcedure(t *testing.T, p any, kind bisp.PKind, transaction bool)
 	buf.WriteByte(byte(kind))
 	var expectedBytes []byte
 	if kind == bisp.Response {
-		out := pVal.FieldByName("Out")
+		// The embedded Procedure is the first field of the test procedures.
+		out := pVal.Field(0).FieldByName("Out")
 		expectedBytes, err = encodeTestValue(out.Interface(), false)
 		if err != nil {
 			t.Fatal(err)
 		}
 		buf.Write(expectedBytes)
-	} else if kind == bisp.Call {
+	} else if kind == bisp.Call || kind == bisp.Notify {
 		for i := range pType.NumField() {
 			fType := pType.Field(i)
-			if fType.Name == "Procedure" {
+			if fType.Name == "Procedure" || fType.Name == "Notification" {
 				continue
 			}
 			field := pVal.FieldByName(fType.Name)
@@ -365,9 +433,13 @@ func encodeTestProcedure(t *testing.T, p any, kind bisp.PKind, transaction bool)
 			buf.Write(expectedBytes)
 		}
 	}
+	flags := bisp.FProcedure
+	if transaction {
+		flags |= bisp.FTransaction
+	}
 	header := bisp.Header{
 		Version:       bisp.V1,
-		Flags:         bisp.FProcedure,
+		Flags:         flags,
 		TransactionID: testTransactionID,
 		Type:          pID,
 		Length:        bisp.Length(buf.Len()),
@@ -386,4 +458,6 @@ func init() {
 	bisp.RegisterProcedure[TestProcedureMap]()
 	bisp.RegisterProcedure[TestProcedureEnum]()
 	bisp.RegisterProcedure[TestProcedureMultipleParams]()
+	bisp.RegisterProcedure[TestNotification]()
+	bisp.RegisterProcedure[TestProcedureShadowed]()
 }
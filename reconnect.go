@@ -0,0 +1,274 @@
+package bisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DefaultMinBackoff is the delay before the first reconnection attempt when ReconnectOpts.MinBackoff is not set.
+const DefaultMinBackoff = 100 * time.Millisecond
+
+// DefaultMaxBackoff is the maximum delay between reconnection attempts when ReconnectOpts.MaxBackoff is not set.
+const DefaultMaxBackoff = 10 * time.Second
+
+// ErrConnectionLost is returned by calls that weren't answered before the connection dropped, and aren't replayed
+// because they aren't idempotent.
+var ErrConnectionLost = errors.New("connection lost before the response")
+
+// Dialer opens a new connection to the server.
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+type ReconnectOpts struct {
+	// ClientOpts are the options of the Client of each connection.
+	ClientOpts *ClientOpts
+	// MinBackoff is the delay before the first reconnection attempt, doubled after every failed attempt up to
+	// MaxBackoff. Zero means DefaultMinBackoff.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum delay between reconnection attempts. Zero means DefaultMaxBackoff.
+	MaxBackoff time.Duration
+	// Handshake is run on every new connection before any call is sent or replayed over it, after SyncProcedures. The
+	// connection is dropped and dialed again if either fails.
+	Handshake func(ctx context.Context, c *Client) error
+	// DisableProcedureSync stops SyncProcedures from being run on every new connection, checking that the procedure
+	// registry matches the server. It must be set for servers with ServerOpts.DisableIntrospection set.
+	DisableProcedureSync bool
+	// Idempotent reports whether a call can be sent again. Calls without a response when the connection drops are
+	// replayed over the next connection with the same TransactionID if it returns true, and fail with ErrConnectionLost
+	// otherwise. By default, no call is replayed. Calls that weren't sent, failing with ErrNotSent, are always sent
+	// again.
+	Idempotent func(info *CallInfo) bool
+	// OnError is called with the errors of failed dials and handshakes, and the error the connection dropped with.
+	OnError func(err error)
+}
+
+// ReconnectingClient calls procedures over a connection that is dialed again when it drops, with exponential backoff.
+// Calls made while disconnected, or after the server sent ControlGoAway, wait for the next connection.
+type ReconnectingClient struct {
+	dial Dialer
+	opts ReconnectOpts
+
+	mu     sync.Mutex
+	client *Client
+	// ready is closed once client is connected, and replaced when it drops.
+	ready  chan struct{}
+	closed bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewReconnectingClient returns a ReconnectingClient calling procedures over connections opened by dial. The first
+// connection is dialed in the background.
+func NewReconnectingClient(dial Dialer, opts *ReconnectOpts) *ReconnectingClient {
+	c := &ReconnectingClient{
+		dial:  dial,
+		ready: make(chan struct{}),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.MinBackoff <= 0 {
+		c.opts.MinBackoff = DefaultMinBackoff
+	}
+	if c.opts.MaxBackoff <= 0 {
+		c.opts.MaxBackoff = DefaultMaxBackoff
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.run()
+	return c
+}
+
+// CallFunc calls the function procedure name, registered with RegisterFunc, and returns its results.
+func (c *ReconnectingClient) CallFunc(ctx context.Context, name string, args ...any) ([]any, error) {
+	p, err := NewFuncCall(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	var res any
+	if res, err = c.call(ctx, p); err != nil {
+		return nil, err
+	}
+	return FuncResults(res)
+}
+
+func (c *ReconnectingClient) call(ctx context.Context, p any) (any, error) {
+	t := reflect.TypeOf(p)
+	id, err := GetProcedureID(p)
+	if err != nil {
+		return nil, err
+	}
+	if isNotification(t) {
+		return nil, errors.New(fmt.Sprintf("procedure %s is a notification, use ReconnectingClient.Notify", t))
+	}
+	// The TransactionID is kept across replays, so the server can tell them apart from new calls.
+	tID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	info := newCallInfo(&Header{Flags: FProcedure, Type: id, TransactionID: tID}, p, Call)
+	var interceptors []UnaryInterceptor
+	if c.opts.ClientOpts != nil {
+		interceptors = c.opts.ClientOpts.UnaryInterceptors
+	}
+	return chainUnary(interceptors, info, func(ctx context.Context, p any) (any, error) {
+		for {
+			client, err := c.current(ctx)
+			if err != nil {
+				return nil, err
+			}
+			res, err := client.roundTrip(ctx, p, tID)
+			if errors.Is(err, ErrGoingAway) || errors.Is(err, ErrNotSent) {
+				// The call wasn't sent, wait for the next connection.
+				continue
+			}
+			if !errors.Is(err, ErrClientClosed) {
+				return res, err
+			}
+			if c.opts.Idempotent == nil || !c.opts.Idempotent(info) {
+				return nil, errors.Join(ErrConnectionLost, err)
+			}
+		}
+	})(ctx, p)
+}
+
+// Notify sends p as a one-way procedure call over the current connection, waiting for one if disconnected. It isn't
+// replayed if the connection drops.
+func (c *ReconnectingClient) Notify(ctx context.Context, p any) error {
+	client, err := c.current(ctx)
+	if err != nil {
+		return err
+	}
+	return NotifyProcedure(ctx, client, p)
+}
+
+// Client returns the Client of the current connection, waiting until connected.
+func (c *ReconnectingClient) Client(ctx context.Context) (*Client, error) {
+	return c.current(ctx)
+}
+
+// Close closes the current connection and stops reconnecting. Waiting calls fail with ErrClientClosed.
+func (c *ReconnectingClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	client := c.client
+	c.mu.Unlock()
+	c.cancel()
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
+
+// current returns the connected client, waiting for it while reconnecting.
+func (c *ReconnectingClient) current(ctx context.Context) (*Client, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrClientClosed
+		}
+		if c.client != nil && c.client.closeErr() != nil {
+			c.dropped(c.client)
+		}
+		client, ready := c.client, c.ready
+		c.mu.Unlock()
+		if client != nil && !client.conn.GoingAway() {
+			return client, nil
+		}
+		var dropped <-chan struct{}
+		if client != nil {
+			// The server is shutting down, wait for it to close the connection.
+			dropped = client.done
+		}
+		select {
+		case <-dropped:
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.ctx.Done():
+			return nil, ErrClientClosed
+		}
+	}
+}
+
+// run dials connections, and waits for each to drop before dialing the next, until the client is closed.
+func (c *ReconnectingClient) run() {
+	backoff := c.opts.MinBackoff
+	for {
+		client, err := c.connect()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.reportError(err)
+			select {
+			case <-time.After(backoff):
+			case <-c.ctx.Done():
+				return
+			}
+			backoff = min(2*backoff, c.opts.MaxBackoff)
+			continue
+		}
+		backoff = c.opts.MinBackoff
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			_ = client.Close()
+			return
+		}
+		c.client = client
+		close(c.ready)
+		c.mu.Unlock()
+
+		<-client.done
+		c.mu.Lock()
+		c.dropped(client)
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		c.reportError(client.closeErr())
+	}
+}
+
+// dropped clears client once its connection has dropped, so calls wait for the next one. c.mu must be held.
+func (c *ReconnectingClient) dropped(client *Client) {
+	if c.client == client {
+		c.client = nil
+		c.ready = make(chan struct{})
+	}
+}
+
+func (c *ReconnectingClient) connect() (*Client, error) {
+	conn, err := c.dial(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient(conn, c.opts.ClientOpts)
+	if !c.opts.DisableProcedureSync {
+		if err = SyncProcedures(c.ctx, client); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	if c.opts.Handshake != nil {
+		if err = c.opts.Handshake(c.ctx, client); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (c *ReconnectingClient) reportError(err error) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
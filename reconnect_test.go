@@ -0,0 +1,238 @@
+package bisp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+// dropListener keeps the connections it accepts, so a test can drop them.
+type dropListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *dropListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *dropListener) drop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+// newTestDroppingServer serves TestProcedureAdd, dropping the connection instead of answering the first call.
+func newTestDroppingServer(t *testing.T) (*dropListener, *[]bisp.TransactionID) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	dl := &dropListener{Listener: l}
+	var (
+		mu   sync.Mutex
+		tIDs []bisp.TransactionID
+	)
+	srv := bisp.NewServer(&bisp.ServerOpts{
+		UnaryInterceptors: []bisp.UnaryInterceptor{
+			func(ctx context.Context, info *bisp.CallInfo, p any, next bisp.UnaryHandler) (any, error) {
+				if info.Name != "TestProcedureAdd" {
+					return next(ctx, p)
+				}
+				mu.Lock()
+				tIDs = append(tIDs, info.Header.TransactionID)
+				first := len(tIDs) == 1
+				mu.Unlock()
+				if first {
+					dl.drop()
+					return nil, errors.New("dropped")
+				}
+				return next(ctx, p)
+			},
+		},
+	})
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureAdd) error {
+		p.Out = p.A + p.B
+		return nil
+	})
+	go func() {
+		_ = srv.Serve(dl)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		dl.drop()
+	})
+	return dl, &tIDs
+}
+
+func tcpDialer(addr string, dials *atomic.Int32) bisp.Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+}
+
+func TestReconnectingClient_Replay(t *testing.T) {
+	l, tIDs := newTestDroppingServer(t)
+	var dials, handshakes atomic.Int32
+	client := bisp.NewReconnectingClient(tcpDialer(l.Addr().String(), &dials), &bisp.ReconnectOpts{
+		MinBackoff: time.Millisecond,
+		Handshake: func(ctx context.Context, c *bisp.Client) error {
+			handshakes.Add(1)
+			return nil
+		},
+		Idempotent: func(info *bisp.CallInfo) bool {
+			return info.Name == "TestProcedureAdd"
+		},
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 40, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 42, res.Out)
+	assert.Equal(t, int32(2), dials.Load())
+	assert.Equal(t, int32(2), handshakes.Load())
+	if assert.Len(t, *tIDs, 2) {
+		assert.Equal(t, (*tIDs)[0], (*tIDs)[1])
+	}
+}
+
+// brokenWriteConn fails every write, like a connection that dropped without the reads noticing yet.
+type brokenWriteConn struct {
+	net.Conn
+}
+
+func (c brokenWriteConn) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestReconnectingClient_NotSent(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	var dials atomic.Int32
+	client := bisp.NewReconnectingClient(func(ctx context.Context) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			broken, _ := net.Pipe()
+			t.Cleanup(func() {
+				broken.Close()
+			})
+			return brokenWriteConn{broken}, nil
+		}
+		return conn, nil
+	}, &bisp.ReconnectOpts{MinBackoff: time.Millisecond})
+	defer client.Close()
+
+	// The call isn't idempotent, but it wasn't sent over the broken connection, so it is sent again.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Out)
+	assert.Equal(t, int32(2), dials.Load())
+}
+
+func TestReconnectingClient_ConnectionLost(t *testing.T) {
+	l, _ := newTestDroppingServer(t)
+	var dials atomic.Int32
+	client := bisp.NewReconnectingClient(tcpDialer(l.Addr().String(), &dials), &bisp.ReconnectOpts{MinBackoff: time.Millisecond})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+	assert.ErrorIs(t, err, bisp.ErrConnectionLost)
+
+	// The next call is sent over a new connection.
+	res, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Out)
+}
+
+func TestReconnectingClient_Backoff(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	var (
+		dials  atomic.Int32
+		errs   atomic.Int32
+		failed = errors.New("dial failed")
+	)
+	client := bisp.NewReconnectingClient(func(ctx context.Context) (net.Conn, error) {
+		if dials.Add(1) < 3 {
+			return nil, failed
+		}
+		return conn, nil
+	}, &bisp.ReconnectOpts{
+		MinBackoff: time.Millisecond,
+		OnError: func(err error) {
+			if errors.Is(err, failed) {
+				errs.Add(1)
+			}
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 2, B: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, res.Out)
+	assert.Equal(t, int32(3), dials.Load())
+	assert.Equal(t, int32(2), errs.Load())
+
+	assert.NoError(t, client.Close())
+	_, err = bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 2, B: 3})
+	assert.ErrorIs(t, err, bisp.ErrClientClosed)
+}
+
+func TestReconnectingClient_ProcedureSync(t *testing.T) {
+	_, conn := newTestServer(t, &bisp.ServerOpts{DisableIntrospection: true})
+	var dials atomic.Int32
+	dial := func(ctx context.Context) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			return conn, nil
+		}
+		return nil, errors.New("dial failed")
+	}
+	// The procedures are synced on every connection by default, which fails against the server.
+	synced := make(chan error, 1)
+	client := bisp.NewReconnectingClient(dial, &bisp.ReconnectOpts{
+		MinBackoff: time.Hour,
+		OnError: func(err error) {
+			select {
+			case synced <- err:
+			default:
+			}
+		},
+	})
+	select {
+	case err := <-synced:
+		assert.ErrorContains(t, err, "no handler for procedure")
+	case <-time.After(5 * time.Second):
+		t.Fatal("procedures not synced")
+	}
+	assert.NoError(t, client.Close())
+
+	_, conn = newTestServer(t, &bisp.ServerOpts{DisableIntrospection: true})
+	dials.Store(0)
+	client = bisp.NewReconnectingClient(dial, &bisp.ReconnectOpts{DisableProcedureSync: true})
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Out)
+}
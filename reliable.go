@@ -0,0 +1,378 @@
+package bisp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultRetransmitTimeout is the time before an unacknowledged message is first resent when
+// ReliableOpts.RetransmitTimeout is not set.
+const DefaultRetransmitTimeout = 200 * time.Millisecond
+
+// DefaultMaxRetransmitTimeout is the maximum time between retransmissions when ReliableOpts.MaxRetransmitTimeout is
+// not set.
+const DefaultMaxRetransmitTimeout = 5 * time.Second
+
+// DefaultMaxRetransmits is the number of times a message is resent when ReliableOpts.MaxRetransmits is not set.
+const DefaultMaxRetransmits = 10
+
+// DefaultWindow is the number of unacknowledged messages when ReliableOpts.Window is not set.
+const DefaultWindow = 64
+
+// ErrDeliveryFailed is returned once a ReliableConn is closed because a message wasn't acknowledged after
+// ReliableOpts.MaxRetransmits retransmissions.
+var ErrDeliveryFailed = errors.New("message not acknowledged")
+
+type ReliableOpts struct {
+	// RetransmitTimeout is the time before an unacknowledged message is resent. It doubles after every retransmission,
+	// up to MaxRetransmitTimeout. Zero means DefaultRetransmitTimeout.
+	RetransmitTimeout time.Duration
+	// MaxRetransmitTimeout is the maximum time between retransmissions. Zero means DefaultMaxRetransmitTimeout.
+	MaxRetransmitTimeout time.Duration
+	// MaxRetransmits is the number of times a message is resent before the connection fails with ErrDeliveryFailed.
+	// Zero means DefaultMaxRetransmits.
+	MaxRetransmits int
+	// Window is the number of messages that can be sent without being acknowledged, Send blocks beyond it. The receiver
+	// buffers as many messages received out of order. Zero means DefaultWindow.
+	Window int
+	// MaxPacketSize is the maximum size of a sent frame if the connection is a net.PacketConn, Send fails with
+	// ErrPacketTooLarge beyond it. Zero means DefaultMaxPacketSize.
+	MaxPacketSize int
+	Encoder       EncoderOpts
+	Decoder       DecoderOpts
+}
+
+// ReliableConn delivers messages at least once and in order over an unreliable transport. Sent messages carry a
+// sequence number in an ExtSeq header extension, and are resent with backoff until the peer acknowledges them with a
+// cumulative ControlAck frame. The receiver suppresses duplicates, and delivers messages received out of order once the
+// gap before them is filled, so every message is received exactly once.
+//
+// If the connection is a net.PacketConn, such as a UDP socket made with net.DialUDP, every packet is decoded as a
+// frame, and malformed packets are dropped. Otherwise the connection is read as a stream. Acknowledgements are
+// processed by Receive, so a goroutine must be calling it.
+type ReliableConn struct {
+	conn     net.Conn
+	opts     ReliableOpts
+	datagram bool
+
+	wmu  sync.Mutex
+	wbuf bytes.Buffer
+	enc  *Encoder
+	// smu serializes Send, so sequence numbers are taken in the order messages are queued in unacked.
+	smu sync.Mutex
+
+	// mu guards the sender state: the next sequence number, and the messages waiting for an acknowledgement.
+	mu      sync.Mutex
+	space   *sync.Cond
+	nextSeq uint32
+	unacked []*unacked
+	err     error
+
+	// The receiver state is only used by Receive: the last message delivered in order, and the messages received after a
+	// gap.
+	rmu       sync.Mutex
+	dec       *Decoder
+	rbuf      []byte
+	delivered uint32
+	received  map[uint32]*Message
+
+	once sync.Once
+	done chan struct{}
+}
+
+type unacked struct {
+	seq      uint32
+	frame    []byte
+	timeout  time.Duration
+	resendAt time.Time
+	resent   int
+}
+
+func NewReliableConn(conn net.Conn, opts *ReliableOpts) *ReliableConn {
+	c := &ReliableConn{
+		conn:     conn,
+		nextSeq:  1,
+		received: make(map[uint32]*Message, 16),
+		done:     make(chan struct{}),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.RetransmitTimeout <= 0 {
+		c.opts.RetransmitTimeout = DefaultRetransmitTimeout
+	}
+	if c.opts.MaxRetransmitTimeout <= 0 {
+		c.opts.MaxRetransmitTimeout = DefaultMaxRetransmitTimeout
+	}
+	if c.opts.MaxRetransmits <= 0 {
+		c.opts.MaxRetransmits = DefaultMaxRetransmits
+	}
+	if c.opts.Window <= 0 {
+		c.opts.Window = DefaultWindow
+	}
+	if c.opts.MaxPacketSize <= 0 {
+		c.opts.MaxPacketSize = DefaultMaxPacketSize
+	}
+	// Every message is a single frame carrying its own sequence number.
+	c.opts.Encoder.ChunkSize = 0
+	c.space = sync.NewCond(&c.mu)
+	if _, ok := conn.(net.PacketConn); ok {
+		c.datagram = true
+		c.opts.Encoder.Sync = false
+		c.opts.Decoder.Sync = false
+		c.rbuf = make([]byte, maxUDPPayload)
+	} else {
+		c.dec = NewDecoderWithOpts(bufio.NewReader(conn), &c.opts.Decoder)
+	}
+	c.enc = NewEncoderWithOpts(&c.wbuf, &c.opts.Encoder)
+	go c.retransmit()
+	return c
+}
+
+// Send sends msg with the next sequence number, and keeps it to be resent until it is acknowledged. It blocks while
+// ReliableOpts.Window messages are unacknowledged. msg is not modified. A write that fails with an error other than a
+// timeout or an unreachable peer on a net.PacketConn closes the connection with it.
+func (c *ReliableConn) Send(msg *Message) error {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	c.mu.Lock()
+	for c.err == nil && len(c.unacked) >= c.opts.Window {
+		c.space.Wait()
+	}
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	seq := c.nextSeq
+	c.mu.Unlock()
+
+	m := *msg
+	m.Header.Extensions |= ExtSeq
+	m.Header.Seq = seq
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf.Reset()
+	// The sequence number is only taken once the message is encoded, so the peer isn't left waiting for it.
+	if err := c.enc.Encode(&m); err != nil {
+		return err
+	}
+	if c.datagram && c.wbuf.Len() > c.opts.MaxPacketSize {
+		return &LimitError{Err: ErrPacketTooLarge, Value: c.wbuf.Len(), Max: c.opts.MaxPacketSize}
+	}
+	frame := bytes.Clone(c.wbuf.Bytes())
+	c.mu.Lock()
+	c.nextSeq++
+	c.unacked = append(c.unacked, &unacked{
+		seq:      seq,
+		frame:    frame,
+		timeout:  c.opts.RetransmitTimeout,
+		resendAt: time.Now().Add(c.opts.RetransmitTimeout),
+	})
+	c.mu.Unlock()
+	return c.writeFrame(frame)
+}
+
+// writeFrame writes a frame that is resent until it is acknowledged. Transient errors are left to the retransmissions,
+// while other errors close the connection.
+func (c *ReliableConn) writeFrame(frame []byte) error {
+	_, err := c.conn.Write(frame)
+	if err == nil || c.isTransient(err) {
+		return nil
+	}
+	c.closeWith(err)
+	return err
+}
+
+// isTransient reports whether a write that failed with err can succeed when retransmitted. On a stream, a failed write
+// may have written part of the frame, so no error is transient.
+func (c *ReliableConn) isTransient(err error) bool {
+	if !c.datagram {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return isTransientErrno(err)
+}
+
+// Receive returns the next message in order. Acknowledgements and duplicates are handled without being returned.
+func (c *ReliableConn) Receive() (*Message, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		if msg, ok := c.received[c.delivered+1]; ok {
+			delete(c.received, c.delivered+1)
+			c.delivered++
+			return msg, nil
+		}
+		msg, err := c.readFrame()
+		if err != nil {
+			if cause := c.closeErr(); cause != nil {
+				return nil, cause
+			}
+			return nil, err
+		}
+		if msg == nil {
+			continue
+		}
+		if !msg.Header.HasExtension(ExtSeq) {
+			return msg, nil
+		}
+		seq := msg.Header.Seq
+		if seqAfter(seq, c.delivered) && !seqAfter(seq, c.delivered+uint32(c.opts.Window)) {
+			c.received[seq] = msg
+		}
+		// Acknowledge everything delivered, or about to be delivered, in order. Duplicates are acknowledged again, as the
+		// previous acknowledgement may have been lost.
+		ack := c.delivered
+		for {
+			if _, ok := c.received[ack+1]; !ok {
+				break
+			}
+			ack++
+		}
+		if err = c.sendAck(ack); err != nil && !c.datagram {
+			return nil, err
+		}
+	}
+}
+
+// readFrame reads the next frame, and returns the message it holds, or nil for control frames and dropped packets.
+func (c *ReliableConn) readFrame() (*Message, error) {
+	if !c.datagram {
+		return c.decodeFrame(c.dec)
+	}
+	n, err := c.conn.Read(c.rbuf)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := c.decodeFrame(NewDecoderWithOpts(bytes.NewReader(c.rbuf[:n]), &c.opts.Decoder))
+	if err != nil {
+		// A malformed packet is dropped like a lost one.
+		return nil, nil
+	}
+	return msg, nil
+}
+
+func (c *ReliableConn) decodeFrame(d *Decoder) (*Message, error) {
+	header, err := d.DecodeHeader()
+	if err != nil {
+		return nil, err
+	}
+	if header.HasFlag(FControl) {
+		if err = d.readBody(uint32(header.Length), "control frame"); err != nil {
+			return nil, err
+		}
+		if header.Type == ControlAck && header.HasExtension(ExtSeq) {
+			c.ack(header.Seq)
+		}
+		return nil, nil
+	}
+	var msg Message
+	if err = d.decodeMessage(header, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (c *ReliableConn) sendAck(seq uint32) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf.Reset()
+	if err := c.enc.encodeFrame(&Header{Flags: FControl, Extensions: ExtSeq, Seq: seq}, ControlAck, nil); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(c.wbuf.Bytes())
+	return err
+}
+
+// ack drops the messages acknowledged by a cumulative acknowledgement of seq.
+func (c *ReliableConn) ack(seq uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := 0
+	for i < len(c.unacked) && !seqAfter(c.unacked[i].seq, seq) {
+		i++
+	}
+	if i > 0 {
+		c.unacked = append(c.unacked[:0], c.unacked[i:]...)
+		c.space.Broadcast()
+	}
+}
+
+func (c *ReliableConn) retransmit() {
+	ticker := time.NewTicker(c.opts.RetransmitTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			var frames [][]byte
+			c.mu.Lock()
+			for _, u := range c.unacked {
+				if now.Before(u.resendAt) {
+					continue
+				}
+				if u.resent >= c.opts.MaxRetransmits {
+					c.mu.Unlock()
+					c.closeWith(ErrDeliveryFailed)
+					return
+				}
+				u.resent++
+				u.timeout = min(2*u.timeout, c.opts.MaxRetransmitTimeout)
+				u.resendAt = now.Add(u.timeout)
+				frames = append(frames, u.frame)
+			}
+			c.mu.Unlock()
+			for _, frame := range frames {
+				c.wmu.Lock()
+				err := c.writeFrame(frame)
+				c.wmu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Unacked returns the number of messages waiting for an acknowledgement.
+func (c *ReliableConn) Unacked() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.unacked)
+}
+
+// Close closes the connection. Messages that haven't been acknowledged are not resent.
+func (c *ReliableConn) Close() error {
+	c.closeWith(net.ErrClosed)
+	return c.conn.Close()
+}
+
+func (c *ReliableConn) closeWith(err error) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.space.Broadcast()
+		c.mu.Unlock()
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+func (c *ReliableConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// seqAfter reports whether sequence number a comes after b, allowing for wraparound.
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
@@ -0,0 +1,15 @@
+//go:build !plan9
+
+package bisp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isTransientErrno reports whether err is an error of an unreachable or overloaded peer or network, which a datagram
+// can be retransmitted after.
+func isTransientErrno(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.ENOBUFS)
+}
@@ -0,0 +1,6 @@
+package bisp
+
+// isTransientErrno reports false, as plan9 reports network errors as strings rather than errnos.
+func isTransientErrno(err error) bool {
+	return false
+}
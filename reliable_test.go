@@ -0,0 +1,190 @@
+package bisp_test
+
+import (
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+// lossyConn drops a fifth of the packets written to it, and writes a tenth of them twice.
+type lossyConn struct {
+	*net.UDPConn
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	n := c.rnd.IntN(10)
+	c.mu.Unlock()
+	switch {
+	case n < 2:
+		return len(p), nil
+	case n == 2:
+		_, _ = c.UDPConn.Write(p)
+	}
+	return c.UDPConn.Write(p)
+}
+
+func newTestLossyConns(t *testing.T) (*lossyConn, *lossyConn) {
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	b, err := net.DialUDP("udp", nil, a.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+	// Connect a to b, so both ends are connected sockets.
+	bAddr := b.LocalAddr().(*net.UDPAddr)
+	assert.NoError(t, a.Close())
+	a, err = net.DialUDP("udp", a.LocalAddr().(*net.UDPAddr), bAddr)
+	assert.NoError(t, err)
+	return &lossyConn{UDPConn: a, rnd: rand.New(rand.NewPCG(1, 2))}, &lossyConn{UDPConn: b, rnd: rand.New(rand.NewPCG(3, 4))}
+}
+
+func TestReliableConn_Lossy(t *testing.T) {
+	a, b := newTestLossyConns(t)
+	opts := &bisp.ReliableOpts{RetransmitTimeout: 10 * time.Millisecond, MaxRetransmitTimeout: 50 * time.Millisecond, MaxRetransmits: 20, Window: 8}
+	sender := bisp.NewReliableConn(a, opts)
+	receiver := bisp.NewReliableConn(b, opts)
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	// The sender must read for acknowledgements to be processed.
+	go func() {
+		for {
+			if _, err := sender.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	const n = 100
+	go func() {
+		for i := range n {
+			assert.NoError(t, sender.Send(&bisp.Message{Body: int32(i)}))
+		}
+	}()
+	assert.NoError(t, b.SetReadDeadline(time.Now().Add(10*time.Second)))
+	for i := range n {
+		msg, err := receiver.Receive()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, int32(i), msg.Body)
+		assert.Equal(t, uint32(i+1), msg.Header.Seq)
+	}
+	// Keep reading, so retransmissions whose acknowledgement was lost are acknowledged again.
+	go func() {
+		_, _ = receiver.Receive()
+	}()
+	assert.Eventually(t, func() bool { return sender.Unacked() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReliableConn_Stream(t *testing.T) {
+	a, b := net.Pipe()
+	sender := bisp.NewReliableConn(a, nil)
+	receiver := bisp.NewReliableConn(b, nil)
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	go func() {
+		_, _ = sender.Receive()
+	}()
+
+	go func() {
+		assert.NoError(t, sender.Send(&bisp.Message{Body: "first"}))
+		assert.NoError(t, sender.Send(&bisp.Message{Body: testStruct{A: 2, B: "second", C: true}}))
+	}()
+	msg, err := receiver.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "first", msg.Body)
+	msg, err = receiver.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, testStruct{A: 2, B: "second", C: true}, msg.Body)
+	assert.Eventually(t, func() bool { return sender.Unacked() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReliableConn_SendError(t *testing.T) {
+	a, b := net.Pipe()
+	sender := bisp.NewReliableConn(a, nil)
+	receiver := bisp.NewReliableConn(b, nil)
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	go func() {
+		_, _ = sender.Receive()
+	}()
+
+	type unregistered struct{ A int }
+	msg := &bisp.Message{Body: "after"}
+	go func() {
+		assert.Error(t, sender.Send(&bisp.Message{Body: unregistered{A: 1}}))
+		assert.NoError(t, sender.Send(msg))
+	}()
+	res, err := receiver.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "after", res.Body)
+	assert.Equal(t, uint32(1), res.Header.Seq)
+	assert.Equal(t, bisp.Header{}, msg.Header)
+	assert.Eventually(t, func() bool { return sender.Unacked() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReliableConn_DeliveryFailed(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	t.Cleanup(func() { peer.Close() })
+	conn, err := net.DialUDP("udp", nil, peer.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+	sender := bisp.NewReliableConn(conn, &bisp.ReliableOpts{RetransmitTimeout: 5 * time.Millisecond, MaxRetransmits: 2})
+	t.Cleanup(func() { sender.Close() })
+
+	assert.NoError(t, sender.Send(&bisp.Message{Body: "lost"}))
+	_, err = sender.Receive()
+	assert.ErrorIs(t, err, bisp.ErrDeliveryFailed)
+	assert.ErrorIs(t, sender.Send(&bisp.Message{Body: "after"}), bisp.ErrDeliveryFailed)
+}
+
+func TestReliableConn_PacketTooLarge(t *testing.T) {
+	a, b := newTestLossyConns(t)
+	sender := bisp.NewReliableConn(a.UDPConn, &bisp.ReliableOpts{MaxPacketSize: 64})
+	receiver := bisp.NewReliableConn(b.UDPConn, nil)
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	go func() {
+		_, _ = sender.Receive()
+	}()
+
+	err := sender.Send(&bisp.Message{Body: strings.Repeat("a", 64)})
+	var limitErr *bisp.LimitError
+	assert.ErrorAs(t, err, &limitErr)
+	assert.ErrorIs(t, err, bisp.ErrPacketTooLarge)
+	assert.Equal(t, 0, sender.Unacked())
+
+	// The rejected message doesn't take a sequence number.
+	assert.NoError(t, sender.Send(&bisp.Message{Body: "small"}))
+	msg, err := receiver.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "small", msg.Body)
+	assert.Equal(t, uint32(1), msg.Header.Seq)
+}
+
+func TestReliableConn_WriteError(t *testing.T) {
+	a, b := net.Pipe()
+	sender := bisp.NewReliableConn(a, nil)
+	t.Cleanup(func() { sender.Close() })
+	assert.NoError(t, b.Close())
+
+	err := sender.Send(&bisp.Message{Body: "lost"})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.ErrorIs(t, sender.Send(&bisp.Message{Body: "after"}), io.ErrClosedPipe)
+}
@@ -0,0 +1,216 @@
+package bisp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"reflect"
+	"sync"
+)
+
+// RegisterRPCMethod registers the net/rpc method serviceMethod, e.g. "Arith.Multiply", as a function procedure taking
+// args and returning reply, and returns its ID. args and reply are values of the argument and reply types of the
+// method, pointers are dereferenced. Methods must be registered on both sides of the connection to be used with the
+// codecs returned by NewServerCodec and NewClientCodec.
+func RegisterRPCMethod(serviceMethod string, args, reply any) ID {
+	if id, _, ok := lookupProcedure(serviceMethod); ok {
+		return id
+	}
+	argsType := reflect.TypeOf(args)
+	replyType := reflect.TypeOf(reply)
+	if argsType == nil || replyType == nil {
+		panic("rpc method args and reply must not be nil")
+	}
+	p := funcType(serviceMethod,
+		[]reflect.StructField{funcField(nil, "Arg", 0, indirectType(argsType))},
+		[]reflect.StructField{funcField(nil, "Ret", 0, indirectType(replyType))},
+	)
+	pmu.Lock()
+	defer pmu.Unlock()
+	if id, ok := pNameRegistry[serviceMethod]; ok {
+		return id
+	}
+	registerParamTypes(p)
+	id := allocPID()
+	registerProcedureType(serviceMethod, p, id)
+	return id
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// rpcCodec holds what is shared by the server and client codecs. Requests are procedure calls of the methods registered
+// with RegisterRPCMethod, with the sequence number in the TransactionID, and errors are sent as FError messages.
+type rpcCodec struct {
+	conn io.ReadWriteCloser
+	wmu  sync.Mutex
+	enc  *Encoder
+	dec  *Decoder
+	// msg is the message whose header was read, until its body is read.
+	msg *Message
+}
+
+func newRPCCodec(conn io.ReadWriteCloser) rpcCodec {
+	return rpcCodec{
+		conn: conn,
+		enc:  NewEncoder(conn),
+		dec:  NewDecoder(bufio.NewReader(conn)),
+	}
+}
+
+// read decodes the next message, and returns its method name and sequence number.
+func (c *rpcCodec) read() (string, uint64, error) {
+	var msg Message
+	if err := c.dec.Decode(&msg); err != nil {
+		return "", 0, err
+	}
+	c.msg = &msg
+	seq := rpcSeq(msg.Header.TransactionID)
+	if msg.IsError() {
+		return "", seq, nil
+	}
+	if !msg.IsProcedure() {
+		return "", seq, errors.New(fmt.Sprintf("expected rpc procedure, got %s", reflect.TypeOf(msg.Body)))
+	}
+	return procedureName(reflect.TypeOf(msg.Body)), seq, nil
+}
+
+// readField sets body, a pointer, to the field at index of the procedure read by read. The field is discarded if body is
+// nil.
+func (c *rpcCodec) readField(body any, index []int) error {
+	msg := c.msg
+	c.msg = nil
+	if body == nil || msg == nil || msg.IsError() {
+		return nil
+	}
+	dst := reflect.ValueOf(body)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return errors.New(fmt.Sprintf("expected non-nil pointer, got %s", dst.Type()))
+	}
+	field := reflect.ValueOf(msg.Body).FieldByIndex(index)
+	if !field.Type().AssignableTo(dst.Type().Elem()) {
+		return errors.New(fmt.Sprintf("cannot read %s into %s", field.Type(), dst.Type()))
+	}
+	dst.Elem().Set(field)
+	return nil
+}
+
+// write sends body as the field at index of a procedure of the method serviceMethod.
+func (c *rpcCodec) write(serviceMethod string, seq uint64, kind PKind, body any, index []int) error {
+	_, t, ok := lookupProcedure(serviceMethod)
+	if !ok {
+		return errors.New(fmt.Sprintf("rpc method not registered: %s", serviceMethod))
+	}
+	p := reflect.New(t).Elem()
+	field := p.FieldByIndex(index)
+	val := reflect.Indirect(reflect.ValueOf(body))
+	if !val.IsValid() || !val.Type().AssignableTo(field.Type()) {
+		return errors.New(fmt.Sprintf("rpc method %s expects %s, got %s", serviceMethod, field.Type(), reflect.TypeOf(body)))
+	}
+	field.Set(val)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.enc.EncodeProcedure(p.Interface(), kind, &EncodeProcedureOpts{TransactionID: rpcTransactionID(seq)})
+}
+
+func (c *rpcCodec) writeError(seq uint64, msg string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.enc.Encode(&Message{Header: Header{Flags: FError, TransactionID: rpcTransactionID(seq)}, Body: msg})
+}
+
+func (c *rpcCodec) Close() error {
+	return c.conn.Close()
+}
+
+// The fields of function procedures holding the argument and the result of rpc methods, see funcType.
+var (
+	rpcArgIndex   = []int{2}
+	rpcReplyIndex = []int{1, 0}
+)
+
+type serverCodec struct {
+	rpcCodec
+}
+
+// NewServerCodec returns a rpc.ServerCodec encoding requests and responses with bisp, in place of the gob codec used
+// by rpc.ServeConn. The methods served must be registered with RegisterRPCMethod.
+func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &serverCodec{newRPCCodec(conn)}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	name, seq, err := c.read()
+	if err != nil {
+		return err
+	}
+	if c.msg.IsError() {
+		return errors.New("unexpected error message")
+	}
+	if kind := procedureKind(c.msg.Body); kind != Call {
+		return errors.New(fmt.Sprintf("unexpected procedure kind %s", kind))
+	}
+	r.ServiceMethod = name
+	r.Seq = seq
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body any) error {
+	return c.readField(body, rpcArgIndex)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body any) error {
+	if r.Error != "" {
+		return c.writeError(r.Seq, r.Error)
+	}
+	return c.write(r.ServiceMethod, r.Seq, Response, body, rpcReplyIndex)
+}
+
+type clientCodec struct {
+	rpcCodec
+}
+
+// NewClientCodec returns a rpc.ClientCodec encoding requests and responses with bisp, to be used with
+// rpc.NewClientWithCodec. The methods called must be registered with RegisterRPCMethod.
+func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &clientCodec{newRPCCodec(conn)}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body any) error {
+	return c.write(r.ServiceMethod, r.Seq, Call, body, rpcArgIndex)
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	name, seq, err := c.read()
+	if err != nil {
+		return err
+	}
+	r.ServiceMethod = name
+	r.Seq = seq
+	if c.msg.IsError() {
+		r.Error = c.msg.Error().Error()
+	}
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(body any) error {
+	return c.readField(body, rpcReplyIndex)
+}
+
+// rpcTransactionID returns the TransactionID carrying the sequence number seq.
+func rpcTransactionID(seq uint64) TransactionID {
+	var tID TransactionID
+	binary.BigEndian.PutUint64(tID[TransactionIDSize-8:], seq)
+	return tID
+}
+
+func rpcSeq(tID TransactionID) uint64 {
+	return binary.BigEndian.Uint64(tID[TransactionIDSize-8:])
+}
@@ -0,0 +1,95 @@
+package bisp_test
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+type ArithArgs struct {
+	A, B int
+}
+
+type ArithQuotient struct {
+	Quo, Rem int
+}
+
+type Arith int
+
+func (Arith) Multiply(args *ArithArgs, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func (Arith) Divide(args ArithArgs, quo *ArithQuotient) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	quo.Quo = args.A / args.B
+	quo.Rem = args.A % args.B
+	return nil
+}
+
+func init() {
+	bisp.RegisterRPCMethod("Arith.Multiply", ArithArgs{}, 0)
+	bisp.RegisterRPCMethod("Arith.Divide", ArithArgs{}, ArithQuotient{})
+	bisp.RegisterRPCMethod("Arith.Missing", ArithArgs{}, 0)
+}
+
+func newTestRPCClient(t *testing.T) *rpc.Client {
+	server := rpc.NewServer()
+	assert.NoError(t, server.Register(new(Arith)))
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(bisp.NewServerCodec(serverConn))
+	client := rpc.NewClientWithCodec(bisp.NewClientCodec(clientConn))
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+func TestRPCCodec_Call(t *testing.T) {
+	client := newTestRPCClient(t)
+
+	var product int
+	assert.NoError(t, client.Call("Arith.Multiply", &ArithArgs{7, 8}, &product))
+	assert.Equal(t, 56, product)
+
+	var quo ArithQuotient
+	assert.NoError(t, client.Call("Arith.Divide", ArithArgs{17, 5}, &quo))
+	assert.Equal(t, ArithQuotient{3, 2}, quo)
+
+	err := client.Call("Arith.Divide", ArithArgs{1, 0}, &quo)
+	assert.EqualError(t, err, "divide by zero")
+	err = client.Call("Arith.Missing", ArithArgs{1, 0}, &product)
+	assert.ErrorContains(t, err, "can't find method")
+
+	// The connection is still usable after errors.
+	assert.NoError(t, client.Call("Arith.Multiply", &ArithArgs{2, 3}, &product))
+	assert.Equal(t, 6, product)
+}
+
+func TestRPCCodec_Concurrent(t *testing.T) {
+	client := newTestRPCClient(t)
+
+	calls := make([]*rpc.Call, 50)
+	for i := range calls {
+		calls[i] = client.Go("Arith.Multiply", &ArithArgs{i, i}, new(int), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		assert.NoError(t, call.Error)
+		assert.Equal(t, i*i, *call.Reply.(*int))
+	}
+}
+
+func TestRPCCodec_Unregistered(t *testing.T) {
+	client := newTestRPCClient(t)
+	var product int
+	err := client.Call("Arith.Unregistered", &ArithArgs{1, 2}, &product)
+	assert.ErrorContains(t, err, "rpc method not registered")
+}
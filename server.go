@@ -0,0 +1,427 @@
+package bisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// HandlerFunc handles a procedure call. The handler sets p.Out, which is sent back to the caller
+// unless the procedure was sent with Notify.
+type HandlerFunc[P any] func(ctx context.Context, p *P) error
+
+type handler func(ctx context.Context, p any) (any, error)
+
+// replier sends the responses of dispatched procedures, it is implemented by Conn.
+type replier interface {
+	Send(msg *Message) error
+	SendProcedure(p any, kind PKind, opts *EncodeProcedureOpts) error
+	SendBatch(b Batch, opts *EncodeProcedureOpts) error
+}
+
+type ServerOpts struct {
+	// OnError is called with errors that can't be returned to the caller, such as errors returned by handlers of
+	// notifications, or failures to write a response.
+	OnError func(err error)
+	// UnaryInterceptors are called in order around the handlers of procedure calls.
+	UnaryInterceptors []UnaryInterceptor
+	// NotifyInterceptors are called in order around the handlers of notifications.
+	NotifyInterceptors []NotifyInterceptor
+	// DisableIntrospection stops the server from handling the ListProcedures and DescribeProcedure procedures.
+	DisableIntrospection bool
+	// ConnOpts are the options of the Conn wrapping each served connection.
+	ConnOpts *ConnOpts
+}
+
+// ErrServerClosed is returned by Serve and ServeConn once Shutdown has been called.
+var ErrServerClosed = errors.New("server closed")
+
+type Server struct {
+	opts     ServerOpts
+	mu       sync.RWMutex
+	handlers map[ID]handler
+
+	// smu guards the listeners and connections being served. active counts the calls in flight on all connections, so
+	// a call counts as in flight from the moment its frame is read.
+	smu       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*Conn]*servedConn
+	active    int
+	shutdown  bool
+	// idle is closed and reset by end when active drops to zero, if Shutdown is waiting on it.
+	idle chan struct{}
+}
+
+// servedConn is the state of a connection being served, guarded by Server.smu.
+type servedConn struct {
+	// calls counts the calls in flight on the connection.
+	calls int
+	// goneAway is set once ControlGoAway has been written. The connection is then closed as soon as no call is in
+	// flight, and closed is set so frames read after it are not dispatched.
+	goneAway bool
+	closed   bool
+}
+
+func NewServer(opts *ServerOpts) *Server {
+	s := &Server{
+		handlers:  make(map[ID]handler, 16),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*Conn]*servedConn),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if !s.opts.DisableIntrospection {
+		handleIntrospection(s)
+	}
+	return s
+}
+
+// Handle registers h as the handler for procedure P. The procedure is registered if it isn't already.
+func Handle[P any](s *Server, h HandlerFunc[P]) {
+	id := RegisterProcedure[P]()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[id] = func(ctx context.Context, p any) (any, error) {
+		v, ok := p.(P)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("expected procedure of type %s, got %s", reflect.TypeOf(v), reflect.TypeOf(p)))
+		}
+		err := h(ctx, &v)
+		return v, err
+	}
+}
+
+// HandleFunc registers fn as the handler for the function procedure name. The procedure is registered with
+// RegisterFunc if it isn't already.
+func HandleFunc(s *Server, name string, fn any, opts *FuncOpts) {
+	id := RegisterFunc(name, fn, opts)
+	v := reflect.ValueOf(fn)
+	if v.IsNil() {
+		panic("procedure function must not be nil")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[id] = func(ctx context.Context, p any) (any, error) {
+		return callFunc(ctx, id, v, p)
+	}
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine. It returns ErrServerClosed once Shutdown
+// has been called.
+func (s *Server) Serve(l net.Listener) error {
+	s.smu.Lock()
+	if s.shutdown {
+		s.smu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.smu.Unlock()
+	defer func() {
+		s.smu.Lock()
+		delete(s.listeners, l)
+		s.smu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				s.reportError(err)
+			}
+		}()
+	}
+}
+
+// ServeConn reads procedure calls from conn until it is closed. Calls are dispatched concurrently.
+func (s *Server) ServeConn(conn net.Conn) error {
+	c := NewConn(conn, s.opts.ConnOpts)
+	defer c.Close()
+	s.smu.Lock()
+	if s.shutdown {
+		s.smu.Unlock()
+		return ErrServerClosed
+	}
+	sc := &servedConn{}
+	s.conns[c] = sc
+	s.smu.Unlock()
+	defer func() {
+		s.smu.Lock()
+		delete(s.conns, c)
+		s.smu.Unlock()
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for {
+		msg, err := c.Receive()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !msg.IsProcedure() {
+			s.reportError(errors.New(fmt.Sprintf("expected procedure message, got %s", reflect.TypeOf(msg.Body))))
+			continue
+		}
+		if !s.begin(sc) {
+			// The connection was closed for being idle after ControlGoAway, so the call is left unhandled.
+			return nil
+		}
+		go func() {
+			defer s.end(c, sc)
+			s.dispatch(ctx, c, msg)
+		}()
+	}
+}
+
+// DefaultGoAwayTimeout is how long Shutdown waits for ControlGoAway to be written to a connection when its context has
+// no deadline. Connections it can't be written to are closed.
+const DefaultGoAwayTimeout = 5 * time.Second
+
+// Shutdown shuts the server down gracefully. It stops accepting connections and sends ControlGoAway on every
+// connection, so clients stop sending new calls. Calls received after it are still handled, and every connection is
+// closed once it has no call in flight. Calls the client sent before receiving ControlGoAway that are read after their
+// connection is closed are not handled. Shutdown returns once every call is handled. If ctx is done first, the
+// connections are closed and its error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.smu.Lock()
+	s.shutdown = true
+	// The errors are reported once s.smu is unlocked, as OnError may call back into the server.
+	var errs []error
+	for l := range s.listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	conns := make(map[*Conn]*servedConn, len(s.conns))
+	for c, sc := range s.conns {
+		conns[c] = sc
+	}
+	s.smu.Unlock()
+	for _, err := range errs {
+		s.reportError(err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultGoAwayTimeout)
+	}
+	var wg sync.WaitGroup
+	for c, sc := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.goAway(deadline); err != nil {
+				// The client stopped reading, and won't stop sending calls.
+				_ = c.Close()
+				return
+			}
+			s.smu.Lock()
+			sc.goneAway = true
+			s.closeIfIdle(c, sc)
+			s.smu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Calls read before the client handled ControlGoAway start after it was written, so active is checked again every
+	// time it drops to zero. Once it is zero, every connection has been closed and no call can start.
+	var err error
+	s.smu.Lock()
+	for s.active > 0 && err == nil {
+		if s.idle == nil {
+			s.idle = make(chan struct{})
+		}
+		idle := s.idle
+		s.smu.Unlock()
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		s.smu.Lock()
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.smu.Unlock()
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	return s.shutdown
+}
+
+// begin and end count the calls in flight, waking Shutdown whenever the last call ends. begin reports false if the
+// connection was closed by closeIfIdle.
+func (s *Server) begin(sc *servedConn) bool {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	if sc.closed {
+		return false
+	}
+	sc.calls++
+	s.active++
+	return true
+}
+
+func (s *Server) end(c *Conn, sc *servedConn) {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	sc.calls--
+	s.active--
+	if s.active == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+	s.closeIfIdle(c, sc)
+}
+
+// closeIfIdle closes c once ControlGoAway has been written to it and no call is in flight. s.smu must be held.
+func (s *Server) closeIfIdle(c *Conn, sc *servedConn) {
+	if sc.goneAway && sc.calls == 0 && !sc.closed {
+		sc.closed = true
+		_ = c.Close()
+	}
+}
+
+func (s *Server) dispatch(ctx context.Context, c replier, msg *Message) {
+	if batch, ok := msg.Body.(Batch); ok {
+		s.dispatchBatch(ctx, c, msg, batch)
+		return
+	}
+	kind := procedureKind(msg.Body)
+	out, err := s.call(ctx, msg)
+	if kind == Notify {
+		if err != nil {
+			s.reportError(err)
+		}
+		return
+	}
+	opts := &EncodeProcedureOpts{TransactionID: msg.Header.TransactionID, Checksum: msg.Header.HasFlag(FChecksum)}
+	if err != nil {
+		header := Header{Flags: FError, TransactionID: opts.TransactionID}
+		if opts.Checksum {
+			header.SetFlag(FChecksum)
+		}
+		s.reportError(c.Send(&Message{Header: header, Body: err.Error()}))
+		return
+	}
+	s.reportError(c.SendProcedure(out, Response, opts))
+}
+
+// dispatchBatch dispatches the entries of a batch concurrently, and responds with a batch of the responses in the same
+// order. Notifications are left out of the response, and no response is sent if the batch only holds notifications.
+func (s *Server) dispatchBatch(ctx context.Context, c replier, msg *Message, batch Batch) {
+	var (
+		wg      sync.WaitGroup
+		results = make(Batch, len(batch))
+	)
+	for i, entry := range batch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = BatchEntry{
+				Kind:          Response,
+				ProcedureID:   entry.ProcedureID,
+				TransactionID: entry.TransactionID,
+				Err:           entry.Err,
+			}
+			if entry.Err != nil {
+				return
+			}
+			out, err := s.call(ctx, &Message{
+				Header: Header{Flags: FProcedure, Type: entry.ProcedureID, TransactionID: entry.TransactionID},
+				Body:   entry.Procedure,
+			})
+			if entry.Kind == Notify {
+				results[i].Kind = Notify
+				if err != nil {
+					s.reportError(err)
+				}
+				return
+			}
+			results[i].Procedure = out
+			results[i].Err = err
+		}()
+	}
+	wg.Wait()
+
+	res := results[:0]
+	for _, entry := range results {
+		if entry.Kind != Notify {
+			res = append(res, entry)
+		}
+	}
+	if len(res) == 0 {
+		return
+	}
+	s.reportError(c.SendBatch(res, &EncodeProcedureOpts{
+		TransactionID: msg.Header.TransactionID,
+		Checksum:      msg.Header.HasFlag(FChecksum),
+	}))
+}
+
+func (s *Server) call(ctx context.Context, msg *Message) (any, error) {
+	kind := procedureKind(msg.Body)
+	if kind != Call && kind != Notify {
+		return nil, errors.New(fmt.Sprintf("unexpected procedure kind %s", kind))
+	}
+	info := newCallInfo(&msg.Header, msg.Body, kind)
+	if kind == Notify {
+		return nil, chainNotify(s.opts.NotifyInterceptors, info, func(ctx context.Context, p any) error {
+			_, err := s.handle(ctx, p)
+			return err
+		})(ctx, msg.Body)
+	}
+	return chainUnary(s.opts.UnaryInterceptors, info, s.handle)(ctx, msg.Body)
+}
+
+func (s *Server) handle(ctx context.Context, p any) (any, error) {
+	id, err := GetProcedureID(p)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	h, ok := s.handlers[id]
+	s.mu.RUnlock()
+	if ok {
+		return h(ctx, p)
+	}
+	return nil, errors.New(fmt.Sprintf("no handler for procedure %s", reflect.TypeOf(p)))
+}
+
+// handles reports whether s has a handler for procedure id.
+func (s *Server) handles(id ID) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.handlers[id]
+	return ok
+}
+
+// ReportError passes err to ServerOpts.OnError, for errors of connections served outside of Serve, such as the error
+// returned by ServeConn. Nil errors are ignored.
+func (s *Server) ReportError(err error) {
+	s.reportError(err)
+}
+
+// reportError passes err to ServerOpts.OnError. Nil errors are ignored.
+func (s *Server) reportError(err error) {
+	if err != nil && s.opts.OnError != nil {
+		s.opts.OnError(err)
+	}
+}
@@ -0,0 +1,393 @@
+package bisp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+type TestProcedureAdd struct {
+	bisp.Procedure[int]
+	A int
+	B int
+}
+
+type TestProcedureFail struct {
+	bisp.Procedure[string]
+	Reason string
+}
+
+type TestNotificationMetric struct {
+	bisp.Notification
+	Name  string
+	Value float64
+}
+
+// handleTestProcedures registers the handlers of the test procedures and functions on srv.
+func handleTestProcedures(srv *bisp.Server) {
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureAdd) error {
+		p.Out = p.A + p.B
+		return nil
+	})
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureFail) error {
+		return errors.New(p.Reason)
+	})
+	bisp.HandleFunc(srv, "DivMod", testFuncDivMod, testFuncDivModOpts)
+	bisp.HandleFunc(srv, "Concat", testFuncConcat, nil)
+}
+
+func newTestServer(t *testing.T, opts *bisp.ServerOpts) (*bisp.Server, net.Conn) {
+	srv := bisp.NewServer(opts)
+	handleTestProcedures(srv)
+	client, server := net.Pipe()
+	go func() {
+		_ = srv.ServeConn(server)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return srv, client
+}
+
+func TestServer_Call(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	client := bisp.NewClient(conn, nil)
+
+	res, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: 40, B: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, bisp.Response, res.Kind)
+	assert.Equal(t, 42, res.Out)
+}
+
+func TestServer_CallError(t *testing.T) {
+	_, conn := newTestServer(t, nil)
+	client := bisp.NewClient(conn, nil)
+
+	_, err := bisp.CallProcedure(context.Background(), client, TestProcedureFail{Reason: "boom"})
+	assert.EqualError(t, err, "boom")
+}
+
+func TestServer_Notify(t *testing.T) {
+	received := make(chan TestNotificationMetric, 1)
+	srv, conn := newTestServer(t, nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestNotificationMetric) error {
+		received <- *p
+		return nil
+	})
+	client := bisp.NewClient(conn, nil)
+
+	err := bisp.NotifyProcedure(context.Background(), client, TestNotificationMetric{Name: "requests", Value: 1.5})
+	assert.NoError(t, err)
+	select {
+	case p := <-received:
+		assert.Equal(t, bisp.Notify, p.Kind)
+		assert.Equal(t, "requests", p.Name)
+		assert.Equal(t, 1.5, p.Value)
+	case <-time.After(time.Second):
+		t.Fatal("notification not dispatched")
+	}
+}
+
+func TestServer_NotifyError(t *testing.T) {
+	errs := make(chan error, 1)
+	_, conn := newTestServer(t, &bisp.ServerOpts{
+		OnError: func(err error) {
+			errs <- err
+		},
+	})
+	client := bisp.NewClient(conn, nil)
+
+	err := bisp.NotifyProcedure(context.Background(), client, TestProcedureFail{Reason: "boom"})
+	assert.NoError(t, err)
+	select {
+	case err = <-errs:
+		assert.EqualError(t, err, "boom")
+	case <-time.After(time.Second):
+		t.Fatal("notification error not reported")
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := bisp.NewServer(nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureWait) error {
+		close(started)
+		<-release
+		p.Out = p.Name
+		return nil
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	client := bisp.NewClient(conn, nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := make(chan string, 1)
+	go func() {
+		res, err := bisp.CallProcedure(ctx, client, TestProcedureWait{Name: "in flight"})
+		assert.NoError(t, err)
+		results <- res.Out
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	assert.ErrorIs(t, <-served, bisp.ErrServerClosed)
+	assert.Eventually(t, func() bool {
+		_, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+		return errors.Is(err, bisp.ErrGoingAway)
+	}, time.Second, time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown before the call in flight was handled")
+	default:
+	}
+
+	close(release)
+	assert.Equal(t, "in flight", <-results)
+	assert.NoError(t, <-shutdown)
+	_, err = bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+	assert.ErrorIs(t, err, bisp.ErrGoingAway)
+	assert.ErrorIs(t, srv.Serve(l), bisp.ErrServerClosed)
+}
+
+func TestServer_ShutdownConcurrentCalls(t *testing.T) {
+	const callers = 8
+	for range 20 {
+		var handled atomic.Int64
+		srv := bisp.NewServer(nil)
+		bisp.Handle(srv, func(ctx context.Context, p *TestProcedureAdd) error {
+			handled.Add(1)
+			p.Out = p.A + p.B
+			return nil
+		})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go func() {
+			_ = srv.Serve(l)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var (
+			wg    sync.WaitGroup
+			calls atomic.Int64
+		)
+		for range callers {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			assert.NoError(t, err)
+			client := bisp.NewClient(conn, nil)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer client.Close()
+				// Every call is either answered, or not sent because the server is going away. Calls sent before the client
+				// received ControlGoAway fail unhandled when the server closes the idle connection.
+				for {
+					res, err := bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+					if err != nil {
+						if !errors.Is(err, bisp.ErrGoingAway) {
+							assert.ErrorIs(t, err, bisp.ErrClientClosed)
+						}
+						return
+					}
+					assert.Equal(t, 3, res.Out)
+					calls.Add(1)
+				}
+			}()
+		}
+		assert.Eventually(t, func() bool {
+			return calls.Load() >= callers
+		}, time.Second, time.Millisecond)
+		assert.NoError(t, srv.Shutdown(ctx))
+		wg.Wait()
+		assert.Equal(t, calls.Load(), handled.Load())
+		cancel()
+	}
+}
+
+func TestServer_ShutdownIdle(t *testing.T) {
+	srv, conn := newTestServer(t, nil)
+	// The peer reads ControlGoAway but never closes the connection.
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, conn)
+		read <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Shutdown(ctx))
+	assert.NoError(t, ctx.Err())
+	select {
+	case err := <-read:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+// writeSignalConn closes writing on its first write once armed is set.
+type writeSignalConn struct {
+	net.Conn
+	armed   atomic.Bool
+	once    sync.Once
+	writing chan struct{}
+}
+
+func (c *writeSignalConn) Write(p []byte) (int, error) {
+	if c.armed.Load() {
+		c.once.Do(func() {
+			close(c.writing)
+		})
+	}
+	return c.Conn.Write(p)
+}
+
+func TestServer_ShutdownIdleLateCall(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := bisp.NewServer(nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureWait) error {
+		if p.Name == "late" {
+			close(started)
+			<-release
+		}
+		p.Out = p.Name
+		return nil
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	sc := &writeSignalConn{Conn: server, writing: make(chan struct{})}
+	go func() {
+		_ = srv.ServeConn(sc)
+	}()
+	conn := bisp.NewConn(client, nil)
+	opts := &bisp.EncodeProcedureOpts{TransactionID: bisp.TransactionID(make([]byte, bisp.TransactionIDSize))}
+	// A first call makes sure the connection is served before Shutdown.
+	assert.NoError(t, conn.SendProcedure(TestProcedureWait{Name: "served"}, bisp.Call, opts))
+	_, err := conn.Receive()
+	assert.NoError(t, err)
+	sc.armed.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	// The server is idle when it starts writing ControlGoAway, and the call is sent before the client reads it.
+	<-sc.writing
+	assert.NoError(t, conn.SendProcedure(TestProcedureWait{Name: "late"}, bisp.Call, opts))
+	<-started
+
+	responses := make(chan *bisp.Message, 1)
+	go func() {
+		msg, err := conn.Receive()
+		assert.NoError(t, err)
+		responses <- msg
+	}()
+	assert.Eventually(t, conn.GoingAway, time.Second, time.Millisecond)
+	select {
+	case err = <-shutdown:
+		t.Fatalf("shutdown returned (%v) while a call was in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	msg := <-responses
+	if assert.NotNil(t, msg) {
+		res, ok := msg.Body.(TestProcedureWait)
+		assert.True(t, ok)
+		assert.Equal(t, "late", res.Out)
+	}
+	assert.NoError(t, <-shutdown)
+}
+
+// closeErrListener fails to close.
+type closeErrListener struct {
+	net.Listener
+}
+
+func (l closeErrListener) Close() error {
+	_ = l.Listener.Close()
+	return errors.New("close failed")
+}
+
+func TestServer_ShutdownOnError(t *testing.T) {
+	var srv *bisp.Server
+	errs := make(chan error, 2)
+	srv = bisp.NewServer(&bisp.ServerOpts{
+		OnError: func(err error) {
+			// OnError may call back into the server.
+			errs <- errors.Join(err, srv.Serve(nil))
+		},
+	})
+	handleTestProcedures(srv)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(closeErrListener{l})
+	}()
+	// A call is answered once Serve is accepting connections.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	client := bisp.NewClient(conn, nil)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = bisp.CallProcedure(ctx, client, TestProcedureAdd{A: 1, B: 2})
+	assert.NoError(t, err)
+
+	assert.NoError(t, srv.Shutdown(ctx))
+	assert.ErrorIs(t, <-served, bisp.ErrServerClosed)
+	err = <-errs
+	assert.ErrorContains(t, err, "close failed")
+	assert.ErrorIs(t, err, bisp.ErrServerClosed)
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	srv, conn := newTestServer(t, nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureWait) error {
+		close(started)
+		<-release
+		return nil
+	})
+	client := bisp.NewClient(conn, nil)
+	calls := make(chan error, 1)
+	go func() {
+		_, err := bisp.CallProcedure(context.Background(), client, TestProcedureWait{})
+		calls <- err
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, <-calls, bisp.ErrClientClosed)
+}
+
+func init() {
+	bisp.RegisterProcedure[TestProcedureAdd]()
+	bisp.RegisterProcedure[TestProcedureFail]()
+	bisp.RegisterProcedure[TestNotificationMetric]()
+}
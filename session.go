@@ -0,0 +1,518 @@
+package bisp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// DefaultChunkSize is the maximum size of the data frames of Session streams when SessionOpts.ChunkSize is not set,
+// and of the frames written by Encoder.EncodeStream when EncoderOpts.ChunkSize is not set.
+const DefaultChunkSize = 16 * 1024
+
+// DefaultAcceptBacklog is the number of streams waiting for Session.Accept when SessionOpts.AcceptBacklog is not set.
+const DefaultAcceptBacklog = 16
+
+// StreamWindow is the number of bytes that can be written to a Session stream before the peer reads them. Each side of
+// a stream starts with this much credit, and the reading side grants more with ControlStreamWindow frames as it reads.
+const StreamWindow = 256 * 1024
+
+var ErrSessionClosed = errors.New("session closed")
+
+// ErrStreamWindowExceeded is returned by the reads and writes of a stream reset because the peer wrote more than its
+// credit.
+var ErrStreamWindowExceeded = errors.New("stream window exceeded")
+
+type SessionOpts struct {
+	// Server makes streams opened with Open use even IDs, leaving odd IDs to the peer. Set it on exactly one side of the
+	// connection, usually the side that accepted it.
+	Server bool
+	// ChunkSize is the maximum size of the data frames writes to a stream are split into. Smaller chunks interleave
+	// streams more finely. Zero means DefaultChunkSize.
+	ChunkSize int
+	// AcceptBacklog is the number of streams opened by the peer that can wait for Accept. Streams opened beyond it are
+	// closed. Zero means DefaultAcceptBacklog.
+	AcceptBacklog int
+	// ConnOpts holds the options of the Conn the session is built on, such as heartbeats. The decoder limits also apply
+	// to the decoders of the streams.
+	ConnOpts *ConnOpts
+	// StreamInterceptors are called in order around the handlers of streams run by Serve and Run.
+	StreamInterceptors []StreamInterceptor
+	// OnError is called with the errors returned by the handlers of streams accepted by Serve.
+	OnError func(err error)
+}
+
+// Session multiplexes streams over a single connection. Data written to a stream is split into chunks sent as
+// ControlStreamData frames, so a large message on one stream doesn't hold back the others. Writes to a stream block
+// once StreamWindow bytes are buffered unread by the peer.
+type Session struct {
+	conn    *Conn
+	opts    SessionOpts
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	peerID  uint32
+	accept  chan *Stream
+	once    sync.Once
+	err     error
+	connErr error
+	done    chan struct{}
+	// credit holds the credit granted by the read loop and not yet sent, by stream. A single goroutine sends it while
+	// granting is set.
+	cmu      sync.Mutex
+	credit   map[uint32]int
+	granting bool
+}
+
+// NewSession returns a Session multiplexing streams over conn. The session reads from conn until it is closed.
+func NewSession(conn net.Conn, opts *SessionOpts) *Session {
+	s := &Session{
+		streams: make(map[uint32]*Stream, 16),
+		credit:  make(map[uint32]int, 16),
+		nextID:  1,
+		done:    make(chan struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.ChunkSize <= 0 {
+		s.opts.ChunkSize = DefaultChunkSize
+	}
+	s.opts.ChunkSize = min(s.opts.ChunkSize, MaxTcpMessageBodySize)
+	if s.opts.AcceptBacklog <= 0 {
+		s.opts.AcceptBacklog = DefaultAcceptBacklog
+	}
+	if s.opts.Server {
+		s.nextID = 2
+	}
+	s.accept = make(chan *Stream, s.opts.AcceptBacklog)
+	s.conn = NewConn(conn, s.opts.ConnOpts)
+	s.conn.onFrame = s.handleFrame
+	go s.readLoop()
+	return s
+}
+
+// Open opens a new stream, which the peer receives from Accept.
+func (s *Session) Open() (*Stream, error) {
+	var st *Stream
+	// The write lock is held while the ID is assigned, so the peer sees streams opened in the order of their IDs.
+	err := s.conn.write(func(enc *Encoder) error {
+		s.mu.Lock()
+		if s.err != nil {
+			s.mu.Unlock()
+			return s.err
+		}
+		st = newStream(s, s.nextID)
+		s.streams[st.id] = st
+		s.nextID += 2
+		s.mu.Unlock()
+		return enc.encodeFrame(&Header{Flags: FControl, Extensions: ExtStream, StreamID: st.id}, ControlStreamOpen, nil)
+	})
+	if err != nil {
+		if st != nil {
+			s.release(st)
+		}
+		if cause := s.closeErr(); cause != nil {
+			return nil, cause
+		}
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+// Serve accepts streams opened by the peer, and runs h over each of them in a new goroutine, through the
+// StreamInterceptors. Every stream is closed once its handler returns. Serve returns the error the session was closed
+// with, once every handler has returned.
+func (s *Session) Serve(ctx context.Context, h StreamHandler) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.run(ctx, st, false, h); err != nil && s.opts.OnError != nil {
+				s.opts.OnError(err)
+			}
+		}()
+	}
+}
+
+// Run opens a new stream and runs h over it, through the StreamInterceptors. The stream is closed once h returns, and
+// its error returned.
+func (s *Session) Run(ctx context.Context, h StreamHandler) error {
+	st, err := s.Open()
+	if err != nil {
+		return err
+	}
+	return s.run(ctx, st, true, h)
+}
+
+func (s *Session) run(ctx context.Context, st *Stream, opened bool, h StreamHandler) error {
+	info := &StreamInfo{ID: st.id, Opened: opened}
+	err := chainStream(s.opts.StreamInterceptors, info, h)(ctx, st)
+	// Closing fails once the session is closed, which the handler has seen already.
+	if cerr := st.Close(); err == nil && s.closeErr() == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close closes the connection and all streams.
+func (s *Session) Close() error {
+	s.fail(ErrSessionClosed)
+	return s.connErr
+}
+
+func (s *Session) fail(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := make([]*Stream, 0, len(s.streams))
+		for _, st := range s.streams {
+			streams = append(streams, st)
+		}
+		s.mu.Unlock()
+		for _, st := range streams {
+			st.fail(err)
+		}
+		s.connErr = s.conn.Close()
+		close(s.done)
+	})
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) writeFrame(h *Header, typeID ID, body []byte) error {
+	err := s.conn.write(func(enc *Encoder) error {
+		return enc.encodeFrame(h, typeID, body)
+	})
+	if err != nil {
+		if cause := s.closeErr(); cause != nil {
+			return cause
+		}
+	}
+	return err
+}
+
+// sendWindow grants the peer n bytes of credit on stream id.
+func (s *Session) sendWindow(id uint32, n int) error {
+	var body [4]byte
+	binary.BigEndian.PutUint32(body[:], uint32(n))
+	return s.writeFrame(&Header{Flags: FControl, Extensions: ExtStream, StreamID: id}, ControlStreamWindow, body[:])
+}
+
+// goSendWindow is sendWindow for the read loop. The frame is sent from another goroutine, so the read loop doesn't
+// block on a peer that is itself blocked writing. Credit granted while frames are being sent is added up, and sent
+// with a single frame per stream.
+func (s *Session) goSendWindow(id uint32, n int) {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	s.credit[id] += n
+	if !s.granting {
+		s.granting = true
+		go s.grant()
+	}
+}
+
+// grant sends the credit added by goSendWindow until none is left.
+func (s *Session) grant() {
+	for {
+		s.cmu.Lock()
+		if len(s.credit) == 0 {
+			s.granting = false
+			s.cmu.Unlock()
+			return
+		}
+		credit := s.credit
+		s.credit = make(map[uint32]int, len(credit))
+		s.cmu.Unlock()
+		for id, n := range credit {
+			_ = s.sendWindow(id, n)
+		}
+	}
+}
+
+// readLoop reads from the connection until it fails. Stream frames are handled by handleFrame as they are read.
+func (s *Session) readLoop() {
+	for {
+		if _, err := s.conn.Receive(); err != nil {
+			s.fail(errors.Join(ErrSessionClosed, err))
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(h *Header, body []byte) {
+	if !h.HasExtension(ExtStream) {
+		return
+	}
+	switch h.Type {
+	case ControlStreamOpen:
+		s.open(h.StreamID)
+	case ControlStreamData, ControlStreamClose, ControlStreamWindow:
+		s.mu.Lock()
+		st, ok := s.streams[h.StreamID]
+		s.mu.Unlock()
+		switch {
+		case !ok:
+			if h.Type == ControlStreamData {
+				// The credit of data written to a stream that is gone is returned, so the writer doesn't block.
+				s.goSendWindow(h.StreamID, len(body))
+			}
+		case h.Type == ControlStreamData:
+			st.push(body)
+		case h.Type == ControlStreamClose:
+			st.closeRead()
+		case len(body) == 4:
+			st.addCredit(int(binary.BigEndian.Uint32(body)))
+		}
+	}
+}
+
+// open adds a stream opened by the peer, and queues it for Accept. Streams are closed if the backlog is full.
+func (s *Session) open(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || id%2 == s.nextID%2 || id <= s.peerID {
+		return
+	}
+	s.peerID = id
+	st := newStream(s, id)
+	select {
+	case s.accept <- st:
+		s.streams[id] = st
+	default:
+		go func() {
+			_ = st.CloseWrite()
+		}()
+	}
+}
+
+func (s *Session) release(st *Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, st.id)
+}
+
+// Stream is a logical stream of a Session. It has its own Encoder and Decoder, used like those of a connection.
+type Stream struct {
+	id      uint32
+	session *Session
+	enc     *Encoder
+	dec     *Decoder
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	// credit is the number of bytes that can be written before the peer grants more, and read the number of bytes read
+	// since credit was last granted to the peer.
+	credit int
+	read   int
+	// rclosed is set when the peer closed its side, wclosed when CloseWrite is called, and closed when Close is called.
+	rclosed bool
+	wclosed bool
+	closed  bool
+	err     error
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		id:      id,
+		session: s,
+		credit:  StreamWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	opts := s.conn.opts.Decoder
+	opts.Sync = false
+	st.enc = NewEncoder(st)
+	st.dec = NewDecoderWithOpts(st, &opts)
+	return st
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Encoder() *Encoder {
+	return st.enc
+}
+
+func (st *Stream) Decoder() *Decoder {
+	return st.dec
+}
+
+// Read reads data written to the stream by the peer. It returns io.EOF once the peer has closed the stream and all
+// data is read.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 && !st.rclosed && !st.closed && st.err == nil {
+		st.cond.Wait()
+	}
+	var (
+		n     int
+		err   error
+		grant int
+	)
+	switch {
+	case st.closed:
+		err = net.ErrClosed
+	case st.buf.Len() > 0:
+		n, _ = st.buf.Read(p)
+		st.read += n
+		// Credit is granted back in batches, once half the window is read.
+		if st.read >= StreamWindow/2 {
+			grant, st.read = st.read, 0
+		}
+	case st.err != nil:
+		err = st.err
+	default:
+		err = io.EOF
+	}
+	st.mu.Unlock()
+	if grant > 0 {
+		_ = st.session.sendWindow(st.id, grant)
+	}
+	return n, err
+}
+
+// Write splits p into chunks of at most SessionOpts.ChunkSize, each sent as a separate frame. It blocks while the peer
+// has StreamWindow bytes of the stream unread.
+func (st *Stream) Write(p []byte) (int, error) {
+	st.mu.Lock()
+	closed := st.wclosed || st.closed
+	st.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	header := Header{Flags: FControl, Extensions: ExtStream, StreamID: st.id}
+	n := 0
+	for n < len(p) {
+		st.mu.Lock()
+		for st.credit == 0 && !st.wclosed && !st.closed && st.err == nil {
+			st.cond.Wait()
+		}
+		if st.wclosed || st.closed {
+			st.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return n, err
+		}
+		size := min(len(p)-n, st.session.opts.ChunkSize, st.credit)
+		st.credit -= size
+		st.mu.Unlock()
+		if err := st.session.writeFrame(&header, ControlStreamData, p[n:n+size]); err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// CloseWrite closes the writing side of the stream. The peer reads io.EOF once it has read the data written before,
+// and can still write to the stream.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.wclosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.wclosed = true
+	release := st.rclosed
+	st.mu.Unlock()
+	if release {
+		st.session.release(st)
+	}
+	return st.session.writeFrame(&Header{Flags: FControl, Extensions: ExtStream, StreamID: st.id}, ControlStreamClose, nil)
+}
+
+// Close closes both sides of the stream. Data the peer writes after Close is discarded.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	st.closed = true
+	discarded := st.buf.Len() + st.read
+	st.buf.Reset()
+	st.read = 0
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	// The credit of discarded data is returned, so the peer doesn't block writing.
+	if discarded > 0 {
+		_ = st.session.sendWindow(st.id, discarded)
+	}
+	err := st.CloseWrite()
+	st.session.release(st)
+	return err
+}
+
+// push buffers data written by the peer. A peer writing more than its credit resets the stream: the buffered data is
+// discarded, and reads and writes fail with ErrStreamWindowExceeded.
+func (st *Stream) push(data []byte) {
+	st.mu.Lock()
+	if st.closed || st.err != nil {
+		st.mu.Unlock()
+		st.session.goSendWindow(st.id, len(data))
+		return
+	}
+	if st.buf.Len()+st.read+len(data) > StreamWindow {
+		st.err = ErrStreamWindowExceeded
+		st.buf.Reset()
+		st.read = 0
+		st.cond.Broadcast()
+		st.mu.Unlock()
+		go func() {
+			_ = st.CloseWrite()
+		}()
+		return
+	}
+	st.buf.Write(data)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) addCredit(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.credit += n
+	st.cond.Broadcast()
+}
+
+func (st *Stream) closeRead() {
+	st.mu.Lock()
+	st.rclosed = true
+	release := st.wclosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if release {
+		st.session.release(st)
+	}
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.err = err
+	st.cond.Broadcast()
+}
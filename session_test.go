@@ -0,0 +1,279 @@
+package bisp_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSessions(t *testing.T, opts *bisp.SessionOpts) (*bisp.Session, *bisp.Session) {
+	client, server := net.Pipe()
+	clientOpts := bisp.SessionOpts{}
+	if opts != nil {
+		clientOpts = *opts
+	}
+	serverOpts := clientOpts
+	serverOpts.Server = true
+	cs := bisp.NewSession(client, &clientOpts)
+	ss := bisp.NewSession(server, &serverOpts)
+	t.Cleanup(func() {
+		cs.Close()
+		ss.Close()
+	})
+	return cs, ss
+}
+
+func TestSession_Streams(t *testing.T) {
+	cs, ss := newTestSessions(t, nil)
+
+	names := []string{"control", "bulk", "events"}
+	for _, name := range names {
+		st, err := cs.Open()
+		assert.NoError(t, err)
+		assert.NoError(t, st.Encoder().Encode(&bisp.Message{Body: name}))
+	}
+	for _, name := range names {
+		st, err := ss.Accept()
+		assert.NoError(t, err)
+		var msg bisp.Message
+		assert.NoError(t, st.Decoder().Decode(&msg))
+		assert.Equal(t, name, msg.Body)
+
+		// Respond on the same stream.
+		assert.NoError(t, st.Encoder().Encode(&bisp.Message{Body: strings.ToUpper(name)}))
+	}
+
+	st, err := ss.Open()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), st.ID()%2)
+}
+
+func TestSession_Chunks(t *testing.T) {
+	cs, ss := newTestSessions(t, &bisp.SessionOpts{ChunkSize: 512})
+	bulk, err := cs.Open()
+	assert.NoError(t, err)
+	events, err := cs.Open()
+	assert.NoError(t, err)
+
+	large := strings.Repeat("a", bisp.MaxTcpMessageBodySize*2)
+	go func() {
+		assert.NoError(t, bulk.Encoder().Encode(&bisp.Message{Header: bisp.Header{Flags: bisp.F32b}, Body: large}))
+		assert.NoError(t, bulk.CloseWrite())
+	}()
+	go func() {
+		assert.NoError(t, events.Encoder().Encode(&bisp.Message{Body: "event"}))
+	}()
+
+	streams := make(map[uint32]*bisp.Stream, 2)
+	for range 2 {
+		st, err := ss.Accept()
+		assert.NoError(t, err)
+		streams[st.ID()] = st
+	}
+	var msg bisp.Message
+	assert.NoError(t, streams[events.ID()].Decoder().Decode(&msg))
+	assert.Equal(t, "event", msg.Body)
+	assert.NoError(t, streams[bulk.ID()].Decoder().Decode(&msg))
+	assert.Equal(t, large, msg.Body)
+	_, err = streams[bulk.ID()].Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestSession_Close(t *testing.T) {
+	cs, ss := newTestSessions(t, nil)
+	st, err := cs.Open()
+	assert.NoError(t, err)
+	_, err = st.Write([]byte("hello"))
+	assert.NoError(t, err)
+	peer, err := ss.Accept()
+	assert.NoError(t, err)
+
+	assert.NoError(t, st.Close())
+	_, err = st.Write([]byte("hello"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	b, err := io.ReadAll(peer)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ss.Accept()
+		accepted <- err
+	}()
+	assert.NoError(t, cs.Close())
+	select {
+	case err = <-accepted:
+		assert.ErrorIs(t, err, bisp.ErrSessionClosed)
+	case <-time.After(time.Second):
+		t.Fatal("accept not unblocked by close")
+	}
+	_, err = cs.Open()
+	assert.ErrorIs(t, err, bisp.ErrSessionClosed)
+}
+
+func TestSession_Window(t *testing.T) {
+	cs, ss := newTestSessions(t, nil)
+	st, err := cs.Open()
+	assert.NoError(t, err)
+	peer, err := ss.Accept()
+	assert.NoError(t, err)
+
+	data := []byte(strings.Repeat("a", bisp.StreamWindow*3))
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		if err == nil {
+			err = st.CloseWrite()
+		}
+		written <- err
+	}()
+	select {
+	case err = <-written:
+		t.Fatalf("write beyond the window not blocked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b, err := io.ReadAll(peer)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), len(b))
+	select {
+	case err = <-written:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write not unblocked by reads")
+	}
+}
+
+func TestSession_WindowClosed(t *testing.T) {
+	cs, ss := newTestSessions(t, nil)
+	st, err := cs.Open()
+	assert.NoError(t, err)
+	peer, err := ss.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Close())
+
+	// Data written to a closed stream is discarded, and its credit returned.
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(make([]byte, bisp.StreamWindow*3))
+		written <- err
+	}()
+	select {
+	case err = <-written:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write to a closed stream blocked")
+	}
+}
+
+func TestSession_WindowCoalesced(t *testing.T) {
+	client, server := net.Pipe()
+	session := bisp.NewSession(server, &bisp.SessionOpts{Server: true})
+	t.Cleanup(func() { session.Close() })
+
+	// The credit of data written to unknown streams is returned, with the credit granted while nothing reads it added
+	// up in a single frame.
+	var enc bisp.Encoder
+	for range 100 {
+		h := &bisp.Header{Flags: bisp.FControl, Extensions: bisp.ExtStream, StreamID: 7}
+		header, err := enc.EncodeHeader(h, bisp.ControlStreamData, 10)
+		assert.NoError(t, err)
+		_, err = client.Write(append(header, make([]byte, 10)...))
+		assert.NoError(t, err)
+	}
+	frames, credit := 0, 0
+	for credit < 1000 {
+		assert.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+		frame := make([]byte, 15)
+		_, err := io.ReadFull(client, frame)
+		if !assert.NoError(t, err) {
+			break
+		}
+		h, err := bisp.NewDecoder(bytes.NewReader(frame)).DecodeHeader()
+		assert.NoError(t, err)
+		assert.Equal(t, bisp.ControlStreamWindow, h.Type)
+		assert.Equal(t, uint32(7), h.StreamID)
+		credit += int(binary.BigEndian.Uint32(frame[11:]))
+		frames++
+	}
+	assert.Equal(t, 1000, credit)
+	assert.Less(t, frames, 10)
+}
+
+func TestSession_StreamInterceptors(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		infos []bisp.StreamInfo
+	)
+	record := func(ctx context.Context, info *bisp.StreamInfo, st *bisp.Stream, next bisp.StreamHandler) error {
+		mu.Lock()
+		infos = append(infos, *info)
+		mu.Unlock()
+		return next(ctx, st)
+	}
+	errs := make(chan error, 1)
+	cs, ss := newTestSessions(t, &bisp.SessionOpts{
+		StreamInterceptors: []bisp.StreamInterceptor{bisp.RecoverStream(), record},
+		OnError: func(err error) {
+			errs <- err
+		},
+	})
+	served := make(chan error, 1)
+	go func() {
+		served <- ss.Serve(context.Background(), func(ctx context.Context, st *bisp.Stream) error {
+			var msg bisp.Message
+			if err := st.Decoder().Decode(&msg); err != nil {
+				return err
+			}
+			if msg.Body == "panic" {
+				panic("boom")
+			}
+			return st.Encoder().Encode(&bisp.Message{Body: strings.ToUpper(msg.Body.(string))})
+		})
+	}()
+
+	err := cs.Run(context.Background(), func(ctx context.Context, st *bisp.Stream) error {
+		assert.NoError(t, st.Encoder().Encode(&bisp.Message{Body: "hello"}))
+		var msg bisp.Message
+		assert.NoError(t, st.Decoder().Decode(&msg))
+		assert.Equal(t, "HELLO", msg.Body)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// A panicking handler is recovered, and its error reported.
+	err = cs.Run(context.Background(), func(ctx context.Context, st *bisp.Stream) error {
+		return st.Encoder().Encode(&bisp.Message{Body: "panic"})
+	})
+	assert.NoError(t, err)
+	select {
+	case err = <-errs:
+		assert.ErrorContains(t, err, "panicked: boom")
+	case <-time.After(time.Second):
+		t.Fatal("handler error not reported")
+	}
+
+	assert.NoError(t, cs.Close())
+	assert.ErrorIs(t, <-served, bisp.ErrSessionClosed)
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, infos, 4) {
+		var opened int
+		for _, info := range infos {
+			if info.Opened {
+				opened++
+				assert.Equal(t, uint32(1), info.ID%2)
+			}
+		}
+		assert.Equal(t, 2, opened)
+	}
+}
@@ -3,6 +3,7 @@ package bisp
 import (
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 )
 
@@ -27,6 +28,7 @@ var (
 	tFloat64 = reflect.TypeOf(float64(0))
 	tBool    = reflect.TypeOf(false)
 	tString  = reflect.TypeOf("")
+	tReader  = reflect.TypeOf((*io.Reader)(nil)).Elem()
 )
 
 func RegisterType(value interface{}) ID {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"github.com/sindrebakk1/bisp"
+	"io"
 	"reflect"
 )
 
@@ -194,6 +195,16 @@ type testStructEmbeddedStruct struct {
 	B string
 }
 
+type testStructReaderField struct {
+	Name string
+	Data io.Reader
+}
+
+type testStructReaderFieldFirst struct {
+	Data io.Reader
+	Name string
+}
+
 type testStructPrivateFields struct {
 	a int
 	b string
@@ -223,4 +234,6 @@ func init() {
 	bisp.RegisterType(testStructEmbeddedPrivateStruct{})
 	bisp.RegisterType(testStructEmbeddedStruct{})
 	bisp.RegisterType(testStructPrivateFields{})
+	bisp.RegisterType(testStructReaderField{})
+	bisp.RegisterType(testStructReaderFieldFirst{})
 }
@@ -0,0 +1,301 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Opcodes of the frames of RFC 6455.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes of RFC 6455.
+const (
+	CloseNormal          = 1000
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+)
+
+const (
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+	// maxControlPayload is the maximum payload length of control frames.
+	maxControlPayload = 125
+	// closeTimeout is how long writing a close frame may take, so closing doesn't block on a peer that stopped reading.
+	closeTimeout = time.Second
+)
+
+// ErrProtocol is returned by Read when the peer violates RFC 6455. The connection is closed with CloseProtocolError.
+var ErrProtocol = errors.New("websocket protocol error")
+
+// Conn is a WebSocket connection carrying binary messages. Every call to Write sends a single message, and Read reads
+// the payloads of the received messages as a stream. As a bisp.Encoder writes every frame in a single Write, each
+// message carries exactly one bisp frame.
+//
+// Pings are answered by Read, so a goroutine must be reading for the connection to stay alive.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool
+
+	rmu sync.Mutex
+	// remaining is the length of the payload of the current frame left to read, and inMessage is set while a
+	// fragmented message continues in the next frame.
+	remaining uint64
+	inMessage bool
+	mask      [4]byte
+	maskPos   int
+	rerr      error
+
+	wmu    sync.Mutex
+	closed bool
+
+	// dmu guards writeDeadline, the write deadline set with SetDeadline or SetWriteDeadline, which is restored once a
+	// close frame has been written.
+	dmu           sync.Mutex
+	writeDeadline time.Time
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:   conn,
+		br:     br,
+		client: client,
+	}
+}
+
+// Read reads the payloads of binary messages. It returns io.EOF once the peer has closed the connection.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.remaining == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.rerr = err
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.rerr = err
+	}
+	return n, err
+}
+
+// nextFrame reads the header of the next data frame, handling the control frames before it.
+func (c *Conn) nextFrame() error {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			return err
+		}
+		fin := head[0]&finBit != 0
+		opcode := head[0] & 0x0F
+		if head[0]&rsvBits != 0 {
+			return c.fail(CloseProtocolError, "reserved bits set")
+		}
+		// Frames sent by clients are masked, and frames sent by servers are not.
+		if masked := head[1]&maskBit != 0; masked == c.client {
+			return c.fail(CloseProtocolError, "invalid frame mask")
+		}
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+			if length>>63 != 0 {
+				return c.fail(CloseProtocolError, "invalid payload length")
+			}
+		}
+		c.maskPos = 0
+		if !c.client {
+			if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+				return err
+			}
+		}
+
+		switch opcode {
+		case opBinary, opContinuation:
+			if (opcode == opBinary) == c.inMessage {
+				return c.fail(CloseProtocolError, "unexpected continuation")
+			}
+			c.inMessage = !fin
+			c.remaining = length
+			return nil
+		case opText:
+			return c.fail(CloseUnsupportedData, "text messages are not supported")
+		case opClose, opPing, opPong:
+			if !fin || length > maxControlPayload {
+				return c.fail(CloseProtocolError, "invalid control frame")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				return err
+			}
+			c.unmask(payload)
+			switch opcode {
+			case opPing:
+				if err := c.writeFrame(opPong, payload); err != nil {
+					return err
+				}
+			case opClose:
+				// A close payload holds a 2 byte status code, if any.
+				if len(payload) == 1 {
+					return c.fail(CloseProtocolError, "invalid close payload")
+				}
+				// Echo the status code, completing the closing handshake.
+				_ = c.writeFrame(opClose, payload[:min(len(payload), 2)])
+				return io.EOF
+			}
+		default:
+			return c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode))
+		}
+	}
+}
+
+func (c *Conn) unmask(b []byte) {
+	if c.client {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// fail closes the connection with the status code, and returns an error wrapping ErrProtocol.
+func (c *Conn) fail(code uint16, reason string) error {
+	_ = c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, code))
+	_ = c.conn.Close()
+	return errors.Join(ErrProtocol, errors.New(reason))
+}
+
+// Write sends p as a single binary message.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		c.closed = true
+		c.dmu.Lock()
+		defer c.dmu.Unlock()
+		deadline := time.Now().Add(closeTimeout)
+		if !c.writeDeadline.IsZero() && c.writeDeadline.Before(deadline) {
+			deadline = c.writeDeadline
+		}
+		if err := c.conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+		defer c.conn.SetWriteDeadline(c.writeDeadline)
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, finBit|opcode)
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskFlag|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !c.client {
+		frame = append(frame, payload...)
+		_, err := c.conn.Write(frame)
+		return err
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range frame[start:] {
+		frame[start+i] ^= mask[i&3]
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame with CloseNormal, and closes the underlying connection.
+func (c *Conn) Close() error {
+	_ = c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, CloseNormal))
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,241 @@
+// Package ws carries bisp frames over WebSocket connections, as specified by RFC 6455. Each binary WebSocket message
+// carries a single bisp frame. Only the standard library is used.
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sindrebakk1/bisp"
+)
+
+// Subprotocol is the WebSocket subprotocol negotiated for bisp connections.
+const Subprotocol = "bisp"
+
+// acceptGUID is appended to the Sec-WebSocket-Key to compute the Sec-WebSocket-Accept header.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrBadHandshake = errors.New("bad websocket handshake")
+
+type Opts struct {
+	// ConnOpts are the options of the bisp.Conn wrapping the WebSocket connection.
+	ConnOpts *bisp.ConnOpts
+	// Header holds extra headers of the handshake request sent by Dial, such as Origin or Authorization.
+	Header http.Header
+	// TLSConfig is the configuration of wss connections made by Dial.
+	TLSConfig *tls.Config
+	// CheckOrigin reports whether Upgrade accepts the handshake request. By default, requests with an Origin header
+	// are only accepted if its host matches the Host header, so browsers can't connect from other sites.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Upgrade upgrades the HTTP connection of r to a WebSocket connection, and returns it as a bisp.Conn. On failure, an
+// HTTP error response has been written.
+func Upgrade(w http.ResponseWriter, r *http.Request, opts *Opts) (*bisp.Conn, error) {
+	conn, err := Accept(w, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	return bisp.NewConn(conn, connOpts(opts)), nil
+}
+
+// Handler returns a handler upgrading requests to WebSocket connections served by s. Errors serving a connection are
+// reported to ServerOpts.OnError, as they are by Server.Serve.
+func Handler(s *bisp.Server, opts *Opts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Accept(w, r, opts)
+		if err != nil {
+			return
+		}
+		// The server wraps the connection in a bisp.Conn with ServerOpts.ConnOpts.
+		s.ReportError(s.ServeConn(conn))
+	})
+}
+
+// Accept performs the server side of the opening handshake, and returns the WebSocket connection.
+func Accept(w http.ResponseWriter, r *http.Request, opts *Opts) (*Conn, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	fail := func(status int, msg string) (*Conn, error) {
+		http.Error(w, msg, status)
+		return nil, errors.Join(ErrBadHandshake, errors.New(msg))
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		return fail(http.StatusMethodNotAllowed, "method not allowed")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return fail(http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return fail(http.StatusForbidden, "origin not allowed")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "connection can't be hijacked")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+
+	res := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", Subprotocol) {
+		res += "Sec-WebSocket-Protocol: " + Subprotocol + "\r\n"
+	}
+	if _, err = brw.WriteString(res + "\r\n"); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// Dial opens a WebSocket connection to rawURL, a ws or wss URL, and returns it as a bisp.Conn.
+func Dial(ctx context.Context, rawURL string, opts *Opts) (*bisp.Conn, error) {
+	conn, err := DialConn(ctx, rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	return bisp.NewConn(conn, connOpts(opts)), nil
+}
+
+// DialConn performs the client side of the opening handshake, and returns the WebSocket connection.
+func DialConn(ctx context.Context, rawURL string, opts *Opts) (*Conn, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	case "wss":
+		conn, err = (&tls.Dialer{Config: opts.TLSConfig}).DialContext(ctx, "tcp", host)
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported websocket scheme %q", u.Scheme))
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The handshake is bounded by the context.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	var nonce [16]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", Subprotocol)
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(res.Header, "Upgrade", "websocket") ||
+		!headerContains(res.Header, "Connection", "upgrade") ||
+		res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		_ = conn.Close()
+		return nil, errors.Join(ErrBadHandshake, errors.New(fmt.Sprintf("unexpected response %s", res.Status)))
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	return newConn(conn, br, true), nil
+}
+
+func connOpts(opts *Opts) *bisp.ConnOpts {
+	if opts == nil {
+		return nil
+	}
+	return opts.ConnOpts
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether the comma separated list of the header name holds token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
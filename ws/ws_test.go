@@ -0,0 +1,229 @@
+package ws_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sindrebakk1/bisp"
+	"github.com/sindrebakk1/bisp/ws"
+	"github.com/stretchr/testify/assert"
+)
+
+type TestProcedureAdd struct {
+	bisp.Procedure[int]
+	A int
+	B int
+}
+
+func init() {
+	bisp.RegisterProcedure[TestProcedureAdd]()
+}
+
+func wsURL(ts *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestHandler_Call(t *testing.T) {
+	srv := bisp.NewServer(nil)
+	bisp.Handle(srv, func(ctx context.Context, p *TestProcedureAdd) error {
+		p.Out = p.A + p.B
+		return nil
+	})
+	ts := httptest.NewServer(ws.Handler(srv, nil))
+	defer ts.Close()
+
+	conn, err := ws.DialConn(context.Background(), wsURL(ts), nil)
+	assert.NoError(t, err)
+	client := bisp.NewClient(conn, nil)
+	defer client.Close()
+	for i := range 10 {
+		res, err := bisp.CallProcedure(context.Background(), client, TestProcedureAdd{A: i, B: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, i+2, res.Out)
+	}
+}
+
+func TestHandler_Error(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := bisp.NewServer(&bisp.ServerOpts{OnError: func(err error) { errs <- err }})
+	ts := httptest.NewServer(ws.Handler(srv, nil))
+	defer ts.Close()
+
+	// An unmasked frame from the client fails the connection being served.
+	conn, _ := rawHandshake(t, ts)
+	_, err := conn.Write([]byte{0x82, 1, 'x'})
+	assert.NoError(t, err)
+	select {
+	case err = <-errs:
+		assert.ErrorIs(t, err, ws.ErrProtocol)
+	case <-time.After(time.Second):
+		t.Fatal("error not reported")
+	}
+}
+
+func TestDial_SendReceive(t *testing.T) {
+	// The server echoes every message.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ws.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			if err = conn.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	conn, err := ws.Dial(context.Background(), wsURL(ts), &ws.Opts{ConnOpts: &bisp.ConnOpts{HeartbeatInterval: 10 * time.Millisecond}})
+	assert.NoError(t, err)
+	defer conn.Close()
+	for _, body := range []string{"Hello", strings.Repeat("a", 200), strings.Repeat("b", bisp.MaxTcpMessageBodySize-bisp.LengthSize)} {
+		assert.NoError(t, conn.Send(&bisp.Message{Body: body}))
+		msg, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, body, msg.Body)
+	}
+}
+
+func TestAccept_BadHandshake(t *testing.T) {
+	ts := httptest.NewServer(ws.Handler(bisp.NewServer(nil), nil))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	_, err = ws.DialConn(context.Background(), wsURL(ts), &ws.Opts{Header: http.Header{"Origin": {"https://example.com"}}})
+	assert.ErrorIs(t, err, ws.ErrBadHandshake)
+
+	_, err = ws.DialConn(context.Background(), "http"+strings.TrimPrefix(ts.URL, "http"), nil)
+	assert.Error(t, err)
+}
+
+// rawHandshake opens a connection to ts and performs the opening handshake by hand, so frames can be written directly.
+func rawHandshake(t *testing.T, ts *httptest.Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	assert.NoError(t, req.Write(conn))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	// The example of RFC 6455 section 1.3.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+	return conn, br
+}
+
+func TestConn_Protocol(t *testing.T) {
+	accepted := make(chan *ws.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ws.Accept(w, r, nil)
+		if err == nil {
+			accepted <- conn
+		}
+	}))
+	defer ts.Close()
+
+	conn, br := rawHandshake(t, ts)
+	server := <-accepted
+	defer server.Close()
+
+	// A masked ping is answered with an unmasked pong carrying the same payload, and a fragmented message is read as
+	// a whole.
+	mask := []byte{1, 2, 3, 4}
+	masked := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ mask[i%4]
+		}
+		return append(append([]byte{}, mask...), out...)
+	}
+	frames := append([]byte{0x89, 0x80 | 2}, masked([]byte("hi"))...)
+	frames = append(frames, append([]byte{0x02, 0x80 | 3}, masked([]byte("abc"))...)...)
+	frames = append(frames, append([]byte{0x80, 0x80 | 3}, masked([]byte("def"))...)...)
+	_, err := conn.Write(frames)
+	assert.NoError(t, err)
+
+	b := make([]byte, 6)
+	_, err = io.ReadFull(server, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdef", string(b))
+	pong := make([]byte, 4)
+	_, err = io.ReadFull(br, pong)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x8A, 2, 'h', 'i'}, pong)
+
+	// An unmasked frame from the client fails the connection with a protocol error.
+	_, err = conn.Write([]byte{0x82, 1, 'x'})
+	assert.NoError(t, err)
+	_, err = server.Read(b)
+	assert.ErrorIs(t, err, ws.ErrProtocol)
+	closeFrame := make([]byte, 4)
+	_, err = io.ReadFull(br, closeFrame)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x88), closeFrame[0])
+	assert.Equal(t, uint16(ws.CloseProtocolError), binary.BigEndian.Uint16(closeFrame[2:]))
+}
+
+func TestConn_Close(t *testing.T) {
+	accepted := make(chan *ws.Conn, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ws.Accept(w, r, nil)
+		if err == nil {
+			accepted <- conn
+		}
+	}))
+	defer ts.Close()
+	mask := []byte{1, 2, 3, 4}
+
+	// A close frame without a status code is echoed without one.
+	conn, br := rawHandshake(t, ts)
+	server := <-accepted
+	_, err := conn.Write(append([]byte{0x88, 0x80}, mask...))
+	assert.NoError(t, err)
+	_, err = server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	closeFrame := make([]byte, 2)
+	_, err = io.ReadFull(br, closeFrame)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x88, 0}, closeFrame)
+	server.Close()
+
+	// A close payload of a single byte is answered with CloseProtocolError, rather than echoed.
+	conn, br = rawHandshake(t, ts)
+	server = <-accepted
+	defer server.Close()
+	_, err = conn.Write(append(append([]byte{0x88, 0x80 | 1}, mask...), 0x03^mask[0]))
+	assert.NoError(t, err)
+	_, err = server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ws.ErrProtocol)
+	closeFrame = make([]byte, 4)
+	_, err = io.ReadFull(br, closeFrame)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x88, 2}, closeFrame[:2])
+	assert.Equal(t, uint16(ws.CloseProtocolError), binary.BigEndian.Uint16(closeFrame[2:]))
+}